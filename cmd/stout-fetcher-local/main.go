@@ -0,0 +1,31 @@
+// stout-fetcher-local is a layer fetcher for Porto copying layers
+// from a local directory. See pkg/fetcher for the protocol.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	flag "github.com/ogier/pflag"
+
+	"github.com/interiorem/stout/pkg/fetcher"
+)
+
+var dir string
+
+func init() {
+	flag.StringVarP(&dir, "dir", "d", "", "directory with layers")
+	flag.Parse()
+}
+
+func main() {
+	if dir == "" {
+		fmt.Fprintln(os.Stderr, "--dir must be set")
+		os.Exit(2)
+	}
+	local := fetcher.Local{Dir: dir}
+	if err := local.Serve(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
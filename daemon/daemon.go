@@ -103,6 +103,12 @@ func (d *Daemon) RegisterHTTPHandlers(ctx context.Context, mux *http.ServeMux) {
 				w.Write(data)
 			}
 		}(name))
+
+		if provider, ok := d.boxes[name].(isolate.HTTPHandlersProvider); ok {
+			for path, handler := range provider.HTTPHandlers(ctx) {
+				http.Handle("/"+path+"/"+name, handler)
+			}
+		}
 	}
 }
 
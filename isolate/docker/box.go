@@ -8,6 +8,7 @@ import (
 	"io"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -45,7 +46,7 @@ type Box struct {
 	ctx          context.Context
 	cancellation context.CancelFunc
 
-	client *client.Client
+	endpoints []*dockerEndpoint
 
 	spawnSM semaphore.Semaphore
 
@@ -55,6 +56,8 @@ type Box struct {
 
 	muContainers sync.Mutex
 	containers   map[string]*process
+
+	credentials *credentialStore
 }
 
 type dockerBoxConfig struct {
@@ -62,6 +65,11 @@ type dockerBoxConfig struct {
 	APIVersion       string            `json:"version"`
 	SpawnConcurrency uint              `json:"concurrency"`
 	RegistryAuth     map[string]string `json:"registryauth"`
+	// Named Docker daemons. If it is empty, `endpoint` and `version` are used
+	Endpoints map[string]endpointConfig `json:"endpoints"`
+	// Path to Docker config.json with `auths`, `credHelpers` or `credsStore`
+	CredentialsFile string        `json:"credentials"`
+	ImageGC         imageGCConfig `json:"imagegc"`
 }
 
 // NewBox ...
@@ -69,6 +77,11 @@ func NewBox(ctx context.Context, cfg isolate.BoxConfig, gstate isolate.GlobalSta
 	var config = &dockerBoxConfig{
 		DockerEndpoint:   client.DefaultDockerHost,
 		SpawnConcurrency: defaultSpawnConcurrency,
+		ImageGC: imageGCConfig{
+			PeriodSec:     defaultImageGCPeriod,
+			HighThreshold: defaultImageGCHighThreshold,
+			LowThreshold:  defaultImageGCLowThreshold,
+		},
 	}
 
 	decoderConfig := mapstructure.DecoderConfig{
@@ -86,7 +99,7 @@ func NewBox(ctx context.Context, cfg isolate.BoxConfig, gstate isolate.GlobalSta
 		return nil, err
 	}
 
-	client, err := client.NewClient(config.DockerEndpoint, config.APIVersion, nil, defaultHeaders)
+	endpoints, err := newDockerEndpoints(config)
 	if err != nil {
 		return nil, err
 	}
@@ -96,25 +109,40 @@ func NewBox(ctx context.Context, cfg isolate.BoxConfig, gstate isolate.GlobalSta
 		ctx:          ctx,
 		cancellation: cancellation,
 
-		client:     client,
+		endpoints:  endpoints,
 		spawnSM:    semaphore.New(config.SpawnConcurrency),
 		config:     config,
 		state: gstate,
 		containers: make(map[string]*process),
 	}
 
+	if config.CredentialsFile != "" {
+		box.credentials = newCredentialStore(config.CredentialsFile)
+		if _, err = box.credentials.reload(ctx); err != nil {
+			cancellation()
+			return nil, fmt.Errorf("unable to load credentials %s: %v", config.CredentialsFile, err)
+		}
+	}
+
 	body, err := json.Marshal(config)
 	if err != nil {
 		return nil, err
 	}
 	dockerConfig.Set(string(body))
 
-	go box.watchEvents()
+	for _, endpoint := range endpoints {
+		go box.watchEvents(endpoint)
+
+		if config.ImageGC.Enable {
+			gcCtx := log.WithLogger(ctx, log.G(ctx).WithField("endpoint", endpoint.name))
+			go newImageGC(endpoint.client, config.ImageGC, endpoint.images).run(gcCtx)
+		}
+	}
 
 	return box, nil
 }
 
-func (b *Box) watchEvents() {
+func (b *Box) watchEvents(endpoint *dockerEndpoint) {
 	const dieEvent = "die"
 
 	since := time.Now()
@@ -132,7 +160,7 @@ func (b *Box) watchEvents() {
 		Time   int64  `json:"time"`
 	}
 
-	logger := log.G(b.ctx)
+	logger := log.G(b.ctx).WithField("endpoint", endpoint.name)
 
 	for {
 		eventsOptions := types.EventsOptions{
@@ -141,7 +169,7 @@ func (b *Box) watchEvents() {
 		}
 
 		logger.Infof("listening Docker events since %s with filters %s", eventsOptions.Since, fltrs)
-		resp, err := b.client.Events(b.ctx, eventsOptions)
+		resp, err := endpoint.client.Events(b.ctx, eventsOptions)
 		switch err {
 		case nil:
 			sleep = time.Second
@@ -163,14 +191,18 @@ func (b *Box) watchEvents() {
 					var p *process
 					b.muContainers.Lock()
 					p, ok := b.containers[eventResponse.ID]
-					delete(b.containers, eventResponse.ID)
+					if ok && p.endpoint == endpoint {
+						delete(b.containers, eventResponse.ID)
+					} else {
+						ok = false
+					}
 					b.muContainers.Unlock()
 					if ok {
 						p.remove()
 					} else {
 						// NOTE: it could be orphaned worker from our previous launch
 						logger.WithField("id", eventResponse.ID).Warn("unknown container will be removed")
-						containerRemove(b.client, b.ctx, eventResponse.ID)
+						containerRemove(endpoint.client, b.ctx, eventResponse.ID)
 					}
 
 				default:
@@ -221,12 +253,18 @@ func (b *Box) Spawn(ctx context.Context, config isolate.SpawnConfig, output io.W
 	}
 	defer b.spawnSM.Release()
 
+	endpoint := b.pickEndpoint(ctx, config.Name, profile)
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("endpoint", endpoint.name))
+
 	containersCreatedCounter.Inc(1)
-	pr, err := newContainer(ctx, b.client, profile, config.Name, config.Executable, config.Args, config.Env)
+	pr, err := newContainer(ctx, endpoint.client, profile, config.Name, config.Executable, config.Args, config.Env)
 	if err != nil {
 		containersErroredCounter.Inc(1)
 		return nil, err
 	}
+	pr.endpoint = endpoint
+
+	endpoint.images.Used(pr.image)
 
 	b.muContainers.Lock()
 	b.containers[pr.containerID] = pr
@@ -246,7 +284,7 @@ func (b *Box) Inspect(ctx context.Context, workeruuid string) ([]byte, error) {
 	for cid, container := range b.containers {
 		if container.uuid == workeruuid {
 			b.muContainers.Unlock()
-			_, data, err := b.client.ContainerInspectWithRaw(ctx, cid, false)
+			_, data, err := container.endpoint.client.ContainerInspectWithRaw(ctx, cid, false)
 			return data, err
 		}
 	}
@@ -254,6 +292,39 @@ func (b *Box) Inspect(ctx context.Context, workeruuid string) ([]byte, error) {
 	return []byte("{}"), nil
 }
 
+// pickEndpoint returns the endpoint requested by the profile
+// or the one with the least number of containers among endpoints
+// the image of the app has been spooled to
+func (b *Box) pickEndpoint(ctx context.Context, name string, profile *Profile) *dockerEndpoint {
+	if profile.Endpoint != "" {
+		if endpoint := lookupEndpoint(b.endpoints, profile.Endpoint); endpoint != nil {
+			return endpoint
+		}
+		log.G(ctx).WithField("endpoint", profile.Endpoint).Warn("unknown endpoint in the profile, least loaded one will be used")
+	}
+
+	// Spool may have failed on some endpoints. If the app has not been
+	// spooled at all, e.g. it uses a local image, any endpoint will do.
+	var endpoints []*dockerEndpoint
+	for _, endpoint := range b.endpoints {
+		if endpoint.images.HasSpooled(name) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if len(endpoints) == 0 {
+		endpoints = b.endpoints
+	}
+
+	var load = make(map[*dockerEndpoint]int, len(b.endpoints))
+	b.muContainers.Lock()
+	for _, container := range b.containers {
+		load[container.endpoint]++
+	}
+	b.muContainers.Unlock()
+
+	return leastLoadedEndpoint(endpoints, load)
+}
+
 // Spool spools an image with a tag latest
 func (b *Box) Spool(ctx context.Context, name string, opts isolate.RawProfile) (err error) {
 	profile, err := decodeProfile(opts)
@@ -276,11 +347,64 @@ func (b *Box) Spool(ctx context.Context, name string, opts isolate.RawProfile) (
 
 	if registryAuth, ok := b.config.RegistryAuth[profile.Registry]; ok {
 		pullOpts.RegistryAuth = registryAuth
+	} else if b.credentials != nil {
+		registryAuth, err := b.credentials.RegistryAuth(ctx, profile.Registry)
+		if err != nil {
+			// NOTE: the registry may allow anonymous pulls, so do not give up
+			log.G(ctx).WithError(err).WithField("registry", profile.Registry).Warn("unable to get credentials")
+		}
+		pullOpts.RegistryAuth = registryAuth
 	}
 
-	body, err := b.client.ImagePull(ctx, ref, pullOpts)
+	// The image is pulled to every endpoint the app could be spawned on
+	var endpoints = b.endpoints
+	if profile.Endpoint != "" {
+		endpoint := lookupEndpoint(b.endpoints, profile.Endpoint)
+		if endpoint == nil {
+			err = fmt.Errorf("unknown Docker endpoint %s in the profile", profile.Endpoint)
+			log.G(ctx).WithError(err).WithField("name", name).Error("unable to spool an image")
+			return err
+		}
+		endpoints = []*dockerEndpoint{endpoint}
+	}
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(endpoints))
+	)
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func(i int, endpoint *dockerEndpoint) {
+			defer wg.Done()
+			errs[i] = pullImage(ctx, endpoint, name, ref, pullOpts)
+		}(i, endpoint)
+	}
+	wg.Wait()
+
+	// The app is spawned on endpoints which have got the image,
+	// so a single unavailable daemon does not fail the spool
+	var failed []string
+	for i, endpoint := range endpoints {
+		if errs[i] != nil {
+			endpoint.images.Unspooled(name)
+			failed = append(failed, fmt.Sprintf("%s: %v", endpoint.name, errs[i]))
+		}
+	}
+	switch {
+	case len(failed) == len(endpoints):
+		return fmt.Errorf("unable to pull %s to any endpoint: %s", ref, strings.Join(failed, "; "))
+	case len(failed) > 0:
+		log.G(ctx).WithField("ref", ref).Warnf("the image has not been pulled to some endpoints: %s", strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+func pullImage(ctx context.Context, endpoint *dockerEndpoint, name, ref string, pullOpts types.ImagePullOptions) error {
+	logger := log.G(ctx).WithField("endpoint", endpoint.name)
+	body, err := endpoint.client.ImagePull(ctx, ref, pullOpts)
 	if err != nil {
-		log.G(ctx).WithError(err).WithField("ref", ref).Error("unable to pull an image")
+		logger.WithError(err).WithField("ref", ref).Error("unable to pull an image")
 		return err
 	}
 	defer body.Close()
@@ -289,6 +413,7 @@ func (b *Box) Spool(ctx context.Context, name string, opts isolate.RawProfile) (
 		return err
 	}
 
+	endpoint.images.Spooled(name, ref)
 	return nil
 }
 
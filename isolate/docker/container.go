@@ -42,6 +42,8 @@ type process struct {
 	client *client.Client
 
 	containerID string
+	image       string
+	endpoint    *dockerEndpoint
 
 	removed uint32
 
@@ -138,6 +140,7 @@ func newContainer(ctx context.Context, client *client.Client, profile *Profile,
 		cancellation: cancel,
 		client:       client,
 		containerID:  resp.ID,
+		image:        image,
 		uuid:         workeruuid,
 	}
 
@@ -123,8 +123,10 @@ func TestImagePullFromRegistry(t *testing.T) {
 
 	ctx := context.Background()
 	box := Box{
-		ctx:    ctx,
-		client: client,
+		ctx: ctx,
+		endpoints: []*dockerEndpoint{
+			{name: defaultEndpointName, host: endpoint, client: client, images: newImageTracker()},
+		},
 		config: &dockerBoxConfig{},
 	}
 
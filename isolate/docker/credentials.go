@@ -0,0 +1,207 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/pkg/log"
+)
+
+const (
+	credentialHelperPrefix = "docker-credential-"
+	// Username returned by credential helpers for identity tokens
+	tokenUsername = "<token>"
+
+	defaultIndexServer = "index.docker.io/v1"
+
+	credentialHelperTimeout = 30 * time.Second
+)
+
+// dockerConfigFile is a subset of ~/.docker/config.json
+type dockerConfigFile struct {
+	Auths       map[string]types.AuthConfig `json:"auths"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+	CredsStore  string                      `json:"credsStore"`
+}
+
+// credentialHelperReply is a reply of `docker-credential-<name> get`
+type credentialHelperReply struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// can be overwritten for tests
+var runCredentialHelper = func(ctx context.Context, helper string, registry string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, credentialHelperTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, credentialHelperPrefix+helper, "get")
+	cmd.Stdin = strings.NewReader(registry)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("credential helper %s failed: %v %s", helper, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// credentialStore reads Docker config.json and resolves registry credentials
+// either from `auths` or via credential helpers. The file is re-read
+// as soon as its modification time or size changes.
+type credentialStore struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	config  dockerConfigFile
+}
+
+func newCredentialStore(path string) *credentialStore {
+	return &credentialStore{path: path}
+}
+
+// reload re-reads the file if it has changed. The last successfully
+// loaded config is returned if it can not be read.
+func (s *credentialStore) reload(ctx context.Context) (dockerConfigFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return s.config, err
+	}
+
+	if fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return s.config, nil
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return s.config, err
+	}
+	defer f.Close()
+
+	var config dockerConfigFile
+	if err = json.NewDecoder(f).Decode(&config); err != nil {
+		return s.config, err
+	}
+
+	log.G(ctx).WithField("path", s.path).Info("docker credentials have been reloaded")
+	s.config = config
+	s.modTime = fi.ModTime()
+	s.size = fi.Size()
+	return s.config, nil
+}
+
+// RegistryAuth returns base64 encoded AuthConfig to be passed as ImagePullOptions.RegistryAuth.
+// Empty string is returned if there are no credentials for the registry.
+func (s *credentialStore) RegistryAuth(ctx context.Context, registry string) (string, error) {
+	// A broken or removed file, e.g. one being rewritten, does not drop
+	// credentials loaded before: reload returns them along with the error
+	config, err := s.reload(ctx)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("path", s.path).Warn("unable to reload docker credentials, the last loaded ones are used")
+	}
+
+	auth, found, err := resolveCredentials(ctx, config, registry)
+	if err != nil || !found {
+		return "", err
+	}
+
+	return encodeAuthConfig(auth)
+}
+
+func resolveCredentials(ctx context.Context, config dockerConfigFile, registry string) (types.AuthConfig, bool, error) {
+	registry = normalizeRegistry(registry)
+
+	for server, helper := range config.CredHelpers {
+		if normalizeRegistry(server) == registry {
+			return fromCredentialHelper(ctx, helper, server)
+		}
+	}
+
+	for server, auth := range config.Auths {
+		if normalizeRegistry(server) != registry {
+			continue
+		}
+
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return auth, false, fmt.Errorf("invalid auth for %s: %v", server, err)
+			}
+			userpass := strings.SplitN(string(decoded), ":", 2)
+			if len(userpass) != 2 {
+				return auth, false, fmt.Errorf("invalid auth for %s: must be formatted as user:password", server)
+			}
+			auth.Username, auth.Password = userpass[0], userpass[1]
+			auth.Auth = ""
+		}
+		auth.ServerAddress = server
+		return auth, true, nil
+	}
+
+	if config.CredsStore != "" {
+		return fromCredentialHelper(ctx, config.CredsStore, registry)
+	}
+
+	return types.AuthConfig{}, false, nil
+}
+
+func fromCredentialHelper(ctx context.Context, helper, server string) (types.AuthConfig, bool, error) {
+	out, err := runCredentialHelper(ctx, helper, server)
+	if err != nil {
+		return types.AuthConfig{}, false, err
+	}
+
+	var reply credentialHelperReply
+	if err = json.Unmarshal(out, &reply); err != nil {
+		return types.AuthConfig{}, false, fmt.Errorf("unable to decode reply of credential helper %s: %v", helper, err)
+	}
+
+	auth := types.AuthConfig{ServerAddress: server}
+	if reply.Username == tokenUsername {
+		auth.IdentityToken = reply.Secret
+	} else {
+		auth.Username = reply.Username
+		auth.Password = reply.Secret
+	}
+	return auth, true, nil
+}
+
+func encodeAuthConfig(auth types.AuthConfig) (string, error) {
+	body, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(body), nil
+}
+
+// normalizeRegistry strips a scheme and a trailing slash,
+// so `https://registry.io/` matches `registry.io`
+func normalizeRegistry(registry string) string {
+	if i := strings.Index(registry, "://"); i >= 0 {
+		registry = registry[i+3:]
+	}
+	registry = strings.TrimSuffix(registry, "/")
+
+	switch registry {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return defaultIndexServer
+	}
+	return registry
+}
@@ -0,0 +1,105 @@
+package docker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func decodeRegistryAuth(t *testing.T, payload string) types.AuthConfig {
+	body, err := base64.URLEncoding.DecodeString(payload)
+	require.NoError(t, err)
+	var auth types.AuthConfig
+	require.NoError(t, json.Unmarshal(body, &auth))
+	return auth
+}
+
+func TestCredentialStore(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	defer func(f func(context.Context, string, string) ([]byte, error)) { runCredentialHelper = f }(runCredentialHelper)
+	runCredentialHelper = func(ctx context.Context, helper string, registry string) ([]byte, error) {
+		switch helper {
+		case "ecr":
+			return []byte(`{"ServerURL":"` + registry + `","Username":"AWS","Secret":"ecrsecret"}`), nil
+		case "store":
+			return []byte(`{"ServerURL":"` + registry + `","Username":"<token>","Secret":"identity"}`), nil
+		}
+		return nil, fmt.Errorf("unknown helper %s", helper)
+	}
+
+	dir, err := ioutil.TempDir("", "credentials")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+
+	const config = `{
+		"auths": {
+			"https://registry.local/": {"auth": "` + "dXNlcjpwYXNz" + `"},
+			"https://index.docker.io/v1/": {"username": "hub", "password": "hubpass"}
+		},
+		"credHelpers": {"aws.ecr.local": "ecr"}
+	}`
+	require.NoError(ioutil.WriteFile(path, []byte(config), 0600))
+
+	store := newCredentialStore(path)
+
+	payload, err := store.RegistryAuth(ctx, "registry.local")
+	require.NoError(err)
+	auth := decodeRegistryAuth(t, payload)
+	require.Equal("user", auth.Username)
+	require.Equal("pass", auth.Password)
+	require.Empty(auth.Auth)
+
+	payload, err = store.RegistryAuth(ctx, "docker.io")
+	require.NoError(err)
+	require.Equal("hub", decodeRegistryAuth(t, payload).Username)
+
+	payload, err = store.RegistryAuth(ctx, "aws.ecr.local")
+	require.NoError(err)
+	auth = decodeRegistryAuth(t, payload)
+	require.Equal("AWS", auth.Username)
+	require.Equal("ecrsecret", auth.Password)
+
+	payload, err = store.RegistryAuth(ctx, "unknown.local")
+	require.NoError(err)
+	require.Empty(payload)
+
+	// credsStore is used for registries without explicit credentials
+	// and the file is re-read after modification
+	require.NoError(ioutil.WriteFile(path, []byte(`{"credsStore": "store"}`), 0600))
+	future := time.Now().Add(time.Minute)
+	require.NoError(os.Chtimes(path, future, future))
+
+	payload, err = store.RegistryAuth(ctx, "unknown.local")
+	require.NoError(err)
+	auth = decodeRegistryAuth(t, payload)
+	require.Equal("identity", auth.IdentityToken)
+	require.Empty(auth.Username)
+
+	// a broken file does not drop the credentials loaded before
+	require.NoError(ioutil.WriteFile(path, []byte(`{"credsStore": `), 0600))
+	future = future.Add(time.Minute)
+	require.NoError(os.Chtimes(path, future, future))
+	_, err = store.reload(ctx)
+	require.Error(err)
+
+	payload, err = store.RegistryAuth(ctx, "unknown.local")
+	require.NoError(err)
+	require.Equal("identity", decodeRegistryAuth(t, payload).IdentityToken)
+
+	require.NoError(os.Remove(path))
+	payload, err = store.RegistryAuth(ctx, "unknown.local")
+	require.NoError(err)
+	require.Equal("identity", decodeRegistryAuth(t, payload).IdentityToken)
+}
@@ -0,0 +1,137 @@
+package docker
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/go-connections/tlsconfig"
+)
+
+const defaultEndpointName = "default"
+
+type endpointTLSConfig struct {
+	CA                 string `json:"ca"`
+	Cert               string `json:"cert"`
+	Key                string `json:"key"`
+	InsecureSkipVerify bool   `json:"insecure"`
+}
+
+type endpointConfig struct {
+	// unix:///var/run/docker.sock or tcp://host:2376
+	Host       string             `json:"host"`
+	APIVersion string             `json:"version"`
+	TLS        *endpointTLSConfig `json:"tls"`
+}
+
+// dockerEndpoint is a Docker daemon the Box spawns containers on
+type dockerEndpoint struct {
+	name   string
+	host   string
+	client *client.Client
+	images *imageTracker
+}
+
+func newDockerEndpoint(name string, cfg endpointConfig) (*dockerEndpoint, error) {
+	if cfg.Host == "" {
+		return nil, fmt.Errorf("host of Docker endpoint %s is not specified", name)
+	}
+
+	var httpClient *http.Client
+	if cfg.TLS != nil {
+		options := tlsconfig.Options{
+			CAFile:             cfg.TLS.CA,
+			CertFile:           cfg.TLS.Cert,
+			KeyFile:            cfg.TLS.Key,
+			InsecureSkipVerify: cfg.TLS.InsecureSkipVerify,
+		}
+		tlsc, err := tlsconfig.Client(options)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS configuration of Docker endpoint %s: %v", name, err)
+		}
+
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsc,
+			},
+		}
+	}
+
+	cl, err := client.NewClient(cfg.Host, cfg.APIVersion, httpClient, defaultHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dockerEndpoint{
+		name:   name,
+		host:   cfg.Host,
+		client: cl,
+		images: newImageTracker(),
+	}, nil
+}
+
+// newDockerEndpoints creates endpoints sorted by name.
+// The legacy single `endpoint` option is used if `endpoints` section is empty.
+func newDockerEndpoints(config *dockerBoxConfig) ([]*dockerEndpoint, error) {
+	if len(config.Endpoints) == 0 {
+		endpoint, err := newDockerEndpoint(defaultEndpointName, endpointConfig{
+			Host:       config.DockerEndpoint,
+			APIVersion: config.APIVersion,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []*dockerEndpoint{endpoint}, nil
+	}
+
+	var endpoints = make([]*dockerEndpoint, 0, len(config.Endpoints))
+	for name, cfg := range config.Endpoints {
+		if cfg.APIVersion == "" {
+			cfg.APIVersion = config.APIVersion
+		}
+		endpoint, err := newDockerEndpoint(name, cfg)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	sort.Sort(endpointsByName(endpoints))
+	return endpoints, nil
+}
+
+// lookupEndpoint finds an endpoint either by its name or by its host
+func lookupEndpoint(endpoints []*dockerEndpoint, name string) *dockerEndpoint {
+	for _, endpoint := range endpoints {
+		if endpoint.name == name {
+			return endpoint
+		}
+	}
+
+	for _, endpoint := range endpoints {
+		if endpoint.host == name {
+			return endpoint
+		}
+	}
+
+	return nil
+}
+
+// leastLoadedEndpoint picks an endpoint with the smallest number of containers.
+// Ties are broken by the order of endpoints.
+func leastLoadedEndpoint(endpoints []*dockerEndpoint, load map[*dockerEndpoint]int) *dockerEndpoint {
+	var picked *dockerEndpoint
+	for _, endpoint := range endpoints {
+		if picked == nil || load[endpoint] < load[picked] {
+			picked = endpoint
+		}
+	}
+	return picked
+}
+
+type endpointsByName []*dockerEndpoint
+
+func (e endpointsByName) Len() int           { return len(e) }
+func (e endpointsByName) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e endpointsByName) Less(i, j int) bool { return e[i].name < e[j].name }
@@ -0,0 +1,138 @@
+package docker
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/isolate"
+)
+
+func TestNewDockerEndpoints(t *testing.T) {
+	require := require.New(t)
+
+	endpoints, err := newDockerEndpoints(&dockerBoxConfig{
+		DockerEndpoint: "unix:///var/run/docker.sock",
+	})
+	require.NoError(err)
+	require.Len(endpoints, 1)
+	require.Equal(defaultEndpointName, endpoints[0].name)
+
+	endpoints, err = newDockerEndpoints(&dockerBoxConfig{
+		DockerEndpoint: "unix:///var/run/docker.sock",
+		APIVersion:     "v1.19",
+		Endpoints: map[string]endpointConfig{
+			"remote": {Host: "tcp://10.0.0.1:2375"},
+			"local":  {Host: "unix:///var/run/docker.sock", APIVersion: "v1.24"},
+		},
+	})
+	require.NoError(err)
+	require.Len(endpoints, 2)
+	require.Equal("local", endpoints[0].name)
+	require.Equal("v1.24", endpoints[0].client.ClientVersion())
+	require.Equal("remote", endpoints[1].name)
+	require.Equal("v1.19", endpoints[1].client.ClientVersion())
+
+	_, err = newDockerEndpoints(&dockerBoxConfig{
+		Endpoints: map[string]endpointConfig{
+			"remote": {Host: "tcp://10.0.0.1:2376", TLS: &endpointTLSConfig{CA: "/nonexistent/ca.pem"}},
+		},
+	})
+	require.Error(err)
+
+	_, err = newDockerEndpoints(&dockerBoxConfig{
+		Endpoints: map[string]endpointConfig{"empty": {}},
+	})
+	require.Error(err)
+}
+
+func TestPickEndpoint(t *testing.T) {
+	require := require.New(t)
+
+	a := &dockerEndpoint{name: "a", host: "tcp://a:2375", images: newImageTracker()}
+	b := &dockerEndpoint{name: "b", host: "tcp://b:2375", images: newImageTracker()}
+	endpoints := []*dockerEndpoint{a, b}
+
+	require.Equal(b, lookupEndpoint(endpoints, "b"))
+	require.Equal(a, lookupEndpoint(endpoints, "tcp://a:2375"))
+	require.Nil(lookupEndpoint(endpoints, "c"))
+
+	require.Equal(a, leastLoadedEndpoint(endpoints, nil))
+	require.Equal(b, leastLoadedEndpoint(endpoints, map[*dockerEndpoint]int{a: 2, b: 1}))
+	require.Equal(a, leastLoadedEndpoint(endpoints, map[*dockerEndpoint]int{a: 1, b: 1}))
+
+	ctx := context.Background()
+	box := &Box{
+		endpoints: endpoints,
+		containers: map[string]*process{
+			"1": {endpoint: a},
+		},
+	}
+	require.Equal(b, box.pickEndpoint(ctx, "app", &Profile{}))
+	require.Equal(a, box.pickEndpoint(ctx, "app", &Profile{Endpoint: "a"}))
+	require.Equal(b, box.pickEndpoint(ctx, "app", &Profile{Endpoint: "unknown"}))
+
+	// the app is spawned where its image has been spooled to
+	a.images.Spooled("app", "registry/app")
+	require.Equal(a, box.pickEndpoint(ctx, "app", &Profile{}))
+	require.Equal(b, box.pickEndpoint(ctx, "other", &Profile{}))
+}
+
+func TestSpoolToEndpoints(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	var pulls int32
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/images/create") {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&pulls, 1)
+		fmt.Fprintln(w, `{"status": "Downloaded newer image"}`)
+	}))
+	defer registry.Close()
+
+	endpoints, err := newDockerEndpoints(&dockerBoxConfig{
+		APIVersion: "v1.19",
+		Endpoints: map[string]endpointConfig{
+			"alive": {Host: "tcp://" + registry.Listener.Addr().String()},
+			"dead":  {Host: "tcp://127.0.0.1:1"},
+		},
+	})
+	require.NoError(err)
+	alive, dead := endpoints[0], endpoints[1]
+	box := &Box{
+		endpoints:  endpoints,
+		config:     &dockerBoxConfig{},
+		containers: map[string]*process{"1": {endpoint: alive}},
+	}
+
+	spool := func(profile map[string]interface{}) error {
+		opts, err := isolate.NewRawProfile(profile)
+		require.NoError(err)
+		return box.Spool(ctx, "app", opts)
+	}
+
+	err = spool(map[string]interface{}{"registry": "registry", "endpoint": "unknown"})
+	require.EqualError(err, "unknown Docker endpoint unknown in the profile")
+	require.Equal(int32(0), atomic.LoadInt32(&pulls))
+
+	err = spool(map[string]interface{}{"registry": "registry", "endpoint": "dead"})
+	require.Error(err)
+	require.Contains(err.Error(), "dead: ")
+
+	// a dead daemon does not fail the spool to other endpoints,
+	// the app is spawned on the ones which have the image
+	require.NoError(spool(map[string]interface{}{"registry": "registry"}))
+	require.Equal(int32(1), atomic.LoadInt32(&pulls))
+	require.True(alive.images.HasSpooled("app"))
+	require.False(dead.images.HasSpooled("app"))
+	require.Equal(alive, box.pickEndpoint(ctx, "app", &Profile{}))
+}
@@ -0,0 +1,394 @@
+package docker
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/pkg/log"
+)
+
+const (
+	defaultImageGCPeriod        = 300
+	defaultImageGCHighThreshold = 85
+	defaultImageGCLowThreshold  = 75
+
+	noneTag = "<none>:<none>"
+)
+
+type imageGCConfig struct {
+	Enable bool `json:"enable"`
+	// How often the collector runs
+	PeriodSec uint `json:"period_sec"`
+	// Disk usage of the Docker root (in percents) which triggers the eviction
+	HighThreshold uint `json:"high_threshold"`
+	// Disk usage (in percents) the eviction tries to reach
+	LowThreshold uint `json:"low_threshold"`
+	// Unreferenced images unused longer than TTL are removed regardless of disk usage.
+	// The usage is not persisted: after a restart TTL is counted from the start
+	// or from the moment the last container of the image has gone.
+	// Zero disables TTL based removal.
+	TTLSec uint `json:"ttl_sec"`
+	// Path used to measure disk usage. DockerRootDir reported by Docker is used if empty
+	Root string `json:"root"`
+	// Images with a tag starting with one of these prefixes are never removed
+	Exclude []string `json:"exclude"`
+}
+
+// imageGCClient is a subset of client.APIClient used by the collector
+type imageGCClient interface {
+	ImageList(ctx context.Context, options types.ImageListOptions) ([]types.Image, error)
+	ImageRemove(ctx context.Context, image string, options types.ImageRemoveOptions) ([]types.ImageDelete, error)
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	Info(ctx context.Context) (types.Info, error)
+}
+
+// can be overwritten for tests
+var diskUsage = func(path string) (float64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+
+	if st.Blocks == 0 {
+		return 0, nil
+	}
+
+	return float64(st.Blocks-st.Bfree) * 100 / float64(st.Blocks), nil
+}
+
+// normalizeRef appends the default tag to a reference without a tag
+// to make it comparable with RepoTags reported by Docker
+func normalizeRef(ref string) string {
+	if strings.Contains(ref, "@") {
+		return ref
+	}
+
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref
+	}
+
+	return ref + ":latest"
+}
+
+// imageTracker remembers which references are spooled by applications
+// and when every reference has been used for the last time
+type imageTracker struct {
+	mu       sync.Mutex
+	started  time.Time
+	spooled  map[string]string
+	lastUsed map[string]time.Time
+}
+
+func newImageTracker() *imageTracker {
+	return &imageTracker{
+		started:  time.Now(),
+		spooled:  make(map[string]string),
+		lastUsed: make(map[string]time.Time),
+	}
+}
+
+// Spooled marks ref as the current image of the application
+func (t *imageTracker) Spooled(app, ref string) {
+	ref = normalizeRef(ref)
+	t.mu.Lock()
+	t.spooled[app] = ref
+	t.lastUsed[ref] = time.Now()
+	t.mu.Unlock()
+}
+
+// Unspooled forgets the image of the application,
+// which could not be updated
+func (t *imageTracker) Unspooled(app string) {
+	t.mu.Lock()
+	delete(t.spooled, app)
+	t.mu.Unlock()
+}
+
+// HasSpooled reports whether an image of the application has been spooled
+func (t *imageTracker) HasSpooled(app string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.spooled[app]
+	return ok
+}
+
+// seen updates the last usage time of images of existing containers
+func (t *imageTracker) seen(refs map[string]struct{}, now time.Time) {
+	t.mu.Lock()
+	for ref := range refs {
+		t.lastUsed[ref] = now
+	}
+	t.mu.Unlock()
+}
+
+// Used updates the last usage time of ref
+func (t *imageTracker) Used(ref string) {
+	ref = normalizeRef(ref)
+	t.mu.Lock()
+	t.lastUsed[ref] = time.Now()
+	t.mu.Unlock()
+}
+
+func (t *imageTracker) isSpooled(ref string) bool {
+	for _, spooled := range t.spooled {
+		if spooled == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// LastUsed returns the latest usage time among the image ID and its tags.
+// Images which have not been seen since the start of the daemon are considered
+// to be used at the start, so TTL is counted from it.
+func (t *imageTracker) LastUsed(image types.Image) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	last := t.started
+	for _, ref := range append([]string{image.ID}, image.RepoTags...) {
+		if used, ok := t.lastUsed[ref]; ok && used.After(last) {
+			last = used
+		}
+	}
+	return last
+}
+
+// Forget drops the usage history of a removed image
+func (t *imageTracker) Forget(image types.Image) {
+	t.mu.Lock()
+	delete(t.lastUsed, image.ID)
+	for _, ref := range image.RepoTags {
+		delete(t.lastUsed, ref)
+	}
+	t.mu.Unlock()
+}
+
+type gcCandidate struct {
+	image    types.Image
+	lastUsed time.Time
+}
+
+type imageGC struct {
+	client  imageGCClient
+	config  imageGCConfig
+	tracker *imageTracker
+}
+
+func newImageGC(client imageGCClient, config imageGCConfig, tracker *imageTracker) *imageGC {
+	if config.PeriodSec == 0 {
+		config.PeriodSec = defaultImageGCPeriod
+	}
+	if config.LowThreshold > config.HighThreshold {
+		config.LowThreshold = config.HighThreshold
+	}
+
+	return &imageGC{
+		client:  client,
+		config:  config,
+		tracker: tracker,
+	}
+}
+
+func (gc *imageGC) run(ctx context.Context) {
+	period := time.Duration(gc.config.PeriodSec) * time.Second
+	log.G(ctx).Infof("start image gc every %s", period)
+	for {
+		select {
+		case <-time.After(period):
+			if err := gc.collect(ctx); err != nil {
+				imagesGCErrorsCounter.Inc(1)
+				log.G(ctx).WithError(err).Error("image gc failed")
+			}
+		case <-ctx.Done():
+			log.G(ctx).Info("image gc has been stopped")
+			return
+		}
+	}
+}
+
+func (gc *imageGC) root(ctx context.Context) (string, error) {
+	if gc.config.Root != "" {
+		return gc.config.Root, nil
+	}
+
+	info, err := gc.client.Info(ctx)
+	if err != nil {
+		return "", err
+	}
+	return info.DockerRootDir, nil
+}
+
+// candidates returns unreferenced images sorted from the least recently used one
+func (gc *imageGC) candidates(ctx context.Context) ([]gcCandidate, error) {
+	images, err := gc.client.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	containers, err := gc.client.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	inUse := make(map[string]struct{}, len(containers)*2)
+	for _, cnt := range containers {
+		inUse[cnt.ImageID] = struct{}{}
+		inUse[normalizeRef(cnt.Image)] = struct{}{}
+	}
+	// Images of containers are being used, even of the ones created
+	// before the restart, so TTL is counted from when the last container is gone
+	gc.tracker.seen(inUse, time.Now())
+
+	gc.tracker.mu.Lock()
+	var candidates = make([]gcCandidate, 0, len(images))
+	for _, image := range images {
+		if gc.isReferenced(image, inUse) {
+			continue
+		}
+		candidates = append(candidates, gcCandidate{image: image})
+	}
+	gc.tracker.mu.Unlock()
+
+	for i := range candidates {
+		candidates[i].lastUsed = gc.tracker.LastUsed(candidates[i].image)
+	}
+
+	sort.Sort(byLastUsed(candidates))
+	return candidates, nil
+}
+
+// isReferenced must be called with tracker.mu held
+func (gc *imageGC) isReferenced(image types.Image, inUse map[string]struct{}) bool {
+	if _, ok := inUse[image.ID]; ok {
+		return true
+	}
+
+	for _, tag := range image.RepoTags {
+		if tag == noneTag {
+			continue
+		}
+
+		if _, ok := inUse[tag]; ok {
+			return true
+		}
+
+		if gc.tracker.isSpooled(tag) {
+			return true
+		}
+
+		for _, prefix := range gc.config.Exclude {
+			if strings.HasPrefix(tag, prefix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// collect removes expired images and evicts least recently used ones
+// while the disk usage is above the threshold
+func (gc *imageGC) collect(ctx context.Context) (err error) {
+	defer log.G(ctx).Trace("collect images").Stop(&err)
+	start := time.Now()
+	defer imagesGCTimer.UpdateSince(start)
+
+	candidates, err := gc.candidates(ctx)
+	if err != nil {
+		return err
+	}
+
+	if gc.config.TTLSec > 0 {
+		ttl := time.Duration(gc.config.TTLSec) * time.Second
+		rest := candidates[:0]
+		for _, candidate := range candidates {
+			if start.Sub(candidate.lastUsed) > ttl {
+				log.G(ctx).WithField("id", candidate.image.ID).Infof("image has not been used since %s", candidate.lastUsed)
+				if gc.remove(ctx, candidate.image) == nil {
+					continue
+				}
+			}
+			rest = append(rest, candidate)
+		}
+		candidates = rest
+	}
+
+	root, err := gc.root(ctx)
+	if err != nil {
+		return err
+	}
+
+	usage, err := diskUsage(root)
+	if err != nil {
+		return err
+	}
+	dockerDiskUsage.Update(int64(usage))
+
+	if usage < float64(gc.config.HighThreshold) {
+		return nil
+	}
+
+	log.G(ctx).Warnf("disk usage of %s is %.1f%%, evict images down to %d%%", root, usage, gc.config.LowThreshold)
+	for _, candidate := range candidates {
+		if usage < float64(gc.config.LowThreshold) {
+			break
+		}
+
+		if gc.remove(ctx, candidate.image) != nil {
+			continue
+		}
+
+		if usage, err = diskUsage(root); err != nil {
+			return err
+		}
+		dockerDiskUsage.Update(int64(usage))
+	}
+
+	return nil
+}
+
+// remove deletes the image. Tagged images are untagged one by one,
+// as Docker refuses to remove an image referenced by several repositories
+// without force
+func (gc *imageGC) remove(ctx context.Context, image types.Image) (err error) {
+	defer log.G(ctx).WithField("id", image.ID).Trace("removing image").Stop(&err)
+
+	removeOpts := types.ImageRemoveOptions{
+		Force:         false,
+		PruneChildren: true,
+	}
+
+	var refs []string
+	for _, tag := range image.RepoTags {
+		if tag != noneTag {
+			refs = append(refs, tag)
+		}
+	}
+	if len(refs) == 0 {
+		refs = []string{image.ID}
+	}
+
+	for _, ref := range refs {
+		if _, err = gc.client.ImageRemove(ctx, ref, removeOpts); err != nil {
+			imagesGCErrorsCounter.Inc(1)
+			return err
+		}
+	}
+
+	imagesRemovedCounter.Inc(1)
+	gc.tracker.Forget(image)
+	return nil
+}
+
+type byLastUsed []gcCandidate
+
+func (b byLastUsed) Len() int           { return len(b) }
+func (b byLastUsed) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLastUsed) Less(i, j int) bool { return b[i].lastUsed.Before(b[j].lastUsed) }
@@ -0,0 +1,129 @@
+package docker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type fakeGCClient struct {
+	images     []types.Image
+	containers []types.Container
+	removed    []string
+	// disk usage drops by this value after every removal
+	step float64
+}
+
+func (f *fakeGCClient) ImageList(ctx context.Context, options types.ImageListOptions) ([]types.Image, error) {
+	return f.images, nil
+}
+
+func (f *fakeGCClient) ImageRemove(ctx context.Context, image string, options types.ImageRemoveOptions) ([]types.ImageDelete, error) {
+	if options.Force {
+		return nil, fmt.Errorf("gc must not force removal")
+	}
+	f.removed = append(f.removed, image)
+	return nil, nil
+}
+
+func (f *fakeGCClient) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	return f.containers, nil
+}
+
+func (f *fakeGCClient) Info(ctx context.Context) (types.Info, error) {
+	return types.Info{DockerRootDir: "/var/lib/docker"}, nil
+}
+
+func TestNormalizeRef(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("alpine:latest", normalizeRef("alpine"))
+	assert.Equal("alpine:3.4", normalizeRef("alpine:3.4"))
+	assert.Equal("localhost:5000/app:latest", normalizeRef("localhost:5000/app"))
+	assert.Equal("localhost:5000/app:v1", normalizeRef("localhost:5000/app:v1"))
+	assert.Equal("app@sha256:abcd", normalizeRef("app@sha256:abcd"))
+}
+
+func TestImageGCEvictsLRU(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	cl := &fakeGCClient{
+		images: []types.Image{
+			{ID: "sha256:running", RepoTags: []string{"registry/running:latest"}},
+			{ID: "sha256:spooled", RepoTags: []string{"registry/spooled:latest"}},
+			{ID: "sha256:old", RepoTags: []string{noneTag}},
+			{ID: "sha256:older", RepoTags: []string{"registry/older:latest", "registry/older:v1"}},
+			{ID: "sha256:excluded", RepoTags: []string{"base/ubuntu:latest"}},
+		},
+		containers: []types.Container{
+			{ID: "cid", Image: "registry/running", ImageID: "sha256:running"},
+		},
+	}
+
+	usage := 90.0
+	defer func(f func(string) (float64, error)) { diskUsage = f }(diskUsage)
+	diskUsage = func(path string) (float64, error) {
+		require.Equal("/var/lib/docker", path)
+		return usage - 10*float64(len(cl.removed)), nil
+	}
+
+	tracker := newImageTracker()
+	tracker.Spooled("spooled", "registry/spooled")
+	tracker.lastUsed["sha256:older"] = time.Now().Add(-time.Hour)
+	tracker.lastUsed["sha256:old"] = time.Now()
+
+	gc := newImageGC(cl, imageGCConfig{HighThreshold: 85, LowThreshold: 60, Exclude: []string{"base/"}}, tracker)
+	require.NoError(gc.collect(ctx))
+	require.Equal([]string{"registry/older:latest", "registry/older:v1", "sha256:old"}, cl.removed)
+
+	// below the threshold nothing is removed
+	cl.removed = nil
+	usage = 50
+	require.NoError(gc.collect(ctx))
+	require.Empty(cl.removed)
+}
+
+func TestImageGCTTL(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	cl := &fakeGCClient{
+		images: []types.Image{
+			{ID: "sha256:fresh", RepoTags: []string{"registry/fresh:latest"}},
+			{ID: "sha256:stale", RepoTags: []string{"registry/stale:latest"}},
+		},
+	}
+
+	defer func(f func(string) (float64, error)) { diskUsage = f }(diskUsage)
+	diskUsage = func(path string) (float64, error) {
+		return 10, nil
+	}
+
+	tracker := newImageTracker()
+	tracker.started = time.Now().Add(-time.Hour)
+	tracker.Used("registry/fresh")
+
+	gc := newImageGC(cl, imageGCConfig{HighThreshold: 85, LowThreshold: 75, TTLSec: 60}, tracker)
+	require.NoError(gc.collect(ctx))
+	require.Equal([]string{"registry/stale:latest"}, cl.removed)
+
+	// an image used by a container created before the restart
+	// expires once TTL has passed since the container is gone
+	cl.images = []types.Image{{ID: "sha256:worker", RepoTags: []string{"registry/worker:latest"}}}
+	cl.containers = []types.Container{{ImageID: "sha256:worker", Image: "registry/worker"}}
+	cl.removed = nil
+	require.NoError(gc.collect(ctx))
+	cl.containers = nil
+	require.NoError(gc.collect(ctx))
+	require.Empty(cl.removed)
+
+	tracker.lastUsed["sha256:worker"] = time.Now().Add(-time.Hour)
+	tracker.lastUsed["registry/worker:latest"] = time.Now().Add(-time.Hour)
+	require.NoError(gc.collect(ctx))
+	require.Equal([]string{"registry/worker:latest"}, cl.removed)
+}
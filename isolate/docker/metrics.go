@@ -17,6 +17,13 @@ var (
 
 	totalSpawnTimer = metrics.NewTimer()
 
+	// images removed by the image gc
+	imagesRemovedCounter  = metrics.NewCounter()
+	imagesGCErrorsCounter = metrics.NewCounter()
+	imagesGCTimer         = metrics.NewTimer()
+	// disk usage of the Docker root in percents
+	dockerDiskUsage = metrics.NewGauge()
+
 	dockerConfig = expvar.NewString("docker_config")
 )
 
@@ -26,4 +33,8 @@ func init() {
 	registry.Register("containers_created", containersCreatedCounter)
 	registry.Register("containers_errored", containersErroredCounter)
 	registry.Register("total_spawn_timer", totalSpawnTimer)
+	registry.Register("images_removed", imagesRemovedCounter)
+	registry.Register("images_gc_errors", imagesGCErrorsCounter)
+	registry.Register("images_gc_timer", imagesGCTimer)
+	registry.Register("disk_usage", dockerDiskUsage)
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"strings"
 	"time"
 
@@ -29,6 +30,12 @@ type (
 		Close() error
 	}
 
+	// HTTPHandlersProvider is implemented by boxes which serve extra HTTP endpoints.
+	// A handler is registered as /<path>/<name of the box>.
+	HTTPHandlersProvider interface {
+		HTTPHandlers(ctx context.Context) map[string]http.Handler
+	}
+
 	ResponseStream interface {
 		Write(ctx context.Context, num uint64, data []byte) error
 		Error(ctx context.Context, num uint64, code [2]int, msg string) error
@@ -74,6 +81,8 @@ type (
 			DbPath string `json:"dbpath,omitempty"`
 			AllowLocalState bool `json:"allowlocalstate,omitempty"`
 			Headers map[string]string `json:"headers,omitempty"`
+			Allocator string `json:"allocator,omitempty"`
+			PoolFile string `json:"poolfile,omitempty"`
 		} `json:"mtn,omitempty"`
 	}
 )
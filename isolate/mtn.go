@@ -1,12 +1,10 @@
 package isolate
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"sync"
 	"time"
@@ -50,12 +48,15 @@ type MtnCfg struct {
 	SchedLabel string
 	Headers map[string]string
 	DbPath string
+	Allocator string
+	PoolFile string
 }
 
 type MtnState struct {
 	AllocMu sync.Mutex
 	Cfg MtnCfg
 	Db *bolt.DB
+	Allocator NetworkAllocator
 }
 
 type Allocation struct {
@@ -130,6 +131,14 @@ func (c *MtnState) CfgInit(ctx context.Context, cfg *Config) bool {
 	}
 	c.Cfg.Url = cfg.Mtn.Url
 	c.Cfg.Headers = cfg.Mtn.Headers
+	c.Cfg.Allocator = cfg.Mtn.Allocator
+	c.Cfg.PoolFile = cfg.Mtn.PoolFile
+	allocator, err := NewNetworkAllocator(&c.Cfg)
+	if err != nil {
+		log.G(ctx).Errorf("Cant create network allocator inside CfgInit(), returned: %s", err)
+		return false
+	}
+	c.Allocator = allocator
 
 	if len(cfg.Mtn.DbPath) > 1 {
 		c.Cfg.DbPath = cfg.Mtn.DbPath
@@ -218,102 +227,55 @@ func (c *MtnState) PoolInit(ctx context.Context) error {
 			}
 		}
 	}
+	if c.Cfg.Allocator == AllocatorStatic {
+		if err := c.DropStaleAllocs(ctx, tx, allAllocs); err != nil {
+			return &MtnError{fmt.Sprintf("Cant drop stale allocations inside PoolInit(), err: %s", err), ErrStdb}
+		}
+	}
 	if err := tx.Commit(); err != nil {
 		return &MtnError{fmt.Sprint("Cant commit transaction inside PoolInit(), err: %s", err), ErrStdb}
 	}
 	return nil
 }
 
-func (c *MtnState) GetAllocations(logCtx context.Context) (map[string][]Allocation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
-	defer cancel()
-	req, errReq := http.NewRequest("GET", c.Cfg.Url + "?scheduler=" + c.Cfg.SchedLabel, nil)
-	if errReq != nil {
-		return nil, errReq
-	}
-	for header, value := range c.Cfg.Headers {
-		req.Header.Set(header, value)
-	}
-	req = req.WithContext(ctx)
-	rh, errDo := http.DefaultClient.Do(req)
-	var bufBody bytes.Buffer
-	Body := io.TeeReader(rh.Body, &bufBody)
-	if errDo != nil {
-		if rh.StatusCode == 400 {
-			errResp := AllocError{}
-			decoder := json.NewDecoder(Body)
-			errDecode := decoder.Decode(&errResp)
-			if errDecode != nil {
-				return nil, fmt.Errorf(
-					"Cant allocate. Request error: %s. Internal error: %s. Caused: %s. Raw body: %s.",
-					errDo,
-					errResp.Message[0],
-					errResp.Cause.Message[0],
-					&bufBody,
-				)
+// DropStaleAllocs removes free allocations which have been removed from the static pool
+func (c *MtnState) DropStaleAllocs(ctx context.Context, tx *bolt.Tx, pool map[string][]Allocation) error {
+	var stored []Allocation
+	errBkLs := tx.ForEach(func(netId []byte, b *bolt.Bucket) error {
+		return b.ForEach(func(allocId []byte, value []byte) error {
+			var a Allocation
+			if err := json.Unmarshal(value, &a); err != nil {
+				return err
 			}
-			return nil, fmt.Errorf(
-				"Cant allocate. Request error: %s. Body parse error: %s. Raw body: %s.",
-				errDo,
-				errDecode,
-				&bufBody,
-			)
-		}
-		return nil, errDo
-	}
-	defer rh.Body.Close()
-	r := make(map[string][]Allocation)
-	jresp := []RawAlloc{}
-	decoder := json.NewDecoder(Body)
-	log.G(ctx).Debugf("reqHttp.Body from allocator getted in GetAllocations(): %s", &bufBody)
-	errDecode := decoder.Decode(&jresp)
-	if errDecode != nil {
-		return nil, errDecode
+			a.NetId, a.Id = string(netId), string(allocId)
+			stored = append(stored, a)
+			return nil
+		})
+	})
+	if errBkLs != nil {
+		return errBkLs
 	}
-	for _, a := range jresp {
-		r[a.Network] = append(r[a.Network], Allocation{a.Porto.Net, a.Porto.Hostname, a.Porto.Ip, a.Id, a.Network, "", false})
+	for netId, ids := range staleAllocations(pool, stored) {
+		b := tx.Bucket([]byte(netId))
+		for _, id := range ids {
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+			log.G(ctx).Infof("Allocation %s of net id %s is not in the pool anymore, dropped.", id, netId)
+		}
 	}
-	log.G(logCtx).Debugf("GetAllocations() successfull ended with ContentLength size %d.", req.ContentLength)
-	return r, nil
+	return nil
+}
+
+func (c *MtnState) GetAllocations(ctx context.Context) (map[string][]Allocation, error) {
+	return c.Allocator.Allocations(ctx)
 }
 
 func (c *MtnState) RequestAllocs(ctx context.Context, netid string) (map[string]Allocation, error) {
-	r := make(map[string]Allocation)
-	httpCtx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
-	defer cancel()
-	jsonBody := PostAllocreq{netid, c.Cfg.Ident, c.Cfg.SchedLabel}
-	txtBody, errMrsh := json.Marshal(jsonBody)
-	if errMrsh != nil {
-		return nil, errMrsh
-	}
 	log.G(ctx).Debugf("c.Cfg.Allocbuffer inside RequestAllocs() is %d.", c.Cfg.Allocbuffer)
-	for i := 0; i < c.Cfg.Allocbuffer; i++ {
-		req, errNewReq := http.NewRequest("POST", c.Cfg.Url, bytes.NewReader(txtBody))
-		if errNewReq != nil {
-			return nil, errNewReq
-		}
-		for header, value := range c.Cfg.Headers {
-			req.Header.Set(header, value)
-		}
-		req.Header.Set("Content-Type", "application/json")
-		req = req.WithContext(httpCtx)
-		reqHttp, errDo := http.DefaultClient.Do(req)
-		var bufBody bytes.Buffer
-		Body := io.TeeReader(reqHttp.Body, &bufBody)
-		if errDo != nil {
-			log.G(ctx).Errorf("Inside RequestAllocs(), erro: %s. Body: %s.", errDo, &bufBody)
-			return nil, errDo
-		}
-		jsonResp := RawAlloc{}
-		decoder := json.NewDecoder(Body)
-		errDecode := decoder.Decode(&jsonResp)
-		log.G(ctx).Debugf("RequestAllocs() reqHttp.Body from allocator getted in RequestAllocs(): %s", &bufBody)
-		reqHttp.Body.Close()
-		if errDecode != nil {
-			return nil, errDecode
-		}
-		log.G(ctx).Debugf("Allocation from allocator getted in RequestAllocs(): %s", jsonResp)
-		r[jsonResp.Id] = Allocation{jsonResp.Porto.Net, jsonResp.Porto.Hostname, jsonResp.Porto.Ip, jsonResp.Id, netid, "", false}
+	r, err := c.Allocator.Request(ctx, netid, c.Cfg.Allocbuffer)
+	if err != nil {
+		return nil, err
 	}
 	log.G(ctx).Debugf("RequestAllocs() successfull ended with %s.", r)
 	return r, nil
@@ -402,6 +364,9 @@ func (c *MtnState) GetDbAlloc(ctx context.Context, tx *bolt.Tx, netId string, bo
 		log.G(ctx).Errorf("Last hope in GetDbAlloc() failed.")
 		return a, errAllocs
 	}
+	if len(allocs) == 0 {
+		return a, fmt.Errorf("No free allocations left in network %s.", netId)
+	}
 	gotcha := false
 	b, errCrBk := tx.CreateBucketIfNotExists([]byte(netId))
 	if errCrBk != nil {
@@ -445,6 +410,19 @@ func (c *MtnState) FreeDbAlloc(ctx context.Context, netId string, id string) err
 	if err := json.Unmarshal(v, &a); err != nil {
 		return err
 	}
+	if c.Cfg.Allocator == AllocatorStatic {
+		pool, err := c.Allocator.Allocations(ctx)
+		if err != nil {
+			return err
+		}
+		if !inPool(pool, netId, id) {
+			log.G(ctx).Infof("Freed allocation %s of net id %s is not in the pool anymore, dropped.", id, netId)
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}
+	}
 	a.Used = false
 	value, errMrsh := json.Marshal(a)
 	if errMrsh != nil {
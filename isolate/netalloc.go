@@ -0,0 +1,127 @@
+package isolate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/interiorem/stout/pkg/log"
+)
+
+// Types of network allocators
+const (
+	AllocatorHTTP   = "http"
+	AllocatorStatic = "static"
+)
+
+// NetworkAllocator provides addresses and hostnames of MTN networks.
+// MtnState keeps allocations in its DB and marks them used by containers.
+type NetworkAllocator interface {
+	// Allocations returns allocations assigned to the host grouped by network ids
+	Allocations(ctx context.Context) (map[string][]Allocation, error)
+	// Request asks for up to count new allocations in the network.
+	// The result is keyed by ids of allocations.
+	Request(ctx context.Context, netId string, count int) (map[string]Allocation, error)
+}
+
+// NewNetworkAllocator creates the allocator chosen by the configuration
+func NewNetworkAllocator(cfg *MtnCfg) (NetworkAllocator, error) {
+	switch cfg.Allocator {
+	case "", AllocatorHTTP:
+		return &httpAllocator{cfg: cfg}, nil
+	case AllocatorStatic:
+		return newStaticAllocator(cfg.PoolFile)
+	default:
+		return nil, fmt.Errorf("unknown network allocator %q, expected %s or %s", cfg.Allocator, AllocatorHTTP, AllocatorStatic)
+	}
+}
+
+// httpAllocator requests allocations from the remote allocator service
+type httpAllocator struct {
+	cfg *MtnCfg
+}
+
+func (c *httpAllocator) Allocations(logCtx context.Context) (map[string][]Allocation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, errReq := http.NewRequest("GET", c.cfg.Url+"?scheduler="+c.cfg.SchedLabel, nil)
+	if errReq != nil {
+		return nil, errReq
+	}
+	for header, value := range c.cfg.Headers {
+		req.Header.Set(header, value)
+	}
+	req = req.WithContext(ctx)
+	rh, errDo := http.DefaultClient.Do(req)
+	if errDo != nil {
+		return nil, errDo
+	}
+	defer rh.Body.Close()
+	var bufBody bytes.Buffer
+	Body := io.TeeReader(rh.Body, &bufBody)
+	if rh.StatusCode == 400 {
+		errResp := AllocError{}
+		decoder := json.NewDecoder(Body)
+		if errDecode := decoder.Decode(&errResp); errDecode != nil || len(errResp.Message) == 0 || len(errResp.Cause.Message) == 0 {
+			return nil, fmt.Errorf("Cant get allocations. Body parse error: %v. Raw body: %s.", errDecode, &bufBody)
+		}
+		return nil, fmt.Errorf("Cant get allocations. Internal error: %s. Caused: %s. Raw body: %s.", errResp.Message[0], errResp.Cause.Message[0], &bufBody)
+	}
+	r := make(map[string][]Allocation)
+	jresp := []RawAlloc{}
+	decoder := json.NewDecoder(Body)
+	errDecode := decoder.Decode(&jresp)
+	log.G(logCtx).Debugf("reqHttp.Body from allocator getted in GetAllocations(): %s", &bufBody)
+	if errDecode != nil {
+		return nil, errDecode
+	}
+	for _, a := range jresp {
+		r[a.Network] = append(r[a.Network], Allocation{a.Porto.Net, a.Porto.Hostname, a.Porto.Ip, a.Id, a.Network, "", false})
+	}
+	log.G(logCtx).Debugf("GetAllocations() successfull ended with ContentLength size %d.", rh.ContentLength)
+	return r, nil
+}
+
+func (c *httpAllocator) Request(ctx context.Context, netid string, count int) (map[string]Allocation, error) {
+	r := make(map[string]Allocation)
+	httpCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	jsonBody := PostAllocreq{netid, c.cfg.Ident, c.cfg.SchedLabel}
+	txtBody, errMrsh := json.Marshal(jsonBody)
+	if errMrsh != nil {
+		return nil, errMrsh
+	}
+	for i := 0; i < count; i++ {
+		req, errNewReq := http.NewRequest("POST", c.cfg.Url, bytes.NewReader(txtBody))
+		if errNewReq != nil {
+			return nil, errNewReq
+		}
+		for header, value := range c.cfg.Headers {
+			req.Header.Set(header, value)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req = req.WithContext(httpCtx)
+		reqHttp, errDo := http.DefaultClient.Do(req)
+		if errDo != nil {
+			log.G(ctx).Errorf("Inside RequestAllocs(), erro: %s.", errDo)
+			return nil, errDo
+		}
+		var bufBody bytes.Buffer
+		Body := io.TeeReader(reqHttp.Body, &bufBody)
+		jsonResp := RawAlloc{}
+		decoder := json.NewDecoder(Body)
+		errDecode := decoder.Decode(&jsonResp)
+		log.G(ctx).Debugf("RequestAllocs() reqHttp.Body from allocator getted in RequestAllocs(): %s", &bufBody)
+		reqHttp.Body.Close()
+		if errDecode != nil {
+			return nil, errDecode
+		}
+		log.G(ctx).Debugf("Allocation from allocator getted in RequestAllocs(): %s", jsonResp)
+		r[jsonResp.Id] = Allocation{jsonResp.Porto.Net, jsonResp.Porto.Hostname, jsonResp.Porto.Ip, jsonResp.Id, netid, "", false}
+	}
+	return r, nil
+}
@@ -0,0 +1,226 @@
+package isolate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strings"
+)
+
+// maxStaticRangeSize limits the number of addresses of a single range of the pool
+const maxStaticRangeSize = 1 << 16
+
+// StaticPool is the file read by the static allocator
+//
+//	{
+//	  "networks": {
+//	    "<netid>": {
+//	      "net": "L3 veth",
+//	      "hostname": "worker-{ip}.example.net",
+//	      "ranges": ["10.1.0.10-10.1.0.20", "2a02:6b8:c00::/120"],
+//	      "hosts": [{"ip": "10.1.1.1", "hostname": "db.example.net"}]
+//	    }
+//	  }
+//	}
+//
+// `{ip}` in the hostname template is replaced with the address with dots and colons turned into dashes.
+type StaticPool struct {
+	Networks map[string]StaticNetwork `json:"networks"`
+}
+
+// StaticNetwork lists addresses of a network. Addresses of ranges get hostnames from the template.
+type StaticNetwork struct {
+	Net      string       `json:"net"`
+	Hostname string       `json:"hostname"`
+	Ranges   []string     `json:"ranges"`
+	Hosts    []StaticHost `json:"hosts"`
+}
+
+// StaticHost is an address with its own hostname
+type StaticHost struct {
+	Ip       string `json:"ip"`
+	Hostname string `json:"hostname"`
+}
+
+// staticAllocator hands out addresses of a pool read from the local file,
+// so per-container networking works without the remote allocator
+type staticAllocator struct {
+	allocs map[string][]Allocation
+}
+
+func newStaticAllocator(path string) (*staticAllocator, error) {
+	if path == "" {
+		return nil, fmt.Errorf("poolfile must be set for the %s allocator", AllocatorStatic)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pool StaticPool
+	if err = json.Unmarshal(data, &pool); err != nil {
+		return nil, fmt.Errorf("unable to decode pool file %s: %v", path, err)
+	}
+	allocs, err := pool.allocations()
+	if err != nil {
+		return nil, fmt.Errorf("invalid pool file %s: %v", path, err)
+	}
+	return &staticAllocator{allocs: allocs}, nil
+}
+
+func (p *StaticPool) allocations() (map[string][]Allocation, error) {
+	allocs := make(map[string][]Allocation, len(p.Networks))
+	seen := make(map[string]string)
+	for netId, network := range p.Networks {
+		add := func(ip net.IP, hostname string) error {
+			id := ip.String()
+			if other, ok := seen[id]; ok {
+				return fmt.Errorf("address %s of network %s is already in network %s", id, netId, other)
+			}
+			seen[id] = netId
+			allocs[netId] = append(allocs[netId], Allocation{network.Net, hostname, id, id, netId, "", false})
+			return nil
+		}
+
+		for _, host := range network.Hosts {
+			ip := net.ParseIP(host.Ip)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q of network %s", host.Ip, netId)
+			}
+			if host.Hostname == "" {
+				return nil, fmt.Errorf("hostname of %s in network %s must be set", host.Ip, netId)
+			}
+			if err := add(ip, host.Hostname); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(network.Ranges) > 0 && !strings.Contains(network.Hostname, "{ip}") {
+			return nil, fmt.Errorf("hostname template of network %s must contain {ip}", netId)
+		}
+		for _, r := range network.Ranges {
+			first, last, err := parseAddressRange(r)
+			if err != nil {
+				return nil, fmt.Errorf("network %s: %v", netId, err)
+			}
+			for ip := first; ; ip = nextIP(ip) {
+				if err := add(ip, staticHostname(network.Hostname, ip)); err != nil {
+					return nil, err
+				}
+				if ip.Equal(last) {
+					break
+				}
+			}
+		}
+	}
+	return allocs, nil
+}
+
+// parseAddressRange parses `first-last` or CIDR. The network and broadcast
+// addresses of IPv4 CIDR are skipped.
+func parseAddressRange(r string) (net.IP, net.IP, error) {
+	var first, last net.IP
+	if strings.Contains(r, "/") {
+		_, ipnet, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		first = ipnet.IP
+		last = make(net.IP, len(first))
+		for i := range first {
+			last[i] = first[i] | ^ipnet.Mask[i]
+		}
+		if ones, bits := ipnet.Mask.Size(); bits == 32 && bits-ones > 1 {
+			first, last = nextIP(first), prevIP(last)
+		}
+	} else {
+		bounds := strings.SplitN(r, "-", 2)
+		if len(bounds) != 2 {
+			return nil, nil, fmt.Errorf("invalid range %q, expected first-last or CIDR", r)
+		}
+		first, last = net.ParseIP(strings.TrimSpace(bounds[0])), net.ParseIP(strings.TrimSpace(bounds[1]))
+		if first == nil || last == nil {
+			return nil, nil, fmt.Errorf("invalid range %q, expected first-last or CIDR", r)
+		}
+		if (first.To4() == nil) != (last.To4() == nil) {
+			return nil, nil, fmt.Errorf("invalid range %q: addresses of different families", r)
+		}
+		if first.To4() != nil {
+			first, last = first.To4(), last.To4()
+		}
+	}
+
+	size := new(big.Int).Sub(new(big.Int).SetBytes(last), new(big.Int).SetBytes(first))
+	if size.Sign() < 0 {
+		return nil, nil, fmt.Errorf("invalid range %q: the first address is greater than the last one", r)
+	}
+	if size.Cmp(big.NewInt(maxStaticRangeSize)) >= 0 {
+		return nil, nil, fmt.Errorf("range %q is larger than %d addresses", r, maxStaticRangeSize)
+	}
+	return first, last, nil
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP(nil), ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		if next[i]++; next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func prevIP(ip net.IP) net.IP {
+	prev := append(net.IP(nil), ip...)
+	for i := len(prev) - 1; i >= 0; i-- {
+		if prev[i]--; prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
+
+func staticHostname(template string, ip net.IP) string {
+	return strings.Replace(template, "{ip}", strings.NewReplacer(".", "-", ":", "-").Replace(ip.String()), -1)
+}
+
+// Allocations returns the whole pool, so it's loaded into the DB by PoolInit
+func (p *staticAllocator) Allocations(ctx context.Context) (map[string][]Allocation, error) {
+	allocs := make(map[string][]Allocation, len(p.allocs))
+	for netId, list := range p.allocs {
+		allocs[netId] = append([]Allocation(nil), list...)
+	}
+	return allocs, nil
+}
+
+// Request returns nothing as the pool is never extended.
+// Exhausted networks fail in GetDbAlloc.
+func (p *staticAllocator) Request(ctx context.Context, netId string, count int) (map[string]Allocation, error) {
+	if _, ok := p.allocs[netId]; !ok {
+		return nil, fmt.Errorf("network %s is not in the static pool", netId)
+	}
+	return map[string]Allocation{}, nil
+}
+
+// staleAllocations returns ids of free stored allocations grouped by network ids,
+// which are not in the pool anymore. Used ones are kept until they are freed.
+func staleAllocations(pool map[string][]Allocation, stored []Allocation) map[string][]string {
+	stale := make(map[string][]string)
+	for _, a := range stored {
+		if !a.Used && !inPool(pool, a.NetId, a.Id) {
+			stale[a.NetId] = append(stale[a.NetId], a.Id)
+		}
+	}
+	return stale
+}
+
+func inPool(pool map[string][]Allocation, netId, id string) bool {
+	for _, a := range pool[netId] {
+		if a.Id == id {
+			return true
+		}
+	}
+	return false
+}
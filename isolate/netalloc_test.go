@@ -0,0 +1,204 @@
+package isolate
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	. "gopkg.in/check.v1"
+)
+
+func init() {
+	Suite(&staticAllocatorSuite{})
+}
+
+type staticAllocatorSuite struct {
+	dir string
+}
+
+func (s *staticAllocatorSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *staticAllocatorSuite) writePool(c *C, pool string) string {
+	path := filepath.Join(s.dir, "pool.json")
+	c.Assert(ioutil.WriteFile(path, []byte(pool), 0644), IsNil)
+	return path
+}
+
+func (s *staticAllocatorSuite) TestParseAddressRange(c *C) {
+	for r, bounds := range map[string][2]string{
+		"10.0.0.1-10.0.0.3":          {"10.0.0.1", "10.0.0.3"},
+		"10.0.0.255 - 10.0.1.1":      {"10.0.0.255", "10.0.1.1"},
+		"10.0.0.0/30":                {"10.0.0.1", "10.0.0.2"},
+		"10.0.0.7/32":                {"10.0.0.7", "10.0.0.7"},
+		"2a02:6b8:c00::/126":         {"2a02:6b8:c00::", "2a02:6b8:c00::3"},
+		"2a02:6b8::ff-2a02:6b8::101": {"2a02:6b8::ff", "2a02:6b8::101"},
+	} {
+		first, last, err := parseAddressRange(r)
+		c.Assert(err, IsNil, Commentf(r))
+		c.Check(first.String(), Equals, bounds[0], Commentf(r))
+		c.Check(last.String(), Equals, bounds[1], Commentf(r))
+	}
+
+	for _, r := range []string{"", "10.0.0.1", "10.0.0.3-10.0.0.1", "10.0.0.1-2a02:6b8::1", "10.0.0.0/8", "10.0.0.0/33"} {
+		_, _, err := parseAddressRange(r)
+		c.Check(err, NotNil, Commentf(r))
+	}
+}
+
+func (s *staticAllocatorSuite) TestInvalidPool(c *C) {
+	_, err := NewNetworkAllocator(&MtnCfg{Allocator: AllocatorStatic})
+	c.Check(err, NotNil)
+	_, err = NewNetworkAllocator(&MtnCfg{Allocator: "dns"})
+	c.Check(err, NotNil)
+
+	for _, pool := range []string{
+		`{"networks":`,
+		`{"networks": {"1": {"ranges": ["10.0.0.1-10.0.0.2"]}}}`,
+		`{"networks": {"1": {"hosts": [{"ip": "10.0.0.1"}]}}}`,
+		`{"networks": {"1": {"hosts": [{"ip": "host", "hostname": "host"}]}}}`,
+		`{"networks": {"1": {"hostname": "{ip}", "ranges": ["10.0.0.1-10.0.0.2"]}, "2": {"hostname": "{ip}", "ranges": ["10.0.0.2/32"]}}}`,
+	} {
+		_, err = NewNetworkAllocator(&MtnCfg{Allocator: AllocatorStatic, PoolFile: s.writePool(c, pool)})
+		c.Check(err, NotNil, Commentf(pool))
+	}
+}
+
+func (s *staticAllocatorSuite) TestAllocations(c *C) {
+	ctx := context.Background()
+	pool := s.writePool(c, `{"networks": {
+		"100": {
+			"net": "L3 veth",
+			"hostname": "worker-{ip}.example.net",
+			"ranges": ["10.0.0.1-10.0.0.2"],
+			"hosts": [{"ip": "2a02:6b8::1", "hostname": "db.example.net"}]
+		}
+	}}`)
+
+	allocator, err := NewNetworkAllocator(&MtnCfg{Allocator: AllocatorStatic, PoolFile: pool})
+	c.Assert(err, IsNil)
+
+	allocs, err := allocator.Allocations(ctx)
+	c.Assert(err, IsNil)
+	c.Check(allocs, DeepEquals, map[string][]Allocation{"100": {
+		{Net: "L3 veth", Hostname: "db.example.net", Ip: "2a02:6b8::1", Id: "2a02:6b8::1", NetId: "100"},
+		{Net: "L3 veth", Hostname: "worker-10-0-0-1.example.net", Ip: "10.0.0.1", Id: "10.0.0.1", NetId: "100"},
+		{Net: "L3 veth", Hostname: "worker-10-0-0-2.example.net", Ip: "10.0.0.2", Id: "10.0.0.2", NetId: "100"},
+	}})
+
+	// the whole pool is loaded by PoolInit, so there is nothing to request
+	requested, err := allocator.Request(ctx, "100", 4)
+	c.Assert(err, IsNil)
+	c.Check(requested, HasLen, 0)
+	_, err = allocator.Request(ctx, "200", 4)
+	c.Check(err, NotNil)
+}
+
+func (s *staticAllocatorSuite) TestShrunkPool(c *C) {
+	ctx := context.Background()
+	pool := `{"networks": {
+		"100": {"hostname": "worker-{ip}", "ranges": ["10.0.0.1-10.0.0.4"]},
+		"200": {"hostname": "worker-{ip}", "ranges": ["10.0.1.1/32"]}
+	}}`
+	allocator, err := NewNetworkAllocator(&MtnCfg{Allocator: AllocatorStatic, PoolFile: s.writePool(c, pool)})
+	c.Assert(err, IsNil)
+	stored, err := allocator.Allocations(ctx)
+	c.Assert(err, IsNil)
+	var allocs []Allocation
+	for _, netId := range []string{"100", "200"} {
+		allocs = append(allocs, stored[netId]...)
+	}
+	// the removed address in use is dropped once it's freed
+	allocs[3].Used = true
+	c.Check(staleAllocations(stored, allocs), HasLen, 0)
+
+	shrunk := `{"networks": {"100": {"hostname": "worker-{ip}", "ranges": ["10.0.0.2-10.0.0.3"]}}}`
+	allocator, err = NewNetworkAllocator(&MtnCfg{Allocator: AllocatorStatic, PoolFile: s.writePool(c, shrunk)})
+	c.Assert(err, IsNil)
+	current, err := allocator.Allocations(ctx)
+	c.Assert(err, IsNil)
+	c.Check(staleAllocations(current, allocs), DeepEquals, map[string][]string{
+		"100": {"10.0.0.1"},
+		"200": {"10.0.1.1"},
+	})
+	c.Check(inPool(current, "100", "10.0.0.4"), Equals, false)
+	c.Check(inPool(current, "100", "10.0.0.3"), Equals, true)
+}
+
+func (s *staticAllocatorSuite) newMtnState(c *C, pool string) *MtnState {
+	state := &MtnState{Cfg: MtnCfg{
+		Enable:      true,
+		Allocbuffer: 4,
+		Allocator:   AllocatorStatic,
+		PoolFile:    s.writePool(c, pool),
+		DbPath:      filepath.Join(s.dir, "mtn.db"),
+	}}
+	allocator, err := NewNetworkAllocator(&state.Cfg)
+	c.Assert(err, IsNil)
+	state.Allocator = allocator
+	state.Db, err = bolt.Open(state.Cfg.DbPath, 0666, &bolt.Options{Timeout: time.Second})
+	c.Assert(err, IsNil)
+	c.Assert(state.PoolInit(context.Background()), IsNil)
+	return state
+}
+
+func (s *staticAllocatorSuite) checkStat(c *C, state *MtnState, total, used int) {
+	_, stat, err := state.UsedAllocations(context.Background())
+	c.Assert(err, IsNil)
+	c.Check(stat, DeepEquals, AllocsStat{Total: total, Free: total - used, Used: used, MtnEnabled: true})
+}
+
+func (s *staticAllocatorSuite) TestMtnStateWithStaticPool(c *C) {
+	ctx := context.Background()
+	state := s.newMtnState(c, `{"networks": {
+		"100": {"hostname": "worker-{ip}", "ranges": ["10.0.0.1-10.0.0.3"]},
+		"200": {"hostname": "worker-{ip}", "ranges": ["10.0.1.1/32"]}
+	}}`)
+	s.checkStat(c, state, 4, 0)
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		a, err := state.UseAlloc(ctx, "100", "box", "worker")
+		c.Assert(err, IsNil)
+		c.Check(a.Ip, Equals, ip)
+		c.Check(a.Hostname, Equals, "worker-"+strings.Replace(ip, ".", "-", -1))
+		c.Check(a.Used, Equals, true)
+	}
+	s.checkStat(c, state, 4, 3)
+
+	// the static pool can not be extended on demand
+	_, err := state.UseAlloc(ctx, "100", "box", "worker")
+	c.Check(err, ErrorMatches, "No free allocations left in network 100.")
+
+	state.UnuseAlloc(ctx, "100", "10.0.0.3", "worker")
+	s.checkStat(c, state, 4, 2)
+	a, err := state.UseAlloc(ctx, "100", "box", "worker")
+	c.Assert(err, IsNil)
+	c.Check(a.Ip, Equals, "10.0.0.3")
+	state.UnuseAlloc(ctx, "100", "10.0.0.3", "worker")
+	c.Assert(state.Db.Close(), IsNil)
+
+	// free allocations removed from the pool are dropped on start,
+	// used ones are kept until they are freed
+	state = s.newMtnState(c, `{"networks": {
+		"100": {"hostname": "worker-{ip}", "ranges": ["10.0.0.2-10.0.0.4"]}
+	}}`)
+	used, _, err := state.UsedAllocations(ctx)
+	c.Assert(err, IsNil)
+	c.Check(used, HasLen, 2)
+	s.checkStat(c, state, 4, 2)
+
+	state.UnuseAlloc(ctx, "100", "10.0.0.1", "worker")
+	s.checkStat(c, state, 3, 1)
+	for _, ip := range []string{"10.0.0.3", "10.0.0.4"} {
+		a, err := state.UseAlloc(ctx, "100", "box", "worker")
+		c.Assert(err, IsNil)
+		c.Check(a.Ip, Equals, ip)
+	}
+	_, err = state.UseAlloc(ctx, "100", "box", "worker")
+	c.Check(err, ErrorMatches, "No free allocations left in network 100.")
+	c.Assert(state.Db.Close(), IsNil)
+}
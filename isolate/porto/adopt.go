@@ -0,0 +1,277 @@
+package porto
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/isolate"
+	"github.com/interiorem/stout/pkg/log"
+	porto "github.com/yandex/porto/src/api/go"
+)
+
+// containerStateFile is placed into the root directory of a container
+// next to its root volume
+const containerStateFile = "state.json"
+
+// containerState keeps what is needed to take over a running container
+// after restart of the daemon
+type containerState struct {
+	UUID         string        `json:"uuid"`
+	App          string        `json:"app"`
+	Layers       string        `json:"layers"`
+	Volume       string        `json:"volume"`
+	ExtraVolumes []volumeState `json:"extra_volumes,omitempty"`
+
+	Mtn             bool   `json:"mtn"`
+	NetId           string `json:"net_id,omitempty"`
+	MtnAllocationId string `json:"mtn_allocation_id,omitempty"`
+	MtnIp           string `json:"mtn_ip,omitempty"`
+
+	// the name of the container in Porto and the meta container of the app
+	Name string `json:"name,omitempty"`
+	Meta string `json:"meta,omitempty"`
+}
+
+type volumeState struct {
+	Path        string `json:"path"`
+	StoragePath string `json:"storage_path,omitempty"`
+	// the name of a named volume of the app
+	Name string `json:"name,omitempty"`
+}
+
+func (c *container) state() containerState {
+	state := containerState{
+		Name:            c.containerID,
+		Meta:            c.meta,
+		UUID:            c.uuid,
+		App:             c.appName,
+		Layers:          c.layers,
+		Volume:          c.volume.Path(),
+		Mtn:             c.mtn,
+		NetId:           c.netId,
+		MtnAllocationId: c.mtnAllocationId,
+		MtnIp:           c.mtnIp,
+	}
+	for _, volume := range c.extraVolumes {
+		vs := volumeState{Path: volume.Path()}
+		switch volume := volume.(type) {
+		case *storageVolume:
+			vs.StoragePath = volume.storagepath
+		case *namedVolume:
+			vs.Name = volume.name
+		}
+		state.ExtraVolumes = append(state.ExtraVolumes, vs)
+	}
+	return state
+}
+
+// saveState writes the state of the container into its root directory
+func (c *container) saveState() error {
+	body, err := json.Marshal(c.state())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(c.rootDir, containerStateFile), body, 0644)
+}
+
+func loadContainerState(rootDir string) (*containerState, error) {
+	body, err := ioutil.ReadFile(filepath.Join(rootDir, containerStateFile))
+	if err != nil {
+		return nil, err
+	}
+	var state containerState
+	if err = json.Unmarshal(body, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// restoreContainer builds a container from its saved state.
+// Volumes are linked to the container as it's running.
+func restoreContainer(ctx context.Context, gstate isolate.GlobalState, conns *connPool, volumes *namedVolumes, containerID, rootDir string, state *containerState, cleanupEnabled bool) *container {
+	cnt := &container{
+		ctx:            ctx,
+		State:          gstate,
+		uuid:           state.UUID,
+		appName:        state.App,
+		containerID:    containerID,
+		layers:         state.Layers,
+		rootDir:        rootDir,
+		cleanupEnabled: cleanupEnabled,
+		meta:           state.Meta,
+
+		volume: &portoVolume{cID: containerID, path: state.Volume, linked: true},
+		output: ioutil.Discard,
+		stdout: outputStream{name: "stdout"},
+		stderr: outputStream{name: "stderr"},
+
+		mtn:             state.Mtn,
+		mtnAllocCleaned: !state.Mtn,
+		netId:           state.NetId,
+		mtnAllocationId: state.MtnAllocationId,
+		mtnIp:           state.MtnIp,
+
+		conns: conns,
+	}
+
+	for _, vs := range state.ExtraVolumes {
+		volume := portoVolume{cID: containerID, path: vs.Path, linked: true}
+		switch {
+		case vs.Name != "":
+			// the data must survive the container even if named volumes have been disabled
+			if volumes != nil {
+				volumes.adopt(state.App, vs.Name, containerID)
+			}
+			cnt.extraVolumes = append(cnt.extraVolumes, &namedVolume{portoVolume: volume, volumes: volumes, app: state.App, name: vs.Name})
+		case vs.StoragePath != "":
+			cnt.extraVolumes = append(cnt.extraVolumes, &storageVolume{portoVolume: volume, storagepath: vs.StoragePath})
+		default:
+			cnt.extraVolumes = append(cnt.extraVolumes, &volume)
+		}
+	}
+	return cnt
+}
+
+// parseUUID extracts the uuid of a worker from the command of its container
+func parseUUID(command string) string {
+	fields := strings.Fields(command)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "--uuid" {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// stateFromPorto recovers the state of a container started by a version
+// without state files. The container must use the root volume from rootDir,
+// otherwise it belongs to somebody else.
+func (b *Box) stateFromPorto(ctx context.Context, portoConn porto.API, name, containerID, rootDir string, allocations []isolate.Allocation) (*containerState, error) {
+	root, err := portoConn.GetProperty(name, "root")
+	if err != nil {
+		return nil, err
+	}
+	if root != filepath.Join(rootDir, "volume") {
+		return nil, nil
+	}
+
+	command, err := portoConn.GetProperty(name, "command")
+	if err != nil {
+		return nil, err
+	}
+	uuid := parseUUID(command)
+	if uuid == "" {
+		return nil, nil
+	}
+
+	state := &containerState{
+		UUID:   uuid,
+		Volume: root,
+		// appGenLabel is not reversible, but ':' is rare in names of apps
+		App: strings.TrimSuffix(path.Base(containerID), "_"+uuid),
+	}
+
+	volumes, err := portoConn.ListVolumes("", name)
+	if err != nil {
+		return nil, err
+	}
+	for _, volume := range volumes {
+		if volume.Path == root {
+			state.Layers = volume.Properties["layers"]
+			continue
+		}
+		vs := volumeState{Path: volume.Path}
+		// storage of an extra volume is created per container
+		if storage := volume.Properties["storage"]; strings.HasSuffix(storage, containerID) {
+			vs.StoragePath = storage
+		}
+		state.ExtraVolumes = append(state.ExtraVolumes, vs)
+	}
+
+	if ip, _ := portoConn.GetProperty(name, "ip"); ip != "" {
+		for _, allocation := range allocations {
+			if allocation.Ip == ip && allocation.Box == b.Name {
+				state.Mtn = true
+				state.NetId = allocation.NetId
+				state.MtnAllocationId = allocation.Id
+				state.MtnIp = allocation.Ip
+				break
+			}
+		}
+	}
+
+	return state, nil
+}
+
+// adoptContainers takes over the running containers started by
+// the previous instance of the daemon, so they are tracked and cleaned up
+// as if they had been spawned by this one.
+func (b *Box) adoptContainers(ctx context.Context, portoConn porto.API) (err error) {
+	defer log.G(ctx).Trace("adopt running containers").Stop(&err)
+	names, err := portoConn.List()
+	if err != nil {
+		return err
+	}
+
+	allocations, _, err := b.GlobalState.Mtn.UsedAllocations(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		ID := path.Base(name)
+		containerID := b.addRootNamespacePrefix(ID)
+		rootDir := filepath.Join(b.config.Containers, ID)
+		logger := log.G(ctx).WithField("container", name)
+
+		// containers of the box have root directories
+		if _, serr := os.Stat(rootDir); serr != nil {
+			continue
+		}
+
+		portoState, perr := portoConn.GetProperty(name, "state")
+		if perr != nil {
+			logger.WithError(perr).Warn("unable to get state of the container")
+			continue
+		}
+		if portoState != "running" && portoState != "starting" {
+			continue
+		}
+
+		state, err := loadContainerState(rootDir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.WithError(err).Warn("unable to load the state of the container, recover it from Porto")
+			}
+			if state, err = b.stateFromPorto(ctx, portoConn, name, containerID, rootDir, allocations); err != nil {
+				logger.WithError(err).Warn("unable to recover the state of the container")
+				continue
+			}
+		}
+		if state == nil {
+			continue
+		}
+		// workers may be placed into meta containers of their apps
+		if state.Name != "" {
+			containerID = state.Name
+		}
+
+		cnt := restoreContainer(ctx, b.GlobalState, b.conns, b.namedVolumes, containerID, rootDir, state, b.config.CleanupEnabled)
+		b.muContainers.Lock()
+		b.containers[containerID] = cnt
+		b.muContainers.Unlock()
+		if cnt.meta != "" {
+			b.appMetas.adopt(cnt.meta)
+		}
+		containersAdoptedCounter.Inc(1)
+		logger.WithField("uuid", state.UUID).Info("the container has been adopted")
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package porto
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/isolate"
+)
+
+func TestContainerStateRoundTrip(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	rootDir, err := ioutil.TempDir("", "container")
+	require.NoError(err)
+	defer os.RemoveAll(rootDir)
+
+	original := &container{
+		uuid:        "7ad7a1f4-6c4c-4b54-9b43-bd1fd8e3c4a1",
+		appName:     "app:v1",
+		containerID: "/porto/app_v1_7ad7a1f4-6c4c-4b54-9b43-bd1fd8e3c4a1",
+		layers:      "sha256_a;sha256_b",
+		rootDir:     rootDir,
+		volume:      &portoVolume{path: filepath.Join(rootDir, "volume")},
+		extraVolumes: []Volume{
+			&portoVolume{path: filepath.Join(rootDir, "volume", "tmp")},
+			&storageVolume{
+				portoVolume: portoVolume{path: filepath.Join(rootDir, "volume", "data")},
+				storagepath: "/storage/app_v1_7ad7a1f4-6c4c-4b54-9b43-bd1fd8e3c4a1",
+			},
+		},
+		mtn:             true,
+		netId:           "net",
+		mtnAllocationId: "alloc",
+		mtnIp:           "2a02:6b8::1",
+	}
+	require.NoError(original.saveState())
+
+	state, err := loadContainerState(rootDir)
+	require.NoError(err)
+	require.Equal(original.state(), *state)
+
+	restored := restoreContainer(ctx, isolate.GlobalState{}, nil, nil, original.containerID, rootDir, state, true)
+	require.Equal(original.uuid, restored.uuid)
+	require.Equal(original.appName, restored.appName)
+	require.Equal(original.layers, restored.layers)
+	require.Equal(original.state(), restored.state())
+	require.False(restored.mtnAllocCleaned)
+	require.True(restored.volume.(*portoVolume).linked)
+	require.IsType(&portoVolume{}, restored.extraVolumes[0])
+	require.IsType(&storageVolume{}, restored.extraVolumes[1])
+
+	_, err = loadContainerState(filepath.Join(rootDir, "absent"))
+	require.True(os.IsNotExist(err))
+}
+
+func TestParseUUID(t *testing.T) {
+	require := require.New(t)
+	require.Equal("abc", parseUUID("/usr/bin/worker --app app --uuid abc --endpoint /run/cocaine"))
+	require.Equal("abc", parseUUID("/usr/bin/worker --uuid abc"))
+	require.Empty(parseUUID("/usr/bin/worker --uuid"))
+	require.Empty(parseUUID("/bin/sleep 100"))
+}
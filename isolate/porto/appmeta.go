@@ -0,0 +1,193 @@
+package porto
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	porto "github.com/yandex/porto/src/api/go"
+	portorpc "github.com/yandex/porto/src/api/go/rpc"
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/pkg/log"
+)
+
+// appLimitProperties can be set for the meta container of an app
+var appLimitProperties = map[string]bool{
+	"memory_limit":     true,
+	"memory_guarantee": true,
+	"anon_limit":       true,
+	"cpu_limit":        true,
+	"cpu_guarantee":    true,
+	"cpu_weight":       true,
+	"io_limit":         true,
+	"io_ops_limit":     true,
+	"thread_limit":     true,
+}
+
+// appMetaConfig makes the box place workers of an app into a meta container,
+// so limits of the meta container are shared by all the workers of the app
+type appMetaConfig struct {
+	Enable bool `json:"enable"`
+	// Limits of meta containers unless the app_limits section of a profile sets them
+	Defaults map[string]string `json:"defaults"`
+}
+
+func checkAppLimits(limits map[string]string) error {
+	for property := range limits {
+		if !appLimitProperties[property] {
+			allowed := make([]string, 0, len(appLimitProperties))
+			for name := range appLimitProperties {
+				allowed = append(allowed, name)
+			}
+			sort.Strings(allowed)
+			return fmt.Errorf("property %q can not be set for the app, expected one of %s", property, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+func (c *appMetaConfig) validate() error {
+	return checkAppLimits(c.Defaults)
+}
+
+// limits merges limits of the app over the defaults
+func (c *appMetaConfig) limits(app map[string]string) map[string]string {
+	limits := make(map[string]string, len(c.Defaults)+len(app))
+	for property, value := range c.Defaults {
+		limits[property] = value
+	}
+	for property, value := range app {
+		limits[property] = value
+	}
+	return limits
+}
+
+// appMetas counts workers in meta containers of apps. The meta container
+// is created for the first worker and destroyed after the last one.
+type appMetas struct {
+	mu    sync.Mutex
+	metas map[string]*appMeta
+}
+
+// appMeta serializes changes of the meta container of one app,
+// so Porto calls for different apps do not wait for each other
+type appMeta struct {
+	mu      sync.Mutex
+	workers int
+	// callers holding or waiting for mu, protected by appMetas.mu
+	refs int
+}
+
+func newAppMetas() *appMetas {
+	return &appMetas{metas: make(map[string]*appMeta)}
+}
+
+// lock returns the locked state of the meta container
+func (m *appMetas) lock(name string) *appMeta {
+	m.mu.Lock()
+	meta, ok := m.metas[name]
+	if !ok {
+		meta = new(appMeta)
+		m.metas[name] = meta
+	}
+	meta.refs++
+	m.mu.Unlock()
+
+	meta.mu.Lock()
+	return meta
+}
+
+// unlock forgets the state once nobody uses the meta container
+func (m *appMetas) unlock(name string, meta *appMeta) {
+	meta.mu.Unlock()
+
+	m.mu.Lock()
+	// workers can be read: nobody else holds meta.mu without a ref
+	if meta.refs--; meta.refs == 0 && meta.workers == 0 {
+		delete(m.metas, name)
+	}
+	m.mu.Unlock()
+}
+
+// acquire creates the meta container if needed and applies limits to it.
+// Limits are applied on every spawn, so a new version of the profile takes effect.
+func (m *appMetas) acquire(ctx context.Context, portoConn porto.API, name string, limits map[string]string) (err error) {
+	meta := m.lock(name)
+	defer m.unlock(name, meta)
+
+	if meta.workers == 0 {
+		if err = portoConn.Create(name); err != nil {
+			if !isEqualPortoError(err, portorpc.EError_ContainerAlreadyExists) {
+				return err
+			}
+			log.G(ctx).WithField("container", name).Debug("meta container of the app already exists")
+		}
+		defer func() {
+			if err != nil {
+				m.destroy(ctx, portoConn, name)
+			}
+		}()
+	}
+
+	for property, value := range limits {
+		if err = portoConn.SetProperty(name, property, value); err != nil {
+			log.G(ctx).WithError(err).WithField("container", name).Errorf("SetProperty %s %s failed", property, value)
+			return err
+		}
+	}
+
+	// a container without a command becomes a meta one on start
+	if err = portoConn.Start(name); err != nil && !isEqualPortoError(err, portorpc.EError_InvalidState) {
+		return err
+	}
+
+	meta.workers++
+	return nil
+}
+
+// adopt counts a worker of the previous instance of the daemon
+func (m *appMetas) adopt(name string) {
+	meta := m.lock(name)
+	meta.workers++
+	m.unlock(name, meta)
+}
+
+// release destroys the meta container after the last worker of the app
+func (m *appMetas) release(ctx context.Context, portoConn porto.API, name string) {
+	meta := m.lock(name)
+	defer m.unlock(name, meta)
+	if meta.workers--; meta.workers > 0 {
+		return
+	}
+	meta.workers = 0
+	m.destroy(ctx, portoConn, name)
+}
+
+func (m *appMetas) destroy(ctx context.Context, portoConn porto.API, name string) {
+	logger := log.G(ctx).WithField("container", name)
+	if err := portoConn.Destroy(name); err != nil && !isEqualPortoError(err, portorpc.EError_ContainerDoesNotExist) {
+		logger.WithError(err).Warn("unable to destroy meta container of the app")
+		return
+	}
+	logger.Debug("meta container of the app has been destroyed")
+}
+
+// appMetaName returns the name of the meta container of the app
+func (b *Box) appMetaName(app string) string {
+	return b.addRootNamespacePrefix(b.appGenLabel(app))
+}
+
+// releaseAppMeta is called once the container is not tracked anymore.
+// It uses the connection of the caller, as the pool may be exhausted.
+func (b *Box) releaseAppMeta(ctx context.Context, portoConn porto.API, c *container) {
+	if c.meta == "" {
+		return
+	}
+	// workers left for debugging must not be destroyed along with the meta container
+	if !c.cleanupEnabled {
+		return
+	}
+	b.appMetas.release(ctx, portoConn, c.meta)
+}
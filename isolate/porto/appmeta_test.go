@@ -0,0 +1,68 @@
+package porto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	porto "github.com/yandex/porto/src/api/go"
+	"golang.org/x/net/context"
+)
+
+// metaPorto blocks creation of containers listed in hang
+type metaPorto struct {
+	porto.API
+	hang    map[string]chan struct{}
+	created chan string
+}
+
+func (p *metaPorto) Create(name string) error {
+	if hang, ok := p.hang[name]; ok {
+		<-hang
+	}
+	p.created <- name
+	return nil
+}
+
+func (p *metaPorto) SetProperty(name, property, value string) error { return nil }
+func (p *metaPorto) Start(name string) error                        { return nil }
+func (p *metaPorto) Destroy(name string) error                      { return nil }
+
+func TestAppMetasLockPerApp(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	api := &metaPorto{
+		hang:    map[string]chan struct{}{"slow": make(chan struct{})},
+		created: make(chan string, 3),
+	}
+	metas := newAppMetas()
+
+	slowErr := make(chan error, 1)
+	go func() { slowErr <- metas.acquire(ctx, api, "slow", nil) }()
+
+	// the meta container of another app is not waiting for the slow one
+	fastErr := make(chan error, 1)
+	go func() { fastErr <- metas.acquire(ctx, api, "fast", nil) }()
+	select {
+	case err := <-fastErr:
+		require.NoError(err)
+	case <-time.After(time.Second):
+		t.Fatal("the meta container of an app waits for another app")
+	}
+	require.Equal("fast", <-api.created)
+
+	close(api.hang["slow"])
+	require.NoError(<-slowErr)
+	require.Equal("slow", <-api.created)
+
+	// the second worker uses the existing meta container
+	require.NoError(metas.acquire(ctx, api, "fast", nil))
+	metas.release(ctx, api, "fast")
+	metas.release(ctx, api, "fast")
+	metas.release(ctx, api, "slow")
+	require.Empty(api.created)
+	metas.mu.Lock()
+	require.Empty(metas.metas)
+	metas.mu.Unlock()
+}
@@ -0,0 +1,153 @@
+package porto
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/pkg/log"
+)
+
+// spoolCall is a spool in progress shared by concurrent callers.
+// It's cancelled as soon as the last of them has gone.
+type spoolCall struct {
+	// identity of the profile being spooled
+	key       string
+	waiters   int
+	cancelled bool
+	cancel    context.CancelFunc
+	done      chan struct{}
+	err       error
+}
+
+// spools deduplicates concurrent spools of the same app
+type spools struct {
+	mu    sync.Mutex
+	calls map[string]*spoolCall
+}
+
+func newSpools() *spools {
+	return &spools{calls: make(map[string]*spoolCall)}
+}
+
+// do runs spool unless a spool of the app with the same key is in progress,
+// otherwise it waits for the result of that one.
+// A spool with another key, i.e. of another profile, starts after the current one.
+// The caller stops waiting once its context is done.
+func (s *spools) do(ctx context.Context, name, key string, spool func(context.Context) error) error {
+	s.mu.Lock()
+	call, ok := s.calls[name]
+	if !ok || call.cancelled || call.key != key {
+		// A cancelled spool may still be rolling back its layers
+		// and a spool of another profile may still be importing them,
+		// so the new one starts after it.
+		var after chan struct{}
+		if ok {
+			after = call.done
+		}
+		// The spool must outlive the context of the caller, who started it
+		sctx, cancel := context.WithCancel(log.WithLogger(context.Background(), log.G(ctx)))
+		call = &spoolCall{
+			key:    key,
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		s.calls[name] = call
+		go s.run(sctx, name, call, after, spool)
+	}
+	call.waiters++
+	s.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		s.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 && !call.cancelled {
+			log.G(ctx).WithField("name", name).Info("nobody waits for the spool anymore, cancel it")
+			call.cancelled = true
+			call.cancel()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	case <-call.done:
+		return call.err
+	}
+}
+
+func (s *spools) run(ctx context.Context, name string, call *spoolCall, after chan struct{}, spool func(context.Context) error) {
+	defer call.cancel()
+	if after != nil {
+		<-after
+	}
+
+	err := spool(ctx)
+
+	s.mu.Lock()
+	call.err = err
+	if s.calls[name] == call {
+		delete(s.calls, name)
+	}
+	s.mu.Unlock()
+	close(call.done)
+}
+
+// spoolProfile spools the app, sharing the spool with concurrent callers
+// of the same profile
+func (b *Box) spoolProfile(ctx context.Context, name string, profile *Profile) error {
+	key, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	return b.spools.do(ctx, name, string(key), func(ctx context.Context) error { return b.spool(ctx, name, profile) })
+}
+
+// missingLayers returns layers of the journal record which are absent in Porto
+func (b *Box) missingLayers(ctx context.Context, layers string) ([]string, error) {
+	portoConn, err := b.conns.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer portoConn.Close()
+
+	imported, err := portoConn.ListLayers()
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, layer := range strings.Split(layers, ";") {
+		if layer != "" && !contains(imported, layer) {
+			missing = append(missing, layer)
+		}
+	}
+	return missing, nil
+}
+
+// autoSpool returns layers of the app spooling it first if the journal
+// has no record of the app or some of its layers are absent in Porto
+func (b *Box) autoSpool(ctx context.Context, name string, profile *Profile) (string, error) {
+	logger := log.G(ctx).WithField("name", name)
+	layers := b.journal.GetManifestLayers(name)
+	if layers != "" {
+		missing, err := b.missingLayers(ctx, layers)
+		if err != nil {
+			logger.WithError(err).Error("unable to check layers of the app")
+			return "", err
+		}
+		if len(missing) == 0 {
+			return layers, nil
+		}
+		logger.Warnf("layers %v of the app are absent in Porto, they are imported again", missing)
+		layersReimportedCounter.Inc(int64(len(missing)))
+	} else {
+		logger.Info("the app has not been spooled, spool it on spawn")
+	}
+
+	autoSpoolsCounter.Inc(1)
+	if err := b.spoolProfile(ctx, name, profile); err != nil {
+		logger.WithError(err).Error("unable to spool the app on spawn")
+		return "", err
+	}
+	return b.journal.GetManifestLayers(name), nil
+}
@@ -0,0 +1,108 @@
+package porto
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestSpoolsRefcountedCancellation(t *testing.T) {
+	require := require.New(t)
+	spools := newSpools()
+
+	waiters := func() int {
+		spools.mu.Lock()
+		defer spools.mu.Unlock()
+		if call, ok := spools.calls["app"]; ok {
+			return call.waiters
+		}
+		return 0
+	}
+
+	started, block := make(chan struct{}), make(chan struct{})
+	spoolErr := errors.New("spool error")
+	spool := func(ctx context.Context) error {
+		close(started)
+		select {
+		case <-block:
+			return spoolErr
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() { firstErr <- spools.do(first, "app", "v1", spool) }()
+	<-started
+
+	secondErr := make(chan error, 1)
+	go func() { secondErr <- spools.do(context.Background(), "app", "v1", spool) }()
+
+	// a waiter leaves on its own deadline
+	third, cancelThird := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelThird()
+	require.Equal(context.DeadlineExceeded, spools.do(third, "app", "v1", spool))
+	require.NoError(waitFor(func() bool { return waiters() == 2 }))
+
+	// the spool goes on for the second caller
+	cancelFirst()
+	require.Equal(context.Canceled, <-firstErr)
+	close(block)
+	require.Equal(spoolErr, <-secondErr)
+
+	// the spool is cancelled once the last caller has gone
+	cancelled, lastErr := make(chan error, 1), make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		lastErr <- spools.do(ctx, "app", "v1", func(ctx context.Context) error {
+			<-ctx.Done()
+			cancelled <- ctx.Err()
+			return ctx.Err()
+		})
+	}()
+	require.NoError(waitFor(func() bool { return waiters() == 1 }))
+	cancel()
+	require.Equal(context.Canceled, <-lastErr)
+	require.Equal(context.Canceled, <-cancelled)
+}
+
+func TestSpoolsOfAnotherProfile(t *testing.T) {
+	require := require.New(t)
+	spools := newSpools()
+
+	started, block := make(chan struct{}), make(chan struct{})
+	firstErr := make(chan error, 1)
+	go func() {
+		firstErr <- spools.do(context.Background(), "app", "v1", func(ctx context.Context) error {
+			close(started)
+			<-block
+			return nil
+		})
+	}()
+	<-started
+
+	// a spool of another profile is not joined with the current one,
+	// it runs on its own once the current one is over
+	spoolErr := errors.New("spool error")
+	secondStarted, secondErr := make(chan struct{}), make(chan error, 1)
+	go func() {
+		secondErr <- spools.do(context.Background(), "app", "v2", func(ctx context.Context) error {
+			close(secondStarted)
+			return spoolErr
+		})
+	}()
+	select {
+	case <-secondStarted:
+		t.Fatal("the spool of another profile has started concurrently")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(block)
+	require.NoError(<-firstErr)
+	<-secondStarted
+	require.Equal(spoolErr, <-secondErr)
+}
@@ -0,0 +1,95 @@
+package porto
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Modes of bind mounts
+const (
+	bindReadWrite = "rw"
+	bindReadOnly  = "ro"
+)
+
+// bindMount is a bind mount of the profile in Docker syntax `source:target[:options]`
+type bindMount struct {
+	Source string
+	Target string
+	Mode   string
+}
+
+// parseBind parses a bind in Docker syntax. Only host paths can be mounted
+// as Porto knows nothing about named Docker volumes. The only supported
+// options are ro and rw.
+func parseBind(bind string) (bindMount, error) {
+	parts := strings.Split(bind, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return bindMount{}, fmt.Errorf("invalid bind %q, expected source:target[:options]", bind)
+	}
+
+	b := bindMount{Source: parts[0], Target: parts[1], Mode: bindReadWrite}
+	if !filepath.IsAbs(b.Source) {
+		return bindMount{}, fmt.Errorf("invalid bind %q: source %q must be an absolute path", bind, b.Source)
+	}
+	if !filepath.IsAbs(b.Target) {
+		return bindMount{}, fmt.Errorf("invalid bind %q: target %q must be an absolute path", bind, b.Target)
+	}
+	b.Source, b.Target = filepath.Clean(b.Source), filepath.Clean(b.Target)
+	if b.Target == "/" {
+		return bindMount{}, fmt.Errorf("invalid bind %q: the root can not be a target", bind)
+	}
+
+	if len(parts) == 3 {
+		var mode string
+		for _, option := range strings.Split(parts[2], ",") {
+			switch option {
+			case bindReadWrite, bindReadOnly:
+				if mode != "" {
+					return bindMount{}, fmt.Errorf("invalid bind %q: mode is set twice", bind)
+				}
+				mode = option
+			default:
+				return bindMount{}, fmt.Errorf("invalid bind %q: unsupported option %q", bind, option)
+			}
+		}
+		b.Mode = mode
+	}
+
+	return b, nil
+}
+
+func parseBinds(binds []string) ([]bindMount, error) {
+	mounts := make([]bindMount, 0, len(binds))
+	for _, bind := range binds {
+		mount, err := parseBind(bind)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// String returns the bind in the syntax of the Porto bind property
+func (b bindMount) String() string {
+	return escapePortoValue(b.Source) + " " + escapePortoValue(b.Target) + " " + b.Mode
+}
+
+// escapePortoValue escapes separators of Porto list properties
+// like bind, so a value stays a single item
+func escapePortoValue(value string) string {
+	if !strings.ContainsAny(value, "\\ ;") {
+		return value
+	}
+	var buff = newBuff()
+	defer buffPool.Put(buff)
+	for _, r := range value {
+		switch r {
+		case '\\', ' ', ';':
+			buff.WriteByte('\\')
+		}
+		buff.WriteRune(r)
+	}
+	return buff.String()
+}
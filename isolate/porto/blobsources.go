@@ -0,0 +1,178 @@
+package porto
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/registry/client/transport"
+	"golang.org/x/net/context"
+)
+
+const (
+	blobSourceDir      = "dir"
+	blobSourceMirror   = "mirror"
+	blobSourceRegistry = "registry"
+
+	// a source is skipped after so many consecutive failures
+	blobSourceMaxFailures = 3
+	blobSourceMinBackoff  = 30 * time.Second
+	blobSourceMaxBackoff  = 10 * time.Minute
+)
+
+// BlobSourceConfig describes a place blobs can be fetched from
+type BlobSourceConfig struct {
+	// dir, mirror or registry
+	Type string `json:"type"`
+	// Directory with blobs named after their digests for `dir`
+	Path string `json:"path"`
+	// Base URL of a pull-through registry mirror for `mirror`
+	URL string `json:"url"`
+}
+
+// blobSource opens blobs for reading. Seek is used to resume partial downloads.
+type blobSource interface {
+	Open(ctx context.Context, repository distribution.Repository, dgst digest.Digest) (distribution.ReadSeekCloser, error)
+	String() string
+}
+
+// dirSource reads blobs pre-seeded into a local directory
+// either as <digest> or as <algorithm>/<hex>
+type dirSource struct {
+	dir string
+}
+
+func (s *dirSource) Open(ctx context.Context, repository distribution.Repository, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	for _, path := range []string{
+		filepath.Join(s.dir, dgst.String()),
+		filepath.Join(s.dir, string(dgst.Algorithm()), dgst.Hex()),
+	} {
+		f, err := os.Open(path)
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return nil, distribution.ErrBlobUnknown
+}
+
+func (s *dirSource) String() string {
+	return blobSourceDir + ":" + s.dir
+}
+
+// mirrorSource reads blobs from a registry mirror via Registry API v2
+type mirrorSource struct {
+	url    string
+	client *http.Client
+}
+
+func (s *mirrorSource) Open(ctx context.Context, repository distribution.Repository, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	blobURL := fmt.Sprintf("%s/v2/%s/blobs/%s", s.url, repository.Named().Name(), dgst)
+	return transport.NewHTTPReadSeeker(s.client, blobURL, func(resp *http.Response) error {
+		if resp.StatusCode == http.StatusNotFound {
+			return distribution.ErrBlobUnknown
+		}
+		return fmt.Errorf("mirror %s replied %s", s.url, resp.Status)
+	}), nil
+}
+
+func (s *mirrorSource) String() string {
+	return blobSourceMirror + ":" + s.url
+}
+
+// registrySource reads blobs from the origin registry of the image
+type registrySource struct{}
+
+func (registrySource) Open(ctx context.Context, repository distribution.Repository, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	return repository.Blobs(ctx).Open(ctx, dgst)
+}
+
+func (registrySource) String() string {
+	return blobSourceRegistry
+}
+
+func newBlobSource(cfg BlobSourceConfig, tr http.RoundTripper) (blobSource, error) {
+	switch cfg.Type {
+	case blobSourceDir:
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("path of %s blob source is not specified", cfg.Type)
+		}
+		return &dirSource{dir: cfg.Path}, nil
+	case blobSourceMirror:
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("url of %s blob source is not specified", cfg.Type)
+		}
+		url := strings.TrimSuffix(cfg.URL, "/")
+		if !strings.HasPrefix(url, "http") {
+			url = "https://" + url
+		}
+		return &mirrorSource{url: url, client: &http.Client{Transport: tr}}, nil
+	case blobSourceRegistry:
+		return registrySource{}, nil
+	default:
+		return nil, fmt.Errorf("unknown blob source type %q", cfg.Type)
+	}
+}
+
+// trackedSource skips a source for a while after several consecutive failures
+type trackedSource struct {
+	blobSource
+
+	mu             sync.Mutex
+	failures       int
+	unhealthyUntil time.Time
+}
+
+func (s *trackedSource) Healthy(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !now.Before(s.unhealthyUntil)
+}
+
+func (s *trackedSource) Succeeded() {
+	s.mu.Lock()
+	s.failures = 0
+	s.unhealthyUntil = time.Time{}
+	s.mu.Unlock()
+}
+
+// Failed returns true if the source has become unhealthy
+func (s *trackedSource) Failed(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures++
+	if s.failures < blobSourceMaxFailures {
+		return false
+	}
+
+	backoff := blobSourceMinBackoff << uint(s.failures-blobSourceMaxFailures)
+	if backoff > blobSourceMaxBackoff || backoff <= 0 {
+		backoff = blobSourceMaxBackoff
+	}
+	s.unhealthyUntil = now.Add(backoff)
+	return true
+}
+
+// orderSources returns healthy sources in the configured order followed by unhealthy ones,
+// so an unhealthy source is still tried as the last resort
+func orderSources(sources []*trackedSource, now time.Time) []*trackedSource {
+	ordered := make([]*trackedSource, 0, len(sources))
+	var unhealthy []*trackedSource
+	for _, source := range sources {
+		if source.Healthy(now) {
+			ordered = append(ordered, source)
+		} else {
+			unhealthy = append(unhealthy, source)
+		}
+	}
+	return append(ordered, unhealthy...)
+}
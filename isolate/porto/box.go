@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
@@ -22,6 +21,7 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/interiorem/stout/isolate"
+	"github.com/interiorem/stout/pkg/fetcher"
 	"github.com/interiorem/stout/pkg/log"
 	"github.com/interiorem/stout/pkg/semaphore"
 
@@ -44,7 +44,7 @@ type portoBoxConfig struct {
 	Journal string `json:"journal"`
 
 	SpawnConcurrency       uint              `json:"concurrency"`
-	SpawnTimeout           uint              `json:"spawn_timeout_sec"`
+	SpawnTimeout           uint              `json:"spawn_timeout_sec"` // Deprecated: use spawn_rate
 	RegistryAuth           map[string]string `json:"registryauth"`
 	DialRetries            int               `json:"dialretries"`
 	CleanupEnabled         bool              `json:"cleanupenabled"`
@@ -57,9 +57,43 @@ type portoBoxConfig struct {
 	DefaultResolvConf      string            `json:"defaultresolv_conf"`
 	CocaineAppVolumeLabel  string            `json:"cocaineappvolumelabel"`
 	DownloadHelperCmd      string            `json:"download_helper_cmd",omitempty`
-	DownloadHelperFallback bool              `json:"download_helper_fallback",omitempty`
+	DownloadHelperFallback bool              `json:"download_helper_fallback",omitempty` // falls back from fetchers too
 	MetaName               string            `json:"meta_name",omitempty`
 	MetaProp               map[string]string `json:"meta_prop",omitempty`
+	// Platform of images picked from manifest lists: os/arch[/variant]
+	Platform string `json:"platform"`
+	// Command to decompress zstd layers
+	ZstdCmd string        `json:"zstd_cmd"`
+	LayerGC layerGCConfig `json:"layergc"`
+	// How many blobs can be downloaded from registries simultaneously
+	DownloadConcurrency uint `json:"download_concurrency"`
+	// Ordered list of places to fetch blobs from: local directories,
+	// registry mirrors and the origin registry
+	BlobSources []BlobSourceConfig `json:"blob_sources"`
+	// How often output of containers is streamed
+	OutputPollMs uint `json:"output_poll_ms"`
+	// Maximum number of connections to Portod
+	PortoPoolSize uint `json:"porto_pool_size"`
+	// How long a connection to Portod is waited for unless the caller has a deadline
+	PortoConnectTimeoutSec uint `json:"porto_connect_timeout_sec"`
+	// Host interface for macvlan and ipvlan networks unless a profile specifies it
+	NetworkMaster string `json:"network_master"`
+	// Allowed properties of containers and their defaults
+	ContainerProperties containerPropertiesConfig `json:"container_properties"`
+	// Persistent named extra volumes of apps
+	NamedVolumes namedVolumesConfig `json:"named_volumes"`
+	// Meta containers with limits shared by workers of an app
+	AppMeta appMetaConfig `json:"app_meta"`
+	// Retention of containers which have exited abnormally or failed to start
+	FailedContainers retainConfig `json:"failed_containers"`
+	// External fetchers of layers listed in profiles
+	Fetchers []fetcherConfig `json:"fetchers"`
+	// Fetcher of layers which do not name one
+	DefaultFetcher string `json:"default_fetcher"`
+	// Token bucket limits of container starts
+	SpawnRate spawnRateConfig `json:"spawn_rate"`
+	// Spool apps on spawn if they have not been spooled or their layers are lost
+	AutoSpool bool `json:"auto_spool"`
 }
 
 func (c *portoBoxConfig) String() string {
@@ -82,14 +116,25 @@ type Box struct {
 	journal     *journal
 
 	spawnSM      semaphore.Semaphore
+	spawnRate    *spawnLimiter
+	spools       *spools
+	exits        *exits
+	layerRefs    *layerRefs
+	fetchers     *layerFetchers
 	transport    *http.Transport
 	muContainers sync.Mutex
 	containers   map[string]*container
 	blobRepo     BlobRepository
+	layerGC      *layerGC
+	conns        *connPool
+	namedVolumes *namedVolumes
+	appMetas     *appMetas
+	retained     *retainedContainers
 	dhEnable     bool
 	dhfEnable    bool
 	prefixEnable bool
 	prefixProp   map[string]string
+	platform     platform
 
 	rootPrefix string
 
@@ -98,7 +143,12 @@ type Box struct {
 	containerPropertiesAndData []string
 }
 
-const defaultVolumeBackend = "overlay"
+const (
+	defaultVolumeBackend = "overlay"
+
+	// how long Porto waits for death of tracked containers at once
+	containerWaitTimeout = time.Second
+)
 
 // NewBox creates new Box
 func NewBox(ctx context.Context, cfg isolate.BoxConfig, gstate isolate.GlobalState) (isolate.Box, error) {
@@ -113,6 +163,15 @@ func NewBox(ctx context.Context, cfg isolate.BoxConfig, gstate isolate.GlobalSta
 		WeakEnabled:    false,
 		Gc:             true,
 		CocaineAppVolumeLabel: "cocaine-app",
+		Platform:              defaultPlatform,
+		ZstdCmd:               defaultZstdCmd,
+		LayerGC: layerGCConfig{
+			PeriodSec: defaultLayerGCPeriod,
+		},
+		OutputPollMs: defaultOutputPollMs,
+
+		PortoPoolSize:          defaultPortoPoolSize,
+		PortoConnectTimeoutSec: defaultPortoConnectTimeoutSec,
 	}
 	decoderConfig := mapstructure.DecoderConfig{
 		WeaklyTypedInput: true,
@@ -143,21 +202,50 @@ func NewBox(ctx context.Context, cfg isolate.BoxConfig, gstate isolate.GlobalSta
 		config.VolumeBackend = defaultVolumeBackend
 	}
 
-	log.G(ctx).WithField("dir", config.Layers).Info("create directory for Layers")
-	if err = os.MkdirAll(config.Layers, 0755); err != nil {
+	if config.OutputPollMs == 0 {
+		config.OutputPollMs = defaultOutputPollMs
+	}
+
+	if err = config.ContainerProperties.validate(); err != nil {
 		return nil, err
 	}
+	if _, ok := config.ContainerProperties.Defaults["ulimit"]; ok && config.DefaultUlimits != "" {
+		return nil, fmt.Errorf("defaultulimits and the ulimit default of container_properties can not be set both")
+	}
 
-	log.G(ctx).WithField("dir", config.Containers).Info("create directory for Containers")
-	if err = os.MkdirAll(config.Containers, 0755); err != nil {
+	if err = config.AppMeta.validate(); err != nil {
+		return nil, err
+	}
+
+	if err = config.SpawnRate.validate(); err != nil {
+		return nil, err
+	}
+	if config.SpawnTimeout > 0 && config.SpawnRate.Rate == 0 {
+		config.SpawnRate.Rate = float64(config.SpawnConcurrency) / float64(config.SpawnTimeout)
+		config.SpawnRate.Burst = config.SpawnConcurrency
+		log.G(ctx).Warnf("spawn_timeout_sec is deprecated, use spawn_rate instead: rate %v, burst %d", config.SpawnRate.Rate, config.SpawnRate.Burst)
+	}
+
+	fetchers, err := newLayerFetchers(config.Fetchers, config.DefaultFetcher)
+	if err != nil {
 		return nil, err
 	}
 
-	blobRepo, err := NewBlobRepository(ctx, BlobRepositoryConfig{SpoolPath: config.Layers})
+	imagePlatform, err := parsePlatform(config.Platform)
 	if err != nil {
 		return nil, err
 	}
 
+	log.G(ctx).WithField("dir", config.Layers).Info("create directory for Layers")
+	if err = os.MkdirAll(config.Layers, 0755); err != nil {
+		return nil, err
+	}
+
+	log.G(ctx).WithField("dir", config.Containers).Info("create directory for Containers")
+	if err = os.MkdirAll(config.Containers, 0755); err != nil {
+		return nil, err
+	}
+
 	tr := &http.Transport{
 		Dial: func(network, addr string) (net.Conn, error) {
 			for i := 0; i <= config.DialRetries; i++ {
@@ -181,7 +269,26 @@ func NewBox(ctx context.Context, cfg isolate.BoxConfig, gstate isolate.GlobalSta
 		ExpectContinueTimeout: 5 * time.Second,
 	}
 
-	portoConn, err := portoConnect()
+	blobRepo, err := NewBlobRepository(ctx, BlobRepositoryConfig{
+		SpoolPath:    config.Layers,
+		MaxDownloads: config.DownloadConcurrency,
+		Sources:      config.BlobSources,
+		Transport:    tr,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes *namedVolumes
+	if config.NamedVolumes.Dir != "" {
+		log.G(ctx).WithField("dir", config.NamedVolumes.Dir).Info("create directory for named volumes")
+		if volumes, err = newNamedVolumes(ctx, config.NamedVolumes); err != nil {
+			return nil, err
+		}
+	}
+
+	conns := newConnPool(portoDial, config.PortoPoolSize, time.Duration(config.PortoConnectTimeoutSec)*time.Second)
+	portoConn, err := conns.Get(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -241,6 +348,11 @@ func NewBox(ctx context.Context, cfg isolate.BoxConfig, gstate isolate.GlobalSta
 		journal:      newJournal(),
 		transport:    tr,
 		spawnSM:      semaphore.New(config.SpawnConcurrency),
+		spawnRate:    newSpawnLimiter(config.SpawnRate),
+		spools:       newSpools(),
+		exits:        newExits(),
+		layerRefs:    newLayerRefs(),
+		fetchers:     fetchers,
 		containers:   make(map[string]*container),
 		onClose:      onClose,
 		rootPrefix:   rootPrefix,
@@ -248,7 +360,17 @@ func NewBox(ctx context.Context, cfg isolate.BoxConfig, gstate isolate.GlobalSta
 		dhfEnable:    dhfEnable,
 		prefixEnable: prefixEnable,
 		blobRepo:     blobRepo,
+		platform:     imagePlatform,
+		conns:        conns,
+		namedVolumes: volumes,
+		appMetas:     newAppMetas(),
 	}
+	if config.FailedContainers.Enable {
+		box.retained = newRetainedContainers(config.FailedContainers)
+	}
+	box.layerGC = newLayerGC(config.LayerGC, config.Layers, box.journal, box.layerRefs, func() (layerStore, error) {
+		return conns.Get(ctx)
+	}, box.runningLayers)
 
 	body, err := json.Marshal(config)
 	if err != nil {
@@ -266,12 +388,33 @@ func NewBox(ctx context.Context, cfg isolate.BoxConfig, gstate isolate.GlobalSta
 		return nil, err
 	}
 
-	box.journal.UpdateFromPorto(layers)
+	if dropped := box.journal.UpdateFromPorto(layers); len(dropped) > 0 {
+		log.G(ctx).Warnf("manifests of %v have been dropped from the journal as their layers are absent in Porto", dropped)
+	}
 
 	journalContent.Set(box.journal.String())
 
+	// Workers of the previous instance are still running
+	if err = box.adoptContainers(ctx, portoConn); err != nil {
+		log.G(ctx).WithError(err).Warn("unable to adopt running containers")
+	}
+
+	if box.retained != nil {
+		if err = box.loadRetained(ctx); err != nil {
+			log.G(ctx).WithError(err).Warn("unable to load retained containers")
+		}
+		go box.runRetention(ctx)
+	}
+
 	go box.waitLoop(ctx)
 	go box.dumpJournalEvery(ctx, time.Minute)
+	go box.outputLoop(ctx)
+	if config.LayerGC.Enable {
+		go box.layerGC.run(ctx)
+	}
+	if volumes != nil {
+		go volumes.run(ctx)
+	}
 
 	return box, nil
 }
@@ -290,41 +433,11 @@ func (b *Box) dumpJournalEvery(ctx context.Context, every time.Duration) {
 
 func (b *Box) dumpJournal(ctx context.Context) (err error) {
 	defer log.G(ctx).Trace("dump journal").Stop(&err)
-	tempfile, err := ioutil.TempFile(filepath.Dir(b.config.Journal), "portojournalbak")
-	if err != nil {
-		return err
-	}
-	defer os.Remove(tempfile.Name())
-	defer tempfile.Close()
-
-	if err = b.journal.Dump(tempfile); err != nil {
-		return err
-	}
-
-	if err = os.Rename(tempfile.Name(), b.config.Journal); err != nil {
-		return err
-	}
-
-	return nil
+	return writeJournal(b.config.Journal, b.journal)
 }
 
 func (b *Box) loadJournal(ctx context.Context) error {
-	f, err := os.Open(b.config.Journal)
-	if err != nil {
-		log.G(ctx).Warnf("unable to open Journal file: %v", err)
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
-	}
-	defer f.Close()
-
-	if err = b.journal.Load(f); err != nil {
-		log.G(ctx).WithError(err).Error("unable to load Journal")
-		return err
-	}
-
-	return nil
+	return readJournal(ctx, b.config.Journal, b.journal)
 }
 
 func (b *Box) waitLoop(ctx context.Context) {
@@ -347,12 +460,12 @@ func (b *Box) waitLoop(ctx context.Context) {
 	}
 
 	log.G(ctx).Info("waitLoop: connect to Portod before gc")
-	portoConn, err = portoConnect()
+	portoConn, err = b.conns.Get(ctx)
 	if err != nil {
 		log.G(ctx).WithError(err).Warn("unable to connect to Portod")
 	}
 
-	if b.config.Gc {
+	if b.config.Gc && portoConn != nil {
 		// In future we can make another loop for gc with pattern checking like:
 		// rePattern, err := regexp.Compile("^.*_[0-9a-f]{6}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$")
 		// Now we just try clean trash one time without error handle.
@@ -367,13 +480,18 @@ func (b *Box) waitLoop(ctx context.Context) {
 		}
 		log.G(ctx).Debugf("Allocation statistic: %s.", stat)
 		var ips []string
+		tracked := b.trackedContainers()
 		for _, name := range containerNames {
+			// tracked containers are cleaned up below, retained ones are purged later
+			keep := contains(tracked, name) || b.retained != nil && b.retained.has(name)
 			containerState, _ := portoConn.GetProperty(name, "state")
 			if containerState == "dead" {
-				log.G(ctx).Debugf("At gc state destroy dead container: %s", name)
-				portoConn.Destroy(name)
+				if !keep {
+					log.G(ctx).Debugf("At gc state destroy dead container: %s", name)
+					portoConn.Destroy(name)
+				}
 			} else if containerState == "stopped" {
-				if name != b.config.MetaName {
+				if name != b.config.MetaName && !keep {
 					log.G(ctx).Debugf("At gc state destroy stopped container: %s", name)
 					portoConn.Destroy(name)
 				}
@@ -421,10 +539,11 @@ func (b *Box) waitLoop(ctx context.Context) {
 		}
 	}
 
+	// Porto wakes us up as soon as any of the containers is dead.
+	// Polling is used if Porto does not support waiting.
+	useEvents := true
 LOOP:
 	for {
-		log.G(ctx).Debugf("next iteration of waitLoop will started after %d second of sleep.", b.config.WaitLoopStepSec)
-		time.Sleep(time.Duration(b.config.WaitLoopStepSec) * time.Second)
 		if closed(portoConn) {
 			return
 		}
@@ -432,7 +551,7 @@ LOOP:
 		// In case of error: wait either a fixed timeout or closing of Box
 		if portoConn == nil {
 			log.G(ctx).Info("waitLoop: connect to Portod")
-			portoConn, err = portoConnect()
+			portoConn, err = b.conns.Get(ctx)
 			if err != nil {
 				log.G(ctx).WithError(err).Warn("unable to connect to Portod")
 				select {
@@ -444,60 +563,159 @@ LOOP:
 			}
 		}
 
-		ourContainers := []string{}
-		b.muContainers.Lock()
-		for k, _ := range b.containers {
-			ourContainers = append(ourContainers, k)
-		}
-		b.muContainers.Unlock()
-		log.G(ctx).Debugf("That containers are being tracked now: %s", ourContainers)
+		if useEvents {
+			ourContainers := b.trackedContainers()
+			if len(ourContainers) == 0 {
+				select {
+				case <-time.After(containerWaitTimeout):
+				case <-ctx.Done():
+				}
+				continue LOOP
+			}
 
-		for _, ourContainer := range ourContainers {
-			containerState, err := portoConn.GetProperty(ourContainer, "state")
-			if err != nil {
-				e := err.(*porto.Error)
-				switch e.ErrName {
-				case "ContainerDoesNotExist":
-					b.muContainers.Lock()
-					container, ok := b.containers[ourContainer]
-					if ok {
-						delete(b.containers, ourContainer)
-					}
-					rest := len(b.containers)
-					b.muContainers.Unlock()
-					if ok {
-						log.G(ctx).WithError(err).Errorf("We take ContainerDoesNotExist exception %s for exist container %s but try kill anyway.", err, ourContainer)
-						if err = container.Kill(); err != nil {
-							log.G(ctx).WithError(err).Debugf("catch at try kill ContainerDoesNotExist %s", ourContainer)
-						}
-					}
-					log.G(ctx).Debugf("%d containers are being tracked now after remove ContainerDoesNotExist %s", rest, ourContainer)
-				default:
-					portoConn.Close()
-					portoConn = nil
+			// New containers are taken into account after the timeout
+			name, err := portoConn.Wait(ourContainers, containerWaitTimeout)
+			switch {
+			case err == nil && name == "":
+				continue LOOP
+			case err == nil:
+				if b.handleWaited(ctx, portoConn, name) {
 					continue LOOP
 				}
+			case isEqualPortoError(err, portorpc.EError_ContainerDoesNotExist):
+				log.G(ctx).WithError(err).Debug("some of tracked containers do not exist")
+			case isEqualPortoError(err, portorpc.EError_NotSupported), isEqualPortoError(err, portorpc.EError_InvalidMethod):
+				log.G(ctx).WithError(err).Warn("Porto does not support waiting for containers, fallback to polling")
+				useEvents = false
+				continue LOOP
+			default:
+				log.G(ctx).WithError(err).Warn("unable to wait for containers")
+				discardConn(portoConn)
+				portoConn = nil
+				continue LOOP
 			}
-			if containerState == "dead" {
-				b.muContainers.Lock()
-				container, ok := b.containers[ourContainer]
-				if ok {
-					delete(b.containers, ourContainer)
-				}
-				rest := len(b.containers)
-				b.muContainers.Unlock()
-				log.G(ctx).Infof("%s container have status dead now.", ourContainer)
-				if ok {
-					if err = container.Kill(); err != nil {
-						log.G(ctx).WithError(err).Errorf("Killing %s error", ourContainer)
-					}
-				}
-				log.G(ctx).Infof("%d containers are being tracked now", rest)
+		} else {
+			log.G(ctx).Debugf("next iteration of waitLoop will started after %d second of sleep.", b.config.WaitLoopStepSec)
+			select {
+			case <-time.After(time.Duration(b.config.WaitLoopStepSec) * time.Second):
+			case <-ctx.Done():
+				continue LOOP
 			}
 		}
+
+		if err = b.pollContainers(ctx, portoConn); err != nil {
+			discardConn(portoConn)
+			portoConn = nil
+		}
 	}
 }
 
+// trackedContainers returns names of the tracked containers
+func (b *Box) trackedContainers() []string {
+	b.muContainers.Lock()
+	defer b.muContainers.Unlock()
+	ourContainers := make([]string, 0, len(b.containers))
+	for k := range b.containers {
+		ourContainers = append(ourContainers, k)
+	}
+	return ourContainers
+}
+
+// handleWaited cleans up the container reported by Wait.
+// It returns false if the state of the container is unexpected,
+// so all the containers must be checked.
+func (b *Box) handleWaited(ctx context.Context, portoConn porto.API, name string) bool {
+	containerState, err := portoConn.GetProperty(name, "state")
+	switch {
+	case err == nil && containerState == "dead":
+		b.untrackDead(ctx, portoConn, name)
+		return true
+	case isEqualPortoError(err, portorpc.EError_ContainerDoesNotExist):
+		b.untrackMissing(ctx, portoConn, name, err)
+		return true
+	default:
+		log.G(ctx).WithError(err).Warnf("Wait has returned %s container in %s state", name, containerState)
+		return false
+	}
+}
+
+// pollContainers checks states of all the tracked containers.
+// An error means that the connection to Porto must be recreated.
+func (b *Box) pollContainers(ctx context.Context, portoConn porto.API) error {
+	ourContainers := b.trackedContainers()
+	log.G(ctx).Debugf("That containers are being tracked now: %s", ourContainers)
+
+	for _, ourContainer := range ourContainers {
+		containerState, err := portoConn.GetProperty(ourContainer, "state")
+		if err != nil {
+			if !isEqualPortoError(err, portorpc.EError_ContainerDoesNotExist) {
+				return err
+			}
+			b.untrackMissing(ctx, portoConn, ourContainer, err)
+		}
+		if containerState == "dead" {
+			b.untrackDead(ctx, portoConn, ourContainer)
+		}
+	}
+	return nil
+}
+
+// untrack stops tracking of the container. It returns nil if the container is not tracked
+// and the number of the containers which are still being tracked.
+func (b *Box) untrack(name string) (*container, int) {
+	b.muContainers.Lock()
+	defer b.muContainers.Unlock()
+	container := b.containers[name]
+	delete(b.containers, name)
+	return container, len(b.containers)
+}
+
+func (b *Box) untrackMissing(ctx context.Context, portoConn porto.API, name string, err error) {
+	container, rest := b.untrack(name)
+	if container != nil {
+		log.G(ctx).WithError(err).Errorf("We take ContainerDoesNotExist exception %s for exist container %s but try kill anyway.", err, name)
+		start := time.Now()
+		if err = container.Kill(); err != nil {
+			log.G(ctx).WithError(err).Debugf("catch at try kill ContainerDoesNotExist %s", name)
+		}
+		b.releaseAppMeta(ctx, portoConn, container)
+		containerCleanupTimer.UpdateSince(start)
+	}
+	log.G(ctx).Debugf("%d containers are being tracked now after remove ContainerDoesNotExist %s", rest, name)
+}
+
+func (b *Box) untrackDead(ctx context.Context, portoConn porto.API, name string) {
+	container, rest := b.untrack(name)
+	log.G(ctx).Infof("%s container have status dead now.", name)
+	if container != nil {
+		exit, err := b.handleExit(ctx, portoConn, container)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("id", name).Warn("unable to read how the container has exited")
+		}
+		if err != nil || !b.retainIfFailed(ctx, portoConn, container, exit) {
+			start := time.Now()
+			if err := container.Kill(); err != nil {
+				log.G(ctx).WithError(err).Errorf("Killing %s error", name)
+			}
+			b.releaseAppMeta(ctx, portoConn, container)
+			containerCleanupTimer.UpdateSince(start)
+		}
+	}
+	log.G(ctx).Infof("%d containers are being tracked now", rest)
+}
+
+// runningLayers returns apps and layers of the tracked containers
+func (b *Box) runningLayers() ([]string, []string) {
+	var apps, layers []string
+	b.muContainers.Lock()
+	for _, container := range b.containers {
+		apps = append(apps, container.appName)
+		layers = append(layers, strings.Split(container.layers, ";")...)
+	}
+	b.muContainers.Unlock()
+	return apps, layers
+}
+
 func (b *Box) appGenLabel(appname string) string {
 	appname = strings.Replace(appname, ":", "_", -1)
 	return appname
@@ -514,29 +732,62 @@ func (b *Box) addRootNamespacePrefix(container string) string {
 	return filepath.Join(b.rootPrefix, container)
 }
 
-// get layers from registy
-func (b *Box) getLayersViaDownloadHelper(ctx context.Context, name string, profile Profile) error {
-	layers := make([]string, 0)
+// fetchLayer fetches the layer described by the profile with its fetcher
+// or the download helper if the layer has no fetcher
+func (b *Box) fetchLayer(ctx context.Context, name string, layer Layer) (string, error) {
+	blobPath := filepath.Join(b.config.Layers, layer.Digest)
+	lf, err := b.fetchers.pick(layer)
+	if err != nil {
+		return "", err
+	}
+	if lf != nil {
+		err = lf.Fetch(ctx, fetcher.Request{
+			Digest:      layer.Digest,
+			DigestType:  layer.DigestType,
+			Size:        uint64(layer.Size),
+			Source:      layer.Source,
+			TorrentID:   layer.TorrentId,
+			Destination: blobPath,
+		})
+		if err != nil {
+			os.Remove(blobPath)
+			return "", err
+		}
+		return blobPath, nil
+	}
+	if !b.dhEnable {
+		return "", fmt.Errorf("layer %s has no fetcher", layer.Digest)
+	}
 
-	portoConn, err := portoConnect()
+	wctx, cancel := context.WithTimeout(ctx, 1*time.Hour)
+	defer cancel()
+	timeout := fmt.Sprint(300 + uint(60*(layer.Size/(100*1024*1024))))
+	cmd := exec.CommandContext(wctx, b.config.DownloadHelperCmd, "get", "-d", b.config.Layers,
+		"-t", timeout, layer.TorrentId)
+	stdoutStderr, err := cmd.CombinedOutput()
 	if err != nil {
-		log.G(ctx).WithError(err).WithField("name", name).Error("Porto connection error")
-		return err
+		log.G(ctx).WithError(err).WithField("name", name).Errorf("When download layer via download helper. output is: %s.", stdoutStderr)
+		if ctx.Err() != nil {
+			// the helper has been killed, so the blob is incomplete
+			os.Remove(blobPath)
+			return "", ctx.Err()
+		}
+		return "", err
 	}
-	defer portoConn.Close()
+	return blobPath, nil
+}
+
+// get layers listed in the profile via fetchers
+func (b *Box) getLayersViaFetchers(ctx context.Context, tx *layerTx, name string, profile Profile) error {
+	layers := make([]string, 0)
+
 	for _, layer := range profile.ExtendedInfo.Layers {
 		portoLayerName := fmt.Sprintf("%s_%s", layer.DigestType, layer.Digest)
-		wctx, cancel := context.WithTimeout(context.Background(), 1*time.Hour)
-		defer cancel()
-		timeout := fmt.Sprint(300 + uint(60*(layer.Size/(100*1024*1024))))
-		cmd := exec.CommandContext(wctx, b.config.DownloadHelperCmd, "get", "-d", b.config.Layers,
-			"-t", timeout, layer.TorrentId)
-		stdoutStderr, err := cmd.CombinedOutput()
+		tx.use(portoLayerName)
+		blobPath, err := b.fetchLayer(ctx, name, layer)
 		if err != nil {
-			log.G(ctx).WithError(err).WithField("name", name).Errorf("When download layer via download helper. output is: %s.", stdoutStderr)
 			return err
 		}
-		blobPath := filepath.Join(b.config.Layers, layer.Digest)
 		f, err := os.Open(blobPath)
 		if err != nil {
 			return fmt.Errorf("ERROR when open layer %s for check hashsumm.", blobPath)
@@ -551,10 +802,7 @@ func (b *Box) getLayersViaDownloadHelper(ctx context.Context, name string, profi
 		if digest != layer.Digest {
 			return fmt.Errorf("ERROR hashsum missmatch, hashSum.Sum(): %s, Digest: %s.", digest, layer.Digest)
 		}
-		entry := log.G(ctx).WithField("layer", blobPath).Trace("Try to import layer")
-		err = portoConn.ImportLayer(portoLayerName, blobPath, false)
-		if err != nil && !isEqualPortoError(err, portorpc.EError_LayerAlreadyExists) {
-			entry.Stop(&err)
+		if err = tx.importLayer(ctx, portoLayerName, blobPath); err != nil {
 			return err
 		}
 		layers = append(layers, portoLayerName)
@@ -564,7 +812,7 @@ func (b *Box) getLayersViaDownloadHelper(ctx context.Context, name string, profi
 }
 
 // get layers from registy
-func (b *Box) getLayersViaRegistry(ctx context.Context, name string, profile Profile) error {
+func (b *Box) getLayersViaRegistry(ctx context.Context, tx *layerTx, name string, profile Profile) error {
 	if profile.Registry == "" {
 		log.G(ctx).WithField("name", name).Error("Registry must be non empty")
 		return fmt.Errorf("Registry must be non empty")
@@ -609,28 +857,42 @@ func (b *Box) getLayersViaRegistry(ctx context.Context, name string, profile Pro
 		return err
 	}
 
+	// multi-arch image: pick a manifest for our platform
+	if list, ok := manifest.(*manifestList); ok {
+		descriptor, err := list.Select(b.platform)
+		if err != nil {
+			return err
+		}
+		log.G(ctx).WithFields(apexlog.Fields{"name": name, "platform": b.platform, "digest": descriptor.Digest}).Debug("manifest has been selected from the list")
+
+		if manifest, err = manifests.Get(ctx, descriptor.Digest); err != nil {
+			return err
+		}
+	}
+
 	var order layersOrder
 	switch manifest.(type) {
 	case schema1.SignedManifest, *schema1.SignedManifest:
 		order = layerOrderV1
-	case schema2.DeserializedManifest, *schema2.DeserializedManifest:
+	case schema2.DeserializedManifest, *schema2.DeserializedManifest, *ociManifest:
 		order = layerOrderV2
+	case *manifestList:
+		return fmt.Errorf("nested manifest lists are not supported")
 	default:
 		return fmt.Errorf("unknown manifest type %T", manifest)
 	}
 
 	layers := make([]string, 0)
 
-	portoConn, err := portoConnect()
-	if err != nil {
-		log.G(ctx).WithError(err).WithField("name", name).Error("Porto connection error")
-		return err
-	}
-	defer portoConn.Close()
-
 	for _, descriptor := range order(manifest.References()) {
 		// TODO: Add support for __weak__ layers
 		layerName := descriptor.Digest.String()
+		compression, err := compressionOf(descriptor.MediaType)
+		if err != nil {
+			return err
+		}
+		portoLayerName := strings.Replace(layerName, ":", "_", -1)
+		tx.use(portoLayerName)
 		// TODO: insert check of the layer existance here
 		// ListLayers is too heavy IMHO
 		// if the layer presents we can skip it
@@ -638,11 +900,16 @@ func (b *Box) getLayersViaRegistry(ctx context.Context, name string, profile Pro
 		if err != nil {
 			return err
 		}
-		entry := log.G(ctx).WithField("layer", layerName).Trace("Try to import layer")
-		portoLayerName := strings.Replace(layerName, ":", "_", -1)
-		err = portoConn.ImportLayer(portoLayerName, blobPath, false)
-		if err != nil && !isEqualPortoError(err, portorpc.EError_LayerAlreadyExists) {
-			entry.Stop(&err)
+		if compression == compressionZstd {
+			if blobPath, err = decompressZstd(ctx, b.config.ZstdCmd, blobPath); err != nil {
+				return err
+			}
+		}
+		err = tx.importLayer(ctx, portoLayerName, blobPath)
+		if compression == compressionZstd {
+			os.Remove(blobPath)
+		}
+		if err != nil {
 			return err
 		}
 		layers = append(layers, portoLayerName)
@@ -652,6 +919,28 @@ func (b *Box) getLayersViaRegistry(ctx context.Context, name string, profile Pro
 	return nil
 }
 
+// importLayer imports the blob into Porto. An existing layer is not an error,
+// created reports whether the layer has been imported by the call.
+func (b *Box) importLayer(ctx context.Context, layer, blobPath string) (created bool, err error) {
+	portoConn, err := b.conns.Get(ctx)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("layer", layer).Error("Porto connection error")
+		return false, err
+	}
+	defer portoConn.Close()
+
+	entry := log.G(ctx).WithField("layer", blobPath).Trace("Try to import layer")
+	err = portoConn.ImportLayer(layer, blobPath, false)
+	if err != nil {
+		if isEqualPortoError(err, portorpc.EError_LayerAlreadyExists) {
+			return false, nil
+		}
+		entry.Stop(&err)
+		return false, err
+	}
+	return true, nil
+}
+
 // Spool downloades Docker images from Distribution, builds base layer for Porto container
 func (b *Box) Spool(ctx context.Context, name string, opts isolate.RawProfile) (err error) {
 	defer log.G(ctx).WithField("name", name).Trace("spool").Stop(&err)
@@ -662,14 +951,67 @@ func (b *Box) Spool(ctx context.Context, name string, opts isolate.RawProfile) (
 		return err
 	}
 
+	return b.spoolProfile(ctx, name, profile)
+}
+
+// spool checks the profile and imports layers of the app.
+// Concurrent calls for the same app must be deduplicated by b.spools.
+func (b *Box) spool(ctx context.Context, name string, profile *Profile) (err error) {
+	if err = b.config.ContainerProperties.check(profile.Container); err != nil {
+		log.G(ctx).WithError(err).WithField("name", name).Error("invalid container section of the profile")
+		return err
+	}
+
+	if err = checkAppLimits(profile.AppLimits); err != nil {
+		log.G(ctx).WithError(err).WithField("name", name).Error("invalid app_limits section of the profile")
+		return err
+	}
+
+	if _, err = parseBinds(profile.Binds); err != nil {
+		log.G(ctx).WithError(err).WithField("name", name).Error("invalid binds of the profile")
+		return err
+	}
+
+	// MTN allocations take the place of the network section
+	if !b.GlobalState.Mtn.Cfg.Enable || profile.Network["mtn"] != "enable" {
+		network, err := parseNetwork(profile.NetworkMode, profile.Network, b.config.NetworkMaster)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("name", name).Error("invalid network section of the profile")
+			return err
+		}
+		if warning := network.warning(); warning != "" {
+			log.G(ctx).WithField("name", name).Warn(warning)
+		}
+	}
+
+	for _, volume := range profile.ExtraVolumes {
+		if volume.Name == "" {
+			continue
+		}
+		if b.namedVolumes == nil {
+			err = fmt.Errorf("volume %s is named, but named volumes are disabled in the box", volume.Name)
+		} else {
+			err = b.namedVolumes.validate(volume)
+		}
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("name", name).Error("invalid extra volume of the profile")
+			return err
+		}
+	}
+
+	// layers are not collected until they are referenced by the journal,
+	// the ones imported by a failed spool are removed
+	tx := b.newLayerTx()
+	defer func() { tx.finish(ctx, err) }()
+
 	var errGet error
 	layersImported := false
-	if len(profile.ExtendedInfo.Layers) > 0 && b.dhEnable {
-		log.G(ctx).Debugf("Try get layers via download_helper cmd: %s.", b.config.DownloadHelperCmd)
-		errGet = b.getLayersViaDownloadHelper(ctx, name, *profile)
+	if len(profile.ExtendedInfo.Layers) > 0 && (b.dhEnable || b.fetchers.enabled()) {
+		log.G(ctx).Debugf("Try get layers via fetchers or download_helper cmd: %s.", b.config.DownloadHelperCmd)
+		errGet = b.getLayersViaFetchers(ctx, tx, name, *profile)
 		if errGet != nil {
-			log.G(ctx).Warnf("Cant get layers via download helper, name: %s, error: %s.", name, errGet)
-			if !b.dhfEnable {
+			log.G(ctx).Warnf("Cant get layers via fetchers, name: %s, error: %s.", name, errGet)
+			if !b.dhfEnable || ctx.Err() != nil {
 				return errGet
 			}
 		} else {
@@ -677,14 +1019,15 @@ func (b *Box) Spool(ctx context.Context, name string, opts isolate.RawProfile) (
 		}
 	}
 	if !layersImported {
-		log.G(ctx).Debugf("Try get layers via  registry. No layers in ExtendedInfo: %s or download helper not enabled: %s.",
-			profile.ExtendedInfo.Layers, b.dhEnable)
-		errGet = b.getLayersViaRegistry(ctx, name, *profile)
+		log.G(ctx).Debugf("Try get layers via  registry. No layers in ExtendedInfo: %s or fetchers not enabled: %s.",
+			profile.ExtendedInfo.Layers, b.dhEnable || b.fetchers.enabled())
+		errGet = b.getLayersViaRegistry(ctx, tx, name, *profile)
 	}
 	if errGet != nil {
 		log.G(ctx).Errorf("Cant Spool(), name: %s, error: %s.", name, errGet)
 		return errGet
 	}
+	b.layerGC.Used(name)
 
 	// NOTE: Not so fast, but it's important for debug
 	journalContent.Set(b.journal.String())
@@ -699,15 +1042,6 @@ func (b *Box) Spool(ctx context.Context, name string, opts isolate.RawProfile) (
 	return nil
 }
 
-// ReleaseLock release spawn lock by configurable timeout
-func (b *Box) ReleaseLock(ctx context.Context) {
-	if b.config.SpawnTimeout > 0 {
-		log.G(ctx).Debugf("start spawn timeout for next porto container: %d", b.config.SpawnTimeout)
-	}
-	time.Sleep(time.Duration(b.config.SpawnTimeout) * time.Second)
-	b.spawnSM.Release()
-}
-
 // Spawn spawns new Porto container
 func (b *Box) Spawn(ctx context.Context, config isolate.SpawnConfig, output io.Writer) (isolate.Process, error) {
 	var profile = new(Profile)
@@ -716,32 +1050,56 @@ func (b *Box) Spawn(ctx context.Context, config isolate.SpawnConfig, output io.W
 		log.G(ctx).WithError(err).Error("unable to decode profile")
 		return nil, err
 	}
-	start := time.Now()
-
-	spawningQueueSize.Inc(1)
-	if spawningQueueSize.Count() > 10 {
-		spawningQueueSize.Dec(1)
-		return nil, syscall.EAGAIN
+	// the app may be spawned with a profile that has never been spooled
+	if err = b.config.ContainerProperties.check(profile.Container); err != nil {
+		log.G(ctx).WithError(err).WithField("name", config.Name).Error("invalid container section of the profile")
+		return nil, err
 	}
+	start := time.Now()
 
 	layers := b.journal.GetManifestLayers(config.Name)
+	if b.config.AutoSpool {
+		if layers, err = b.autoSpool(ctx, config.Name, profile); err != nil {
+			return nil, err
+		}
+	}
 	if layers == "" {
 		err := fmt.Errorf("no layers in the journal for the app")
 		log.G(ctx).WithFields(apexlog.Fields{"name": config.Name, "error": err}).Error("unable to start container")
 		return nil, err
 	}
+	// layers must not be collected until the container is tracked
+	usedLayers := strings.Split(layers, ";")
+	b.layerRefs.ref(usedLayers...)
+	defer b.layerRefs.release(usedLayers)
+
+	spawningQueueSize.Inc(1)
+	if spawningQueueSize.Count() > 10 {
+		spawningQueueSize.Dec(1)
+		return nil, syscall.EAGAIN
+	}
 
 	ID := b.appGenLabel(config.Name) + "_" + config.Args["--uuid"]
+	containerID := b.addRootNamespacePrefix(ID)
+	var meta string
+	if b.config.AppMeta.Enable {
+		meta = b.appMetaName(config.Name)
+		containerID = meta + "/" + ID
+	}
 	cfg := containerConfig{
 		BoxName:        b.Name,
 		Root:           filepath.Join(b.config.Containers, ID),
-		ID:             b.addRootNamespacePrefix(ID),
+		ID:             containerID,
 		Layer:          layers,
 		State:          b.GlobalState,
 		CleanupEnabled: b.config.CleanupEnabled,
 		SetImgURI:      b.config.SetImgURI,
 		VolumeBackend:  b.config.VolumeBackend,
 		VolumeLabel:    b.config.CocaineAppVolumeLabel,
+		NetworkMaster:  b.config.NetworkMaster,
+		Properties:     &b.config.ContainerProperties,
+		NamedVolumes:   b.namedVolumes,
+		conns:          b.conns,
 		execInfo: execInfo{
 			Profile:     profile,
 			name:        config.Name,
@@ -753,27 +1111,49 @@ func (b *Box) Spawn(ctx context.Context, config isolate.SpawnConfig, output io.W
 		},
 	}
 
-	portoConn, err := portoConnect()
-	if err != nil {
-		return nil, err
+	queued := time.Now()
+	err = b.spawnRate.Wait(ctx, config.Name)
+	if err == nil {
+		err = b.spawnSM.Acquire(ctx)
 	}
-	defer portoConn.Close()
-
-	err = b.spawnSM.Acquire(ctx)
 	spawningQueueSize.Dec(1)
 	if err != nil {
 		return nil, isolate.ErrSpawningCancelled
 	}
-	defer b.ReleaseLock(ctx)
+	spawnQueueTimer.UpdateSince(queued)
+	defer b.spawnSM.Release()
+
+	portoConn, err := b.conns.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer portoConn.Close()
+
+	b.layerGC.Used(config.Name)
 
 	log.G(ctx).WithFields(apexlog.Fields{"name": config.Name, "layer": cfg.Layer, "root": cfg.Root, "id": cfg.ID}).Info("Create container")
 
+	if meta != "" {
+		if err = b.appMetas.acquire(ctx, portoConn, meta, b.config.AppMeta.limits(profile.AppLimits)); err != nil {
+			log.G(ctx).WithError(err).WithField("name", config.Name).Error("unable to prepare meta container of the app")
+			return nil, err
+		}
+	}
+
 	containersCreatedCounter.Inc(1)
 	pr, err := newContainer(ctx, portoConn, cfg)
 	if err != nil {
 		containersErroredCounter.Inc(1)
+		if meta != "" {
+			b.appMetas.release(ctx, portoConn, meta)
+		}
 		return nil, err
 	}
+	pr.meta = meta
+
+	if err = pr.saveState(); err != nil {
+		log.G(ctx).WithError(err).WithField("id", pr.containerID).Warn("unable to save the state of the container, it can not be adopted after restart")
+	}
 
 	b.muContainers.Lock()
 	b.containers[pr.containerID] = pr
@@ -781,10 +1161,17 @@ func (b *Box) Spawn(ctx context.Context, config isolate.SpawnConfig, output io.W
 
 	if err = pr.start(portoConn, output); err != nil {
 		containersErroredCounter.Inc(1)
-		pr.Cleanup(portoConn)
+		b.untrack(pr.containerID)
+		if b.retained != nil && pr.cleanupEnabled {
+			b.retain(ctx, portoConn, pr, fmt.Sprintf("failed to start: %v", err), exitInfo{})
+		} else {
+			pr.Cleanup(portoConn)
+			b.releaseAppMeta(ctx, portoConn, pr)
+		}
 		return nil, err
 	}
 	isolate.NotifyAboutStart(output)
+	pr.startStreaming()
 	totalSpawnTimer.UpdateSince(start)
 	return pr, nil
 }
@@ -795,10 +1182,11 @@ func (b *Box) Inspect(ctx context.Context, workeruuid string) ([]byte, error) {
 		if pr.uuid == workeruuid {
 			b.muContainers.Unlock()
 
-			portoConn, err := portoConnect()
+			portoConn, err := b.conns.Get(ctx)
 			if err != nil {
 				return nil, err
 			}
+			defer portoConn.Close()
 			list := getPListAndDlist(portoConn)
 			result, err := portoConn.Get([]string{cid}, list)
 			if err != nil {
@@ -809,13 +1197,33 @@ func (b *Box) Inspect(ctx context.Context, workeruuid string) ([]byte, error) {
 		}
 	}
 	b.muContainers.Unlock()
+
+	// the worker has exited already
+	if exit, ok := b.exits.get(workeruuid); ok {
+		return json.Marshal(exit)
+	}
 	return []byte(""), nil
 }
 
+// HTTPHandlers returns endpoints of named volumes and retained containers if they are enabled
+func (b *Box) HTTPHandlers(ctx context.Context) map[string]http.Handler {
+	handlers := make(map[string]http.Handler)
+	if b.namedVolumes != nil {
+		handlers["volumes"] = b.namedVolumes
+	}
+	if b.retained != nil {
+		handlers["retained"] = b.retainedHandler(ctx)
+	}
+	return handlers
+}
+
 // Close releases all resources such as idle connections from http.Transport
 func (b *Box) Close() error {
 	b.transport.CloseIdleConnections()
-	b.GlobalState.Mtn.Db.Close()
+	b.conns.Close()
+	if b.GlobalState.Mtn != nil && b.GlobalState.Mtn.Db != nil {
+		b.GlobalState.Mtn.Db.Close()
+	}
 	b.onClose()
 	return nil
 }
@@ -0,0 +1,763 @@
+package porto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/isolate"
+	porto "github.com/yandex/porto/src/api/go"
+	portorpc "github.com/yandex/porto/src/api/go/rpc"
+)
+
+// syncBuffer collects output of a container
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type fakeBoxEnv struct {
+	porto *fakePorto
+	dir   string
+	cfg   isolate.BoxConfig
+}
+
+// newFakeBoxEnv makes NewBox use an in-memory Portod
+func newFakeBoxEnv(t *testing.T) *fakeBoxEnv {
+	dir, err := ioutil.TempDir("", "fakebox")
+	require.NoError(t, err)
+
+	env := &fakeBoxEnv{
+		porto: newFakePorto(),
+		dir:   dir,
+		cfg: isolate.BoxConfig{
+			"layers":          filepath.Join(dir, "layers"),
+			"containers":      filepath.Join(dir, "containers"),
+			"journal":         filepath.Join(dir, "journal.jrnl"),
+			"output_poll_ms":  10,
+			"waitloopstepsec": 1,
+		},
+	}
+	portoDial = env.porto.Connect
+	return env
+}
+
+func (e *fakeBoxEnv) Close() {
+	portoDial = porto.Connect
+	os.RemoveAll(e.dir)
+}
+
+func (e *fakeBoxEnv) newBox(t *testing.T) *Box {
+	box, err := NewBox(context.Background(), e.cfg, isolate.GlobalState{Mtn: new(isolate.MtnState)})
+	require.NoError(t, err)
+	return box.(*Box)
+}
+
+// importApp imports a layer and registers the app in the journal
+func (e *fakeBoxEnv) importApp(t *testing.T, box *Box, app string) {
+	tarball := filepath.Join(e.dir, app+".tar")
+	require.NoError(t, ioutil.WriteFile(tarball, []byte("layer"), 0644))
+	_, err := box.importLayer(context.Background(), app+"_layer", tarball)
+	require.NoError(t, err)
+	box.journal.InsertManifestLayers(app, app+"_layer")
+}
+
+func spawnConfig(t *testing.T, app, uuid string) isolate.SpawnConfig {
+	opts, err := isolate.NewRawProfile(map[string]interface{}{"cwd": "/usr/bin"})
+	require.NoError(t, err)
+	return isolate.SpawnConfig{
+		Opts:       opts,
+		Name:       app,
+		Executable: "/usr/bin/worker",
+		Args: map[string]string{
+			"--uuid":     uuid,
+			"--endpoint": "/var/run/cocaine.sock",
+		},
+		Env: map[string]string{"A": "B"},
+	}
+}
+
+func eventually(cond func() bool) bool {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestFakePortoStateMachine(t *testing.T) {
+	require := require.New(t)
+	fake := newFakePorto()
+	conn, err := fake.Connect()
+	require.NoError(err)
+
+	require.NoError(conn.Create("a"))
+	require.True(isEqualPortoError(conn.Create("a"), portorpc.EError_ContainerAlreadyExists))
+	require.True(isEqualPortoError(conn.Create("b/c"), portorpc.EError_ContainerDoesNotExist))
+	require.True(isEqualPortoError(conn.Kill("a", 9), portorpc.EError_InvalidState))
+	require.Equal(portorpc.EError_InvalidState, conn.GetLastError())
+
+	require.NoError(conn.SetProperty("a", "command", "sleep 100"))
+	require.NoError(conn.Start("a"))
+	state, err := conn.GetProperty("a", "state")
+	require.NoError(err)
+	require.Equal("running", state)
+
+	name, err := conn.Wait([]string{"a"}, 10*time.Millisecond)
+	require.NoError(err)
+	require.Empty(name)
+
+	go fake.Exit("a", 1, true)
+	name, err = conn.Wait([]string{"a"}, time.Second)
+	require.NoError(err)
+	require.Equal("a", name)
+	oom, err := conn.GetProperty("a", "oom_killed")
+	require.NoError(err)
+	require.Equal("true", oom)
+
+	require.NoError(conn.Destroy("a"))
+	_, err = conn.Wait([]string{"a"}, time.Second)
+	require.True(isEqualPortoError(err, portorpc.EError_ContainerDoesNotExist))
+
+	require.NoError(conn.Close())
+	require.Equal(0, fake.Conns())
+}
+
+func TestBoxWithFakePorto(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	env := newFakeBoxEnv(t)
+	defer env.Close()
+	box := env.newBox(t)
+	defer box.Close()
+	env.importApp(t, box, "app")
+
+	var output syncBuffer
+	pr, err := box.Spawn(ctx, spawnConfig(t, "app", "uuid1"), &output)
+	require.NoError(err)
+	cnt := pr.(*container)
+
+	command, err := env.porto.Property(cnt.containerID, "command")
+	require.NoError(err)
+	require.Equal("/usr/bin/worker", strings.Fields(command)[0])
+	require.Equal("uuid1", parseUUID(command))
+	root, err := env.porto.Property(cnt.containerID, "root")
+	require.NoError(err)
+	require.Equal(cnt.volume.Path(), root)
+	properties, linked, ok := env.porto.Volume(root)
+	require.True(ok)
+	require.Equal("app_layer", properties["layers"])
+	require.Equal([]string{cnt.containerID}, linked)
+
+	// the output is streamed while the container is running
+	require.NoError(env.porto.Write(cnt.containerID, "stdout", "hello"))
+	require.True(eventually(func() bool { return strings.HasSuffix(output.String(), "hello") }))
+
+	data, err := box.Inspect(ctx, "uuid1")
+	require.NoError(err)
+	require.Contains(string(data), "running")
+
+	// a dead container is cleaned up by waitLoop
+	require.NoError(env.porto.Exit(cnt.containerID, 0, false))
+	require.True(eventually(func() bool { return env.porto.State(cnt.containerID) == "" }))
+	require.True(eventually(func() bool { return len(box.trackedContainers()) == 0 }))
+	_, _, ok = env.porto.Volume(root)
+	require.False(ok)
+	_, err = os.Stat(cnt.rootDir)
+	require.True(os.IsNotExist(err))
+}
+
+func TestBoxAdoptsContainersWithFakePorto(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	env := newFakeBoxEnv(t)
+	defer env.Close()
+	box := env.newBox(t)
+	env.importApp(t, box, "app")
+
+	pr, err := box.Spawn(ctx, spawnConfig(t, "app", "uuid1"), ioutil.Discard)
+	require.NoError(err)
+	containerID := pr.(*container).containerID
+	require.NoError(box.dumpJournal(ctx))
+	box.Close()
+
+	// the daemon has been restarted, the worker is still running
+	restarted := env.newBox(t)
+	defer restarted.Close()
+	require.Equal([]string{containerID}, restarted.trackedContainers())
+	data, err := restarted.Inspect(ctx, "uuid1")
+	require.NoError(err)
+	require.Contains(string(data), "running")
+
+	adopted := restarted.containers[containerID]
+	require.Equal("app", adopted.appName)
+	require.Equal("app_layer", adopted.layers)
+	require.NoError(adopted.Kill())
+	require.Equal("", env.porto.State(containerID))
+}
+
+func TestBoxSpoolRejectsInvalidNetworkWithFakePorto(t *testing.T) {
+	env := newFakeBoxEnv(t)
+	defer env.Close()
+	box := env.newBox(t)
+	defer box.Close()
+
+	opts, err := isolate.NewRawProfile(map[string]interface{}{
+		"registry":     "http://localhost:1",
+		"network_mode": "macvlan",
+	})
+	require.NoError(t, err)
+	err = box.Spool(context.Background(), "app", opts)
+	require.EqualError(t, err, "macvlan network mode requires a master interface")
+}
+
+func TestBoxContainerPropertiesWithFakePorto(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	env := newFakeBoxEnv(t)
+	defer env.Close()
+	env.cfg["defaultulimits"] = "nofile: 1024 1024"
+	env.cfg["container_properties"] = map[string]interface{}{
+		"deny":     []string{"capabilities"},
+		"merge":    map[string]string{"ulimit": mergeAppend},
+		"defaults": map[string]string{"ulimit": "core: 0 0"},
+	}
+	_, err := NewBox(ctx, env.cfg, isolate.GlobalState{Mtn: new(isolate.MtnState)})
+	require.Error(err)
+
+	env.cfg["container_properties"] = map[string]interface{}{
+		"deny":  []string{"capabilities"},
+		"merge": map[string]string{"ulimit": mergeAppend},
+	}
+	box := env.newBox(t)
+	defer box.Close()
+	env.importApp(t, box, "app")
+
+	spawn := func(uuid string, properties map[string]string) (*container, error) {
+		config := spawnConfig(t, "app", uuid)
+		opts, err := isolate.NewRawProfile(map[string]interface{}{"container": properties})
+		require.NoError(err)
+		config.Opts = opts
+		pr, err := box.Spawn(ctx, config, ioutil.Discard)
+		if err != nil {
+			return nil, err
+		}
+		return pr.(*container), nil
+	}
+
+	// a denied property rejects the spawn even if the app has not been spooled
+	_, err = spawn("uuid1", map[string]string{"capabilities": "SYS_ADMIN"})
+	require.EqualError(err, `property "capabilities" is denied by the box`)
+	require.Empty(box.trackedContainers())
+
+	// the ulimit of the profile is merged with defaultulimits
+	cnt, err := spawn("uuid2", map[string]string{"ulimit": "core: 0 0"})
+	require.NoError(err)
+	ulimit, err := env.porto.Property(cnt.containerID, "ulimit")
+	require.NoError(err)
+	require.Equal("nofile: 1024 1024;core: 0 0", ulimit)
+
+	cnt, err = spawn("uuid3", nil)
+	require.NoError(err)
+	ulimit, err = env.porto.Property(cnt.containerID, "ulimit")
+	require.NoError(err)
+	require.Equal("nofile: 1024 1024", ulimit)
+}
+
+func TestBoxNamedVolumesWithFakePorto(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	env := newFakeBoxEnv(t)
+	defer env.Close()
+	env.cfg["named_volumes"] = map[string]interface{}{"dir": filepath.Join(env.dir, "volumes")}
+	box := env.newBox(t)
+	defer box.Close()
+	env.importApp(t, box, "app")
+
+	// a profile can be decoded once
+	withVolume := func(uuid string) isolate.SpawnConfig {
+		config := spawnConfig(t, "app", uuid)
+		opts, err := isolate.NewRawProfile(map[string]interface{}{
+			"extravolumes": []interface{}{
+				map[string]interface{}{
+					"target":     "/cache",
+					"name":       "cache",
+					"properties": map[string]interface{}{"backend": "bind"},
+				},
+			},
+		})
+		require.NoError(err)
+		config.Opts = opts
+		return config
+	}
+
+	pr, err := box.Spawn(ctx, withVolume("uuid1"), ioutil.Discard)
+	require.NoError(err)
+	cnt := pr.(*container)
+	require.Len(cnt.extraVolumes, 1)
+	properties, _, ok := env.porto.Volume(cnt.extraVolumes[0].Path())
+	require.True(ok)
+	storage := filepath.Join(env.dir, "volumes", "app", "cache", "data")
+	require.Equal(storage, properties["storage"])
+	require.NoError(ioutil.WriteFile(filepath.Join(storage, "state"), []byte("data"), 0644))
+
+	// the volume is exclusive
+	_, err = box.Spawn(ctx, withVolume("uuid2"), ioutil.Discard)
+	require.Error(err)
+
+	// the data outlives the worker
+	require.NoError(pr.Kill())
+	require.Equal("", env.porto.State(cnt.containerID))
+	pr, err = box.Spawn(ctx, withVolume("uuid3"), ioutil.Discard)
+	require.NoError(err)
+	properties, _, ok = env.porto.Volume(pr.(*container).extraVolumes[0].Path())
+	require.True(ok)
+	require.Equal(storage, properties["storage"])
+	data, err := ioutil.ReadFile(filepath.Join(storage, "state"))
+	require.NoError(err)
+	require.Equal("data", string(data))
+
+	volumes := box.namedVolumes.List("app")
+	require.Len(volumes, 1)
+	require.Equal([]string{pr.(*container).containerID}, volumes[0].Users)
+}
+
+func TestBoxAppMetaWithFakePorto(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	env := newFakeBoxEnv(t)
+	defer env.Close()
+	env.cfg["app_meta"] = map[string]interface{}{
+		"enable":   true,
+		"defaults": map[string]interface{}{"memory_limit": "1G", "cpu_limit": "2c"},
+	}
+	box := env.newBox(t)
+	env.importApp(t, box, "app")
+
+	withLimits := func(uuid string) isolate.SpawnConfig {
+		config := spawnConfig(t, "app", uuid)
+		opts, err := isolate.NewRawProfile(map[string]interface{}{
+			"app_limits": map[string]interface{}{"memory_limit": "4G"},
+		})
+		require.NoError(err)
+		config.Opts = opts
+		return config
+	}
+
+	first, err := box.Spawn(ctx, withLimits("uuid1"), ioutil.Discard)
+	require.NoError(err)
+	second, err := box.Spawn(ctx, withLimits("uuid2"), ioutil.Discard)
+	require.NoError(err)
+
+	require.Equal("app/app_uuid1", first.(*container).containerID)
+	require.Equal("app/app_uuid2", second.(*container).containerID)
+	require.Equal("meta", env.porto.State("app"))
+	limit, err := env.porto.Property("app", "memory_limit")
+	require.NoError(err)
+	require.Equal("4G", limit)
+	limit, err = env.porto.Property("app", "cpu_limit")
+	require.NoError(err)
+	require.Equal("2c", limit)
+
+	// the meta container outlives all but the last worker
+	require.NoError(env.porto.Exit("app/app_uuid1", 0, false))
+	require.True(eventually(func() bool { return len(box.trackedContainers()) == 1 }))
+	require.Equal("meta", env.porto.State("app"))
+
+	// workers stay in the meta container after restart of the daemon
+	require.NoError(box.dumpJournal(ctx))
+	box.Close()
+	restarted := env.newBox(t)
+	defer restarted.Close()
+	require.Equal([]string{"app/app_uuid2"}, restarted.trackedContainers())
+
+	require.NoError(env.porto.Exit("app/app_uuid2", 0, false))
+	require.True(eventually(func() bool { return len(restarted.trackedContainers()) == 0 }))
+	require.True(eventually(func() bool { return env.porto.State("app") == "" }))
+
+	opts, err := isolate.NewRawProfile(map[string]interface{}{
+		"registry":   "http://localhost:1",
+		"app_limits": map[string]interface{}{"command": "sh"},
+	})
+	require.NoError(err)
+	require.Error(restarted.Spool(ctx, "app", opts))
+}
+
+func TestBoxAppMetaStartFailureWithFakePorto(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	env := newFakeBoxEnv(t)
+	defer env.Close()
+	env.cfg["app_meta"] = map[string]interface{}{"enable": true}
+	box := env.newBox(t)
+	defer box.Close()
+	env.importApp(t, box, "app")
+
+	env.porto.FailStart("app/app_uuid1", fakeError(portorpc.EError_Unknown, "exec failed"))
+	_, err := box.Spawn(ctx, spawnConfig(t, "app", "uuid1"), ioutil.Discard)
+	require.Error(err)
+	require.Empty(box.trackedContainers())
+	require.Equal("", env.porto.State("app/app_uuid1"))
+	require.Equal("", env.porto.State("app"))
+
+	// the failed worker does not keep the meta container of the others
+	first, err := box.Spawn(ctx, spawnConfig(t, "app", "uuid2"), ioutil.Discard)
+	require.NoError(err)
+	env.porto.FailStart("app/app_uuid3", fakeError(portorpc.EError_Unknown, "exec failed"))
+	_, err = box.Spawn(ctx, spawnConfig(t, "app", "uuid3"), ioutil.Discard)
+	require.Error(err)
+	require.Equal("meta", env.porto.State("app"))
+
+	require.NoError(env.porto.Exit(first.(*container).containerID, 0, false))
+	require.True(eventually(func() bool { return len(box.trackedContainers()) == 0 }))
+	require.True(eventually(func() bool { return env.porto.State("app") == "" }))
+}
+
+func TestBoxStartFailureWithExhaustedPoolWithFakePorto(t *testing.T) {
+	require := require.New(t)
+
+	env := newFakeBoxEnv(t)
+	defer env.Close()
+	env.cfg["app_meta"] = map[string]interface{}{"enable": true}
+	env.cfg["failed_containers"] = map[string]interface{}{"enable": true, "max_per_app": 1}
+	box := env.newBox(t)
+	defer box.Close()
+	env.importApp(t, box, "app")
+
+	// only one connection is left for Spawn once the wait and output loops hold theirs
+	var held []porto.API
+	exhaust := func() bool {
+		for _, conn := range held {
+			conn.Close()
+		}
+		held = held[:0]
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			conn, err := box.conns.Get(ctx)
+			cancel()
+			if err != nil {
+				return len(held) == defaultPortoPoolSize-2
+			}
+			held = append(held, conn)
+		}
+	}
+	require.True(eventually(exhaust))
+	held[0].Close()
+	defer func() {
+		for _, conn := range held[1:] {
+			conn.Close()
+		}
+	}()
+
+	for _, uuid := range []string{"uuid1", "uuid2"} {
+		env.porto.FailStart("app/app_"+uuid, fakeError(portorpc.EError_Unknown, "exec failed"))
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		start := time.Now()
+		_, err := box.Spawn(ctx, spawnConfig(t, "app", uuid), ioutil.Discard)
+		cancel()
+		require.Error(err)
+		require.Contains(err.Error(), "exec failed")
+		require.True(time.Since(start) < time.Second)
+	}
+
+	// the first container is purged with the connection of Spawn to keep the limit
+	list := box.retained.list("app")
+	require.Len(list, 1)
+	require.Equal("uuid2", list[0].UUID)
+	require.Equal("", env.porto.State("app/app_uuid1"))
+	require.Equal("meta", env.porto.State("app"))
+}
+
+func TestBoxRetainsFailedContainersWithFakePorto(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	env := newFakeBoxEnv(t)
+	defer env.Close()
+	env.cfg["failed_containers"] = map[string]interface{}{"enable": true, "max_per_app": 1}
+	box := env.newBox(t)
+	env.importApp(t, box, "app")
+
+	spawn := func(uuid string) *container {
+		pr, err := box.Spawn(ctx, spawnConfig(t, "app", uuid), ioutil.Discard)
+		require.NoError(err)
+		return pr.(*container)
+	}
+
+	failed := spawn("uuid1")
+	require.NoError(env.porto.Write(failed.containerID, "stderr", "panic: boom"))
+	require.NoError(env.porto.Exit(failed.containerID, 256, false))
+	require.True(eventually(func() bool { return len(box.retained.list("app")) == 1 }))
+	require.Equal("dead", env.porto.State(failed.containerID))
+	stderr, err := ioutil.ReadFile(filepath.Join(failed.rootDir, retainedStderrFile))
+	require.NoError(err)
+	require.Equal("panic: boom", string(stderr))
+	_, err = os.Stat(filepath.Join(failed.rootDir, retainedPropertiesFile))
+	require.NoError(err)
+	retained := box.retained.list("")[0]
+	require.Equal("exited with code 1", retained.Reason)
+	require.Equal("uuid1", retained.UUID)
+
+	// successful containers are cleaned up as usual
+	succeeded := spawn("uuid2")
+	require.NoError(env.porto.Exit(succeeded.containerID, 0, false))
+	require.True(eventually(func() bool { return env.porto.State(succeeded.containerID) == "" }))
+	require.Len(box.retained.list(""), 1)
+
+	// the oldest container of the app is purged to keep the limit
+	oom := spawn("uuid3")
+	require.NoError(env.porto.Exit(oom.containerID, 9, true))
+	require.True(eventually(func() bool {
+		list := box.retained.list("app")
+		return len(list) == 1 && list[0].UUID == "uuid3"
+	}))
+	require.Equal("", env.porto.State(failed.containerID))
+	_, err = os.Stat(failed.rootDir)
+	require.True(os.IsNotExist(err))
+	require.True(box.retained.list("")[0].OOMKilled)
+
+	// retained containers survive restart of the daemon
+	require.NoError(box.dumpJournal(ctx))
+	box.Close()
+	restarted := env.newBox(t)
+	defer restarted.Close()
+	require.Len(restarted.retained.list("app"), 1)
+	require.Empty(restarted.trackedContainers())
+
+	handler := restarted.HTTPHandlers(ctx)["retained"]
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/retained/porto", nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.Contains(w.Body.String(), "killed by OOM")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("DELETE", "/retained/porto?app=app", nil))
+	require.Equal(http.StatusNoContent, w.Code)
+	require.Empty(restarted.retained.list(""))
+	require.Equal("", env.porto.State(oom.containerID))
+	_, err = os.Stat(oom.rootDir)
+	require.True(os.IsNotExist(err))
+}
+
+func TestBoxAutoSpoolWithFakePorto(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	env := newFakeBoxEnv(t)
+	defer env.Close()
+	// the helper puts the blob named by the torrent id into the layers directory
+	calls := filepath.Join(env.dir, "calls")
+	helper := filepath.Join(env.dir, "helper.sh")
+	require.NoError(ioutil.WriteFile(helper, []byte("#!/bin/sh\necho $6 >> "+calls+"\nsleep 0.2\nprintf layer > \"$3/$6\"\n"), 0755))
+	env.cfg["download_helper_cmd"] = helper
+	env.cfg["auto_spool"] = true
+	box := env.newBox(t)
+	defer box.Close()
+
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte("layer")))
+	layer := "sha256_" + digest
+	spawn := func(uuid string) (*container, error) {
+		config := spawnConfig(t, "app", uuid)
+		opts, err := isolate.NewRawProfile(map[string]interface{}{
+			"extended_info": map[string]interface{}{
+				"layers": []interface{}{
+					map[string]interface{}{"digest": digest, "digest_type": "sha256", "torrent_id": digest},
+				},
+			},
+		})
+		require.NoError(err)
+		config.Opts = opts
+		pr, err := box.Spawn(ctx, config, ioutil.Discard)
+		if err != nil {
+			return nil, err
+		}
+		return pr.(*container), nil
+	}
+	helperCalls := func() int {
+		body, err := ioutil.ReadFile(calls)
+		require.NoError(err)
+		return strings.Count(string(body), "\n")
+	}
+
+	// concurrent spawns of an app which has not been spooled share a spool
+	spawned := make(chan *container, 2)
+	for _, uuid := range []string{"uuid1", "uuid2"} {
+		go func(uuid string) {
+			cnt, err := spawn(uuid)
+			if err != nil {
+				t.Error(err)
+			}
+			spawned <- cnt
+		}(uuid)
+	}
+	for i := 0; i < 2; i++ {
+		cnt := <-spawned
+		require.NotNil(cnt)
+		require.NoError(cnt.Kill())
+	}
+	require.Equal(1, helperCalls())
+	require.Equal(layer, box.journal.GetManifestLayers("app"))
+
+	// a layer lost by Porto is imported again
+	portoConn, err := env.porto.Connect()
+	require.NoError(err)
+	require.NoError(portoConn.RemoveLayer(layer))
+	portoConn.Close()
+	_, err = spawn("uuid3")
+	require.NoError(err)
+	require.Equal(2, helperCalls())
+	missing, err := box.missingLayers(ctx, layer)
+	require.NoError(err)
+	require.Empty(missing)
+}
+
+func TestBoxExitsWithFakePorto(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	env := newFakeBoxEnv(t)
+	defer env.Close()
+	box := env.newBox(t)
+	defer box.Close()
+	env.importApp(t, box, "app")
+
+	oomKilled := containersOOMKilledCounter.Count()
+	signaled := containersSignaledCounter.Count()
+	appNonZero := metrics.GetOrRegisterCounter("app."+exitNonZero, appExitsRegistry)
+	nonZero := appNonZero.Count()
+	for uuid, status := range map[string]int{"oom": 9, "signal": 11, "exit": 2 << 8, "success": 0} {
+		pr, err := box.Spawn(ctx, spawnConfig(t, "app", uuid), ioutil.Discard)
+		require.NoError(err)
+		require.NoError(env.porto.Exit(pr.(*container).containerID, status, uuid == "oom"))
+	}
+	require.True(eventually(func() bool { return len(box.trackedContainers()) == 0 }))
+
+	for uuid, expected := range map[string]exitInfo{
+		"oom":     {Kind: exitOOMKilled, Status: 9, Code: -99, OOMKilled: true},
+		"signal":  {Kind: exitSignaled, Status: 11, Code: -11, Signal: 11},
+		"exit":    {Kind: exitNonZero, Status: 2 << 8, Code: 2},
+		"success": {Kind: exitSuccess},
+	} {
+		body, err := box.Inspect(ctx, uuid)
+		require.NoError(err)
+		var exit exitInfo
+		require.NoError(json.Unmarshal(body, &exit), uuid)
+		require.Equal("app", exit.App)
+		require.Equal(uuid, exit.UUID)
+		require.Equal(expected.Kind, exit.Kind, uuid)
+		require.Equal(expected.Status, exit.Status, uuid)
+		require.Equal(expected.Code, exit.Code, uuid)
+		require.Equal(expected.Signal, exit.Signal, uuid)
+		require.Equal(expected.OOMKilled, exit.OOMKilled, uuid)
+	}
+	exit, _ := box.exits.get("exit")
+	require.Equal("exited with code 2", exit.reason())
+
+	require.Equal(oomKilled+1, containersOOMKilledCounter.Count())
+	require.Equal(signaled+1, containersSignaledCounter.Count())
+	require.Equal(nonZero+1, appNonZero.Count())
+}
+
+func TestBoxSpoolRollbackWithFakePorto(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	env := newFakeBoxEnv(t)
+	defer env.Close()
+	// the helper copies blobs named by torrent ids from the source directory
+	// and hangs on the "slow" one
+	src := filepath.Join(env.dir, "src")
+	require.NoError(os.MkdirAll(src, 0755))
+	helper := filepath.Join(env.dir, "helper.sh")
+	require.NoError(ioutil.WriteFile(helper, []byte("#!/bin/sh\n[ \"$6\" = slow ] && exec sleep 10\nexec cp "+src+"/$6 \"$3/$6\"\n"), 0755))
+	env.cfg["download_helper_cmd"] = helper
+	box := env.newBox(t)
+	defer box.Close()
+
+	blob := func(content string) (string, string) {
+		digest := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+		require.NoError(ioutil.WriteFile(filepath.Join(src, digest), []byte(content), 0644))
+		return digest, "sha256_" + digest
+	}
+	shared, sharedLayer := blob("shared")
+	own, _ := blob("own")
+	// the layer of another app must survive the rollback
+	_, err := box.importLayer(ctx, sharedLayer, filepath.Join(src, shared))
+	require.NoError(err)
+	box.journal.InsertManifestLayers("other", sharedLayer)
+
+	spool := func(ctx context.Context, last string) error {
+		opts, err := isolate.NewRawProfile(map[string]interface{}{
+			"extended_info": map[string]interface{}{
+				"layers": []interface{}{
+					map[string]interface{}{"digest": shared, "digest_type": "sha256", "torrent_id": shared},
+					map[string]interface{}{"digest": own, "digest_type": "sha256", "torrent_id": own},
+					map[string]interface{}{"digest": last, "digest_type": "sha256", "torrent_id": last},
+				},
+			},
+		})
+		require.NoError(err)
+		return box.Spool(ctx, "app", opts)
+	}
+	layers := func() []string {
+		portoConn, err := env.porto.Connect()
+		require.NoError(err)
+		defer portoConn.Close()
+		layers, err := portoConn.ListLayers()
+		require.NoError(err)
+		return layers
+	}
+
+	rolledBack := layersRolledBackCounter.Count()
+	require.Error(spool(ctx, "missing"))
+	require.Equal([]string{sharedLayer}, layers())
+	require.Equal(rolledBack+1, layersRolledBackCounter.Count())
+
+	// cancellation reaches the helper
+	cctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	require.Equal(context.DeadlineExceeded, spool(cctx, "slow"))
+	require.True(time.Since(start) < 5*time.Second)
+	// the spool is rolled back after the last caller has gone
+	require.True(eventually(func() bool { return len(layers()) == 1 }))
+	require.Equal([]string{sharedLayer}, layers())
+	require.Empty(box.journal.GetManifestLayers("app"))
+	box.layerRefs.mu.Lock()
+	require.Empty(box.layerRefs.refs)
+	box.layerRefs.mu.Unlock()
+}
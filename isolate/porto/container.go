@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -21,21 +22,32 @@ type container struct {
 
 	State          isolate.GlobalState
 	uuid           string
+	appName        string
 	containerID    string
+	layers         string
 	mtnIp          string
 	rootDir        string
 	cleanupEnabled bool
 	SetImgURI      bool
+	// the meta container of the app if workers are placed into it
+	meta string
 
 	volume       Volume
 	extraVolumes []Volume
-	output       io.Writer
 	VolumeLabel  string
 
+	outputMu  sync.Mutex
+	output    io.Writer
+	streaming bool
+	stdout    outputStream
+	stderr    outputStream
+
 	mtn               bool
 	netId             string
 	mtnAllocationId   string
 	mtnAllocCleaned   bool
+
+	conns *connPool
 }
 
 // NOTE: is it better to have some kind of our own init inside Porto container to handle output?
@@ -63,7 +75,9 @@ func newContainer(ctx context.Context, portoConn porto.API, cfg containerConfig)
 		ctx:              ctx,
 		State:            cfg.State,
 		uuid:             cfg.args["--uuid"],
+		appName:          cfg.name,
 		containerID:      cfg.ID,
+		layers:           cfg.Layer,
 		rootDir:          cfg.Root,
 		cleanupEnabled:   cfg.CleanupEnabled,
 		SetImgURI:        cfg.SetImgURI,
@@ -71,6 +85,8 @@ func newContainer(ctx context.Context, portoConn porto.API, cfg containerConfig)
 		volume:           volume,
 		extraVolumes:     extravolumes,
 		output:           ioutil.Discard,
+		stdout:           outputStream{name: "stdout"},
+		stderr:           outputStream{name: "stderr"},
 		VolumeLabel:      cfg.VolumeLabel,
 
 		mtn:              cfg.Mtn,
@@ -78,6 +94,8 @@ func newContainer(ctx context.Context, portoConn porto.API, cfg containerConfig)
 		netId:            cfg.Network["netid"],
 		mtnAllocationId:  cfg.MtnAllocationId,
 		mtnIp:            cfg.MtnIp,
+
+		conns:            cfg.conns,
 	}
 	return cnt, nil
 }
@@ -91,30 +109,16 @@ func (c *container) start(portoConn porto.API, output io.Writer) (err error) {
 func (c *container) Kill() (err error) {
 	defer log.G(c.ctx).WithField("id", c.containerID).Trace("Kill container").Stop(&err)
 	containersKilledCounter.Inc(1)
-	portoConn, err := portoConnect()
+	// Kill must not depend on the context of the spawn request
+	portoConn, err := c.conns.Get(context.Background())
 	if err != nil {
 		return err
 	}
 	defer portoConn.Close()
 	defer c.Cleanup(portoConn)
 
-	// After Kill the container must be in `dead` state
-	// Wait seems redundant as we sent SIGKILL
-	value, err := portoConn.GetData(c.containerID, "stdout")
-	if err != nil {
-		log.G(c.ctx).WithField("id", c.containerID).WithError(err).Warn("unable to get stdout")
-	}
-	// TODO: add StringWriter interface to an output
-	c.output.Write([]byte(value))
-	log.G(c.ctx).WithField("id", c.containerID).Infof("%d bytes of stdout have been sent", len(value))
-
-	value, err = portoConn.GetData(c.containerID, "stderr")
-	if err != nil {
-		log.G(c.ctx).WithField("id", c.containerID).WithError(err).Warn("unable to get stderr")
-	}
-	c.output.Write([]byte(value))
-	log.G(c.ctx).WithField("id", c.containerID).Infof("%d bytes of stderr have been sent", len(value))
-	log.G(c.ctx).WithField("id", c.containerID).Debugf("Content of stderr that sented: %s", value)
+	// The rest of the output is sent after Kill
+	defer c.drainOutput(portoConn)
 
 	if err = portoConn.Kill(c.containerID, syscall.SIGKILL); err != nil {
 		if !isEqualPortoError(err, portorpc.EError_InvalidState) {
@@ -130,25 +134,32 @@ func (c *container) Kill() (err error) {
 	return nil
 }
 
-func (c *container) Cleanup(portoConn porto.API) {
+// release returns resources which may be used by other containers:
+// an MTN allocation and named volumes. The container itself is left as is.
+func (c *container) release() {
 	if c.mtn {
 		if !c.mtnAllocCleaned {
 			c.State.Mtn.UnuseAlloc(c.ctx, c.netId, c.mtnAllocationId, strings.Join([]string{c.mtnIp, c.containerID}, " "))
 			c.mtnAllocCleaned = true
 		}
 	}
+	for _, extraVolume := range c.extraVolumes {
+		if named, ok := extraVolume.(*namedVolume); ok {
+			named.release(c.ctx)
+		}
+	}
+}
+
+func (c *container) Cleanup(portoConn porto.API) {
+	c.release()
 	if !c.cleanupEnabled {
+		// volumes are left for debugging
 		return
 	}
 	logger := log.G(c.ctx).WithField("id", c.containerID)
 
 	var err error
-	if err = c.volume.Destroy(c.ctx, portoConn); err != nil {
-		logger.WithError(err).Warn("root volume has not been destroyed")
-	} else {
-		logger.Debug("root volume successfully destroyed")
-	}
-
+	// extra volumes are mounted inside the root one
 	for i, extraVolume := range c.extraVolumes {
 		if err = extraVolume.Destroy(c.ctx, portoConn); err != nil {
 			logger.WithError(err).Warnf("extra volume %d has not been destroyed", i)
@@ -156,6 +167,12 @@ func (c *container) Cleanup(portoConn porto.API) {
 			logger.Debugf("extra volume %d successfully destroyed", i)
 		}
 	}
+
+	if err = c.volume.Destroy(c.ctx, portoConn); err != nil {
+		logger.WithError(err).Warn("root volume has not been destroyed")
+	} else {
+		logger.Debug("root volume successfully destroyed")
+	}
 	if err = portoConn.Destroy(c.containerID); err != nil {
 		logger.WithError(err).Warn("Destroy error")
 	} else {
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/interiorem/stout/isolate"
@@ -43,6 +44,16 @@ func (v *portoVolume) Path() string {
 }
 
 func (v *portoVolume) Destroy(ctx context.Context, portoConn porto.API) error {
+	v.unlink(ctx, portoConn)
+	err := os.RemoveAll(v.path)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("container", v.cID).Error("remove root volume failed")
+	}
+	return err
+}
+
+// unlink detaches the volume from the container, the daemon and the root container
+func (v *portoVolume) unlink(ctx context.Context, portoConn porto.API) {
 	lg := log.G(ctx).WithField("container", v.cID)
 	var err error
 	if v.linked {
@@ -64,11 +75,6 @@ func (v *portoVolume) Destroy(ctx context.Context, portoConn porto.API) error {
 	} else {
 		lg.Debugf("volume %s successfully unlinked from '/'", v.path)
 	}
-
-	if err = os.RemoveAll(v.path); err != nil {
-		lg.WithError(err).WithField("container", v.cID).Error("remove root volume failed")
-	}
-	return err
 }
 
 type storageVolume struct {
@@ -110,6 +116,13 @@ type containerConfig struct {
 	MtnAllocationId string
 	MtnIp		string
 	VolumeLabel     string
+	// Host interface for macvlan and ipvlan networks
+	NetworkMaster   string
+	Properties      *containerPropertiesConfig
+	// nil if named volumes are disabled
+	NamedVolumes    *namedVolumes
+
+	conns *connPool
 }
 
 func (c *containerConfig) CreateRootVolume(ctx context.Context, portoConn porto.API) (Volume, error) {
@@ -186,10 +199,37 @@ func (c *containerConfig) CreateExtraVolumes(ctx context.Context, portoConn port
 			properties: volumeprofile.Properties,
 		}
 
-		// There are 2 types of volumes we care about.
-		// The first one requires storage directory for the data,
-		// the second one does not (like tmpfs)
-		if storage := volumeprofile.Properties["storage"]; storage != "" {
+		// There are 3 types of volumes we care about.
+		// A named one keeps its data in the storage of the app between containers,
+		// the second one requires storage directory for the data,
+		// the last one does not (like tmpfs)
+		if volumeprofile.Name != "" {
+			if c.NamedVolumes == nil {
+				cleanUpOnError()
+				return nil, fmt.Errorf("volume %s is named, but named volumes are disabled in the box", volumeprofile.Name)
+			}
+			storage, spaceLimit, err := c.NamedVolumes.Acquire(c.name, volumeprofile, c.ID)
+			if err != nil {
+				cleanUpOnError()
+				return nil, err
+			}
+			volumes = append(volumes, &namedVolume{
+				portoVolume: extraVolume,
+				volumes:     c.NamedVolumes,
+				app:         c.name,
+				name:        volumeprofile.Name,
+			})
+
+			properties := make(map[string]string, len(volumeprofile.Properties)+2)
+			for property, value := range volumeprofile.Properties {
+				properties[property] = value
+			}
+			properties["storage"] = storage
+			if spaceLimit != "" {
+				properties["space_limit"] = spaceLimit
+			}
+			volumeprofile.Properties = properties
+		} else if storage := volumeprofile.Properties["storage"]; storage != "" {
 			// In case of storage type we wrap basic volume here
 			storagevolume := storageVolume{
 				portoVolume: extraVolume,
@@ -239,21 +279,24 @@ func (c *containerConfig) CreateContainer(ctx context.Context, portoConn porto.A
 		c.execInfo.env["image_uri"] = c.Profile.Registry + "/" + c.name
 	}
 
-	// As User can define arbitrary properties in `container` section,
+	// As User can define properties in `container` section,
 	// some vital options like env, bind, command, root must be protected.
-	// Depends on the option there different policies: merge, ro, etc.
+	// The box defines which properties are allowed and how they are merged
+	// with its defaults: see containerPropertiesConfig.
 	var properties = make(map[string]string, 7) // at least it has values
 
 	// Unprotected values
-	if c.ulimits != "" {
-		properties["ulimit"] = c.ulimits
-	}
-
 	if c.Cwd != "" {
 		properties["cwd"] = c.Cwd
 	}
 
-	for property, value := range c.Profile.Container {
+	// defaultulimits is the default of `ulimit`: a profile replaces it or
+	// is appended to it according to the merge policy of the property
+	containerProperties := c.Properties
+	if c.ulimits != "" {
+		containerProperties = containerProperties.withDefault("ulimit", c.ulimits)
+	}
+	for property, value := range containerProperties.apply(c.Profile.Container) {
 		properties[property] = value
 	}
 
@@ -264,39 +307,50 @@ func (c *containerConfig) CreateContainer(ctx context.Context, portoConn porto.A
 		properties["env"] = formatEnv(c.env)
 	}
 
-	if binds, ok := properties["bind"]; ok {
-		properties["bind"] = binds + ";" + formatBinds(&c.execInfo)
+	binds, err := formatBinds(&c.execInfo)
+	if err != nil {
+		return err
+	}
+	if appBinds, ok := properties["bind"]; ok {
+		properties["bind"] = appBinds + ";" + binds
 	} else {
-		properties["bind"] = formatBinds(&c.execInfo)
+		properties["bind"] = binds
 	}
 
 	if c.resolv_conf != "" {
 		properties["resolv_conf"] = c.resolv_conf
 	}
 
-	// Protected options: command, root, enable_porto, net (for now)
+	// Protected options: command, root, enable_porto, net, ip, default_gw
 	properties["command"] = formatCommand(c.executable, c.args)
 	properties["root"] = root.Path()
 	properties["enable_porto"] = "false"
 
 	logger := log.G(ctx).WithField("container", c.ID)
 	c.Mtn = false
-	if !c.State.Mtn.Cfg.Enable {
-		properties["net"] = pickNetwork(c.NetworkMode)
+	if !c.State.Mtn.Cfg.Enable || c.Network["mtn"] != "enable" {
+		network, err := parseNetwork(c.NetworkMode, c.Network, c.NetworkMaster)
+		if err != nil {
+			return err
+		}
+		if warning := network.warning(); warning != "" {
+			logger.Warn(warning)
+		}
+		for property, value := range network.properties() {
+			properties[property] = value
+		}
 	} else {
-		if c.Network["mtn"] == "enable" {
-			alloc, err := c.State.Mtn.UseAlloc(ctx, string(c.Network["netid"]), c.BoxName, c.ID)
-			if err != nil {
-				logger.WithError(err).Errorf("get error from c.State.Mtn.UseAlloc, with netid: %s", c.Network["netid"])
-				return err
-			}
-			properties["net"] = alloc.Net
-			properties["hostname"] = alloc.Hostname
-			properties["ip"] = alloc.Ip
-			c.Mtn = true
-			c.MtnAllocationId = alloc.Id
-			c.MtnIp = alloc.Ip
+		alloc, err := c.State.Mtn.UseAlloc(ctx, string(c.Network["netid"]), c.BoxName, c.ID)
+		if err != nil {
+			logger.WithError(err).Errorf("get error from c.State.Mtn.UseAlloc, with netid: %s", c.Network["netid"])
+			return err
 		}
+		properties["net"] = alloc.Net
+		properties["hostname"] = alloc.Hostname
+		properties["ip"] = alloc.Ip
+		c.Mtn = true
+		c.MtnAllocationId = alloc.Id
+		c.MtnIp = alloc.Ip
 	}
 
 	//logger := log.G(ctx).WithField("container", c.ID)
@@ -323,20 +377,46 @@ func (c *containerConfig) CreateContainer(ctx context.Context, portoConn porto.A
 	return nil
 }
 
+// formatCommand builds the command property. Porto splits it into
+// arguments like a shell does, so every word is quoted if needed.
+// Arguments are sorted to make the command stable.
 func formatCommand(executable string, args map[string]string) string {
 	var buff = newBuff()
 	defer buffPool.Put(buff)
-	buff.WriteString(executable)
-	for k, v := range args {
+	buff.WriteString(shellQuote(executable))
+
+	keys := make([]string, 0, len(args))
+	for k := range args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
 		buff.WriteByte(' ')
-		buff.WriteString(k)
+		buff.WriteString(shellQuote(k))
 		buff.WriteByte(' ')
-		buff.WriteString(v)
+		buff.WriteString(shellQuote(args[k]))
 	}
 
 	return buff.String()
 }
 
+// shellQuote returns the word as is if it has no special characters,
+// otherwise it's enclosed in single quotes
+func shellQuote(word string) string {
+	if word != "" && strings.IndexFunc(word, needsQuoting) < 0 {
+		return word
+	}
+	return "'" + strings.Replace(word, "'", `'\''`, -1) + "'"
+}
+
+func needsQuoting(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return false
+	}
+	return !strings.ContainsRune("-_./:,=@%+", r)
+}
+
 func formatEnv(env map[string]string) string {
 	var buff = newBuff()
 	defer buffPool.Put(buff)
@@ -351,30 +431,24 @@ func formatEnv(env map[string]string) string {
 	return buff.String()
 }
 
-func pickNetwork(network string) string {
-	// TODO: this function is useless now
-	// but we have to add more mapping later
-	switch network {
-	case "inherited":
-		return network
-	default:
-		return "inherited"
-	}
-}
-
 // formatBinds prepares mount points for two cases:
 // - endpoint with a cocaine socket. It always presents in info.args["--endpoint"]
 // - optional mountpoints specified in the profile according to a Docker format
-func formatBinds(info *execInfo) string {
+func formatBinds(info *execInfo) (string, error) {
+	mounts, err := parseBinds(info.Profile.Binds)
+	if err != nil {
+		return "", err
+	}
+
 	var buff = newBuff()
 	defer buffPool.Put(buff)
-	buff.WriteString(info.args["--endpoint"])
+	buff.WriteString(escapePortoValue(info.args["--endpoint"]))
 	buff.WriteByte(' ')
 	buff.WriteString("/run/cocaine")
 	info.args["--endpoint"] = "/run/cocaine"
-	for _, dockerBind := range info.Profile.Binds {
+	for _, mount := range mounts {
 		buff.WriteByte(';')
-		buff.WriteString(strings.Replace(dockerBind, ":", " ", -2))
+		buff.WriteString(mount.String())
 	}
-	return buff.String()
+	return buff.String(), nil
 }
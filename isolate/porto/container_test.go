@@ -11,11 +11,14 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
+	"github.com/interiorem/stout/isolate"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	porto "github.com/yandex/porto/src/api/go"
 	portorpc "github.com/yandex/porto/src/api/go/rpc"
 	"golang.org/x/net/context"
 )
@@ -55,7 +58,9 @@ func TestExecInfoFormatters(t *testing.T) {
 		},
 	}
 
-	assert.Equal("/var/run/cocaine.sock /run/cocaine;/tmp /bind rw", formatBinds(&info))
+	binds, err := formatBinds(&info)
+	assert.NoError(err)
+	assert.Equal("/var/run/cocaine.sock /run/cocaine;/tmp /bind rw", binds)
 	env := strings.Split(formatEnv(info.env), ";")
 	sort.Strings(env)
 	assert.Equal([]string{"envA=A", "envB=B"}, env)
@@ -73,6 +78,102 @@ func TestExecInfoFormatters(t *testing.T) {
 	assert.True(found)
 }
 
+func TestFormatBinds(t *testing.T) {
+	for _, tc := range []struct {
+		binds    []string
+		expected string
+	}{
+		{
+			binds:    nil,
+			expected: "/var/run/cocaine.sock /run/cocaine",
+		},
+		{
+			binds:    []string{"/tmp:/bind"},
+			expected: "/var/run/cocaine.sock /run/cocaine;/tmp /bind rw",
+		},
+		{
+			binds:    []string{"/etc/hosts:/etc/hosts:ro", "/var/log/app/:/logs:rw"},
+			expected: "/var/run/cocaine.sock /run/cocaine;/etc/hosts /etc/hosts ro;/var/log/app /logs rw",
+		},
+		{
+			binds:    []string{"/data/my files:/data;x:ro"},
+			expected: `/var/run/cocaine.sock /run/cocaine;/data/my\ files /data\;x ro`,
+		},
+		{
+			binds:    []string{"/srv/../opt:/opt/./app"},
+			expected: "/var/run/cocaine.sock /run/cocaine;/opt /opt/app rw",
+		},
+	} {
+		info := execInfo{
+			args:    map[string]string{"--endpoint": "/var/run/cocaine.sock"},
+			Profile: &Profile{Binds: tc.binds},
+		}
+		binds, err := formatBinds(&info)
+		require.NoError(t, err, "%v", tc.binds)
+		assert.Equal(t, tc.expected, binds, "%v", tc.binds)
+		assert.Equal(t, "/run/cocaine", info.args["--endpoint"])
+	}
+}
+
+func TestParseBindErrors(t *testing.T) {
+	for _, bind := range []string{
+		"",
+		"/tmp",
+		"/a:/b:ro:rw",
+		"data:/data",
+		"/data:data",
+		"/data:/",
+		"/data:/data:z",
+		"/data:/data:ro,rw",
+		"/data:/data:",
+		"C:\\data:/data",
+	} {
+		_, err := parseBind(bind)
+		assert.Error(t, err, bind)
+	}
+
+	_, err := formatBinds(&execInfo{
+		args:    map[string]string{"--endpoint": "/var/run/cocaine.sock"},
+		Profile: &Profile{Binds: []string{"/tmp:/bind", "volume:/data"}},
+	})
+	assert.Error(t, err)
+}
+
+func TestFormatCommand(t *testing.T) {
+	for _, tc := range []struct {
+		executable string
+		args       map[string]string
+		expected   string
+	}{
+		{
+			executable: "/usr/bin/worker",
+			expected:   "/usr/bin/worker",
+		},
+		{
+			executable: "/usr/bin/worker",
+			args:       map[string]string{"--uuid": "bfe13176-7195", "--app": "app:v1", "protocol": "1"},
+			expected:   "/usr/bin/worker --app app:v1 --uuid bfe13176-7195 protocol 1",
+		},
+		{
+			executable: "/usr/bin/worker",
+			args:       map[string]string{"--locator": "[2a02:6b8::32]:10053,5.45.197.172:10053"},
+			expected:   "/usr/bin/worker --locator '[2a02:6b8::32]:10053,5.45.197.172:10053'",
+		},
+		{
+			executable: "/opt/my app/worker",
+			args:       map[string]string{"--name": "it's $HOME", "--empty": ""},
+			expected:   `'/opt/my app/worker' --empty '' --name 'it'\''s $HOME'`,
+		},
+		{
+			executable: "/usr/bin/worker",
+			args:       map[string]string{"--config": "a;b|c&d`e`\n"},
+			expected:   "/usr/bin/worker --config 'a;b|c&d`e`\n'",
+		},
+	} {
+		assert.Equal(t, tc.expected, formatCommand(tc.executable, tc.args))
+	}
+}
+
 func TestContainer(t *testing.T) {
 	if runtime.GOOS != "linux" {
 		t.Skipf("Skip under %s", runtime.GOOS)
@@ -131,7 +232,8 @@ func TestContainer(t *testing.T) {
 		io.Copy(ioutil.Discard, tarReader)
 	}
 
-	portoConn, err := portoConnect()
+	conns := newConnPool(porto.Connect, defaultPortoPoolSize, defaultPortoConnectTimeoutSec*time.Second)
+	portoConn, err := conns.Get(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -174,6 +276,7 @@ func TestContainer(t *testing.T) {
 		ID:       "IsolateLinuxApline",
 		Layer:    "testalpine",
 		execInfo: ei,
+		conns:    conns,
 	}
 
 	cnt, err := newContainer(ctx, portoConn, cfg)
@@ -224,3 +327,82 @@ func TestContainer(t *testing.T) {
 	require.NoError(err)
 	assert.Equal(t, ei.Profile.Cwd, cwd)
 }
+
+func TestContainerWithFakePorto(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	storage := filepath.Join(dir, "storage")
+
+	fake := newFakePorto()
+	conns := newConnPool(fake.Connect, defaultPortoPoolSize, time.Second)
+	portoConn, err := conns.Get(ctx)
+	require.NoError(err)
+	defer portoConn.Close()
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "layer.tar"), nil, 0644))
+	require.NoError(portoConn.ImportLayer("testalpine", filepath.Join(dir, "layer.tar"), false))
+
+	ei := execInfo{
+		Profile: &Profile{
+			Cwd: "/tmp",
+			ExtraVolumes: []VolumeProfile{
+				{
+					Target:     "/tmpfs",
+					Properties: map[string]string{"backend": "tmpfs"},
+				}, {
+					Target:     "/bind",
+					Properties: map[string]string{"backend": "bind", "storage": storage},
+				},
+			},
+		},
+		name:       "TestContainer",
+		executable: "echo",
+		args:       map[string]string{"--endpoint": "/var/run/cocaine.sock"},
+		env:        map[string]string{"A": "B"},
+	}
+
+	cfg := containerConfig{
+		BoxName:        "porto",
+		Root:           dir,
+		ID:             "IsolateFake",
+		State:          isolate.GlobalState{Mtn: new(isolate.MtnState)},
+		Layer:          "testalpine",
+		CleanupEnabled: true,
+		execInfo:       ei,
+		conns:          conns,
+	}
+
+	cnt, err := newContainer(ctx, portoConn, cfg)
+	require.NoError(err)
+	require.NoError(cnt.start(portoConn, ioutil.Discard))
+	require.Equal("running", fake.State(cnt.containerID))
+
+	properties := map[string]string{
+		"env":     "A=B",
+		"command": "echo --endpoint /run/cocaine",
+		"cwd":     "/tmp",
+		"bind":    "/var/run/cocaine.sock /run/cocaine",
+		"root":    filepath.Join(dir, "volume"),
+	}
+	for property, expected := range properties {
+		value, err := portoConn.GetProperty(cnt.containerID, property)
+		require.NoError(err)
+		require.Equal(expected, value, property)
+	}
+
+	volumes, err := portoConn.ListVolumes("", cnt.containerID)
+	require.NoError(err)
+	require.Len(volumes, 3)
+	require.Equal(filepath.Join(storage, cnt.containerID), volumes[1].Properties["storage"])
+
+	require.NoError(cnt.Kill())
+	require.Equal("", fake.State(cnt.containerID))
+	volumes, err = portoConn.ListVolumes("", "")
+	require.NoError(err)
+	require.Empty(volumes)
+	_, err = os.Stat(filepath.Join(storage, cnt.containerID))
+	require.True(os.IsNotExist(err))
+}
@@ -0,0 +1,157 @@
+package porto
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	apexlog "github.com/apex/log"
+	"github.com/rcrowley/go-metrics"
+	porto "github.com/yandex/porto/src/api/go"
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/pkg/log"
+)
+
+// Kinds of exits of containers
+const (
+	exitSuccess   = "success"
+	exitOOMKilled = "oom_killed"
+	exitSignaled  = "signaled"
+	exitNonZero   = "non_zero"
+
+	// how many exits of workers are kept for Inspect
+	maxRecordedExits = 1024
+)
+
+// exitInfo describes how a dead container has exited
+type exitInfo struct {
+	App  string `json:"app"`
+	UUID string `json:"uuid"`
+	Kind string `json:"kind"`
+	// raw wait status of the process
+	Status int `json:"exit_status"`
+	// exit code or negative number of the signal
+	Code      int  `json:"exit_code"`
+	Signal    int  `json:"signal,omitempty"`
+	OOMKilled bool `json:"oom_killed"`
+	// how long the container has been running in seconds
+	Time   uint64    `json:"time"`
+	Exited time.Time `json:"exited"`
+}
+
+// readExit reads the exit properties of a dead container
+func readExit(portoConn porto.API, containerID string) (exitInfo, error) {
+	exit := exitInfo{Exited: time.Now()}
+	status, err := portoConn.GetProperty(containerID, "exit_status")
+	if err != nil {
+		return exit, err
+	}
+	if exit.Status, err = strconv.Atoi(status); err != nil {
+		return exit, fmt.Errorf("invalid exit_status %q: %v", status, err)
+	}
+	if oom, err := portoConn.GetProperty(containerID, "oom_killed"); err == nil {
+		exit.OOMKilled = oom == "true"
+	}
+	if code, err := portoConn.GetProperty(containerID, "exit_code"); err == nil {
+		exit.Code, _ = strconv.Atoi(code)
+	}
+	if lifetime, err := portoConn.GetProperty(containerID, "time"); err == nil {
+		exit.Time, _ = strconv.ParseUint(lifetime, 10, 64)
+	}
+
+	ws := syscall.WaitStatus(exit.Status)
+	switch {
+	case exit.OOMKilled:
+		exit.Kind = exitOOMKilled
+	case ws.Signaled():
+		exit.Kind = exitSignaled
+		exit.Signal = int(ws.Signal())
+	case ws.ExitStatus() != 0:
+		exit.Kind = exitNonZero
+	default:
+		exit.Kind = exitSuccess
+	}
+	return exit, nil
+}
+
+// failed reports whether the container has exited abnormally
+func (e *exitInfo) failed() bool {
+	return e.Kind != exitSuccess
+}
+
+// reason returns a human readable description of the failure
+func (e *exitInfo) reason() string {
+	switch e.Kind {
+	case exitOOMKilled:
+		return "killed by OOM"
+	case exitSignaled:
+		return fmt.Sprintf("killed by signal %d", e.Signal)
+	case exitNonZero:
+		return fmt.Sprintf("exited with code %d", syscall.WaitStatus(e.Status).ExitStatus())
+	}
+	return ""
+}
+
+// exits keeps the last exits of workers and counts them per app
+type exits struct {
+	mu    sync.Mutex
+	byID  map[string]exitInfo
+	order []string
+}
+
+func newExits() *exits {
+	return &exits{byID: make(map[string]exitInfo)}
+}
+
+func (e *exits) record(exit exitInfo) {
+	switch exit.Kind {
+	case exitOOMKilled:
+		containersOOMKilledCounter.Inc(1)
+	case exitSignaled:
+		containersSignaledCounter.Inc(1)
+	case exitNonZero:
+		containersExitedNonZeroCounter.Inc(1)
+	}
+	metrics.GetOrRegisterCounter(exit.App+"."+exit.Kind, appExitsRegistry).Inc(1)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.byID[exit.UUID]; !ok {
+		e.order = append(e.order, exit.UUID)
+	}
+	e.byID[exit.UUID] = exit
+	for len(e.order) > maxRecordedExits {
+		delete(e.byID, e.order[0])
+		e.order = e.order[1:]
+	}
+}
+
+func (e *exits) get(uuid string) (exitInfo, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	exit, ok := e.byID[uuid]
+	return exit, ok
+}
+
+// handleExit reads, logs and records how the dead container has exited
+func (b *Box) handleExit(ctx context.Context, portoConn porto.API, c *container) (exitInfo, error) {
+	exit, err := readExit(portoConn, c.containerID)
+	if err != nil {
+		return exit, err
+	}
+	exit.App, exit.UUID = c.appName, c.uuid
+	b.exits.record(exit)
+
+	logger := log.G(ctx).WithFields(apexlog.Fields{
+		"id": c.containerID, "app": c.appName, "exit_status": exit.Status, "exit_code": exit.Code, "time": exit.Time,
+	})
+	if exit.failed() {
+		logger.WithField("reason", exit.reason()).Warn("container has exited abnormally")
+	} else {
+		logger.Info("container has exited")
+	}
+	return exit, nil
+}
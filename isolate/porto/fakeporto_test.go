@@ -0,0 +1,723 @@
+package porto
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	porto "github.com/yandex/porto/src/api/go"
+	portorpc "github.com/yandex/porto/src/api/go/rpc"
+)
+
+var errFakeConnClosed = errors.New("use of closed connection")
+
+// fakePorto is an in-memory Portod. Commands are not executed:
+// a started container is running until it's killed or Exit is called.
+type fakePorto struct {
+	mu         sync.Mutex
+	containers map[string]*fakeContainer
+	volumes    map[string]*fakeVolume
+	layers     map[string]bool
+	// closed on every change of a state of a container
+	changed chan struct{}
+	// number of open connections
+	conns int
+	// errors returned by Start of containers
+	startErrors map[string]error
+}
+
+type fakeContainer struct {
+	state      string
+	properties map[string]string
+	exitStatus int
+	oomKilled  bool
+	output     map[string]*fakeOutput
+}
+
+type fakeVolume struct {
+	properties map[string]string
+	containers []string
+}
+
+func newFakePorto() *fakePorto {
+	return &fakePorto{
+		containers:  make(map[string]*fakeContainer),
+		volumes:     make(map[string]*fakeVolume),
+		layers:      make(map[string]bool),
+		changed:     make(chan struct{}),
+		startErrors: make(map[string]error),
+	}
+}
+
+// Connect has the signature of porto.Connect
+func (f *fakePorto) Connect() (porto.API, error) {
+	f.mu.Lock()
+	f.conns++
+	f.mu.Unlock()
+	return &fakePortoConn{porto: f}, nil
+}
+
+// Exit finishes the process of a running container
+func (f *fakePorto) Exit(name string, status int, oomKilled bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.container(name)
+	if err != nil {
+		return err
+	}
+	if c.state != "running" {
+		return fakeError(portorpc.EError_InvalidState, "container %s is %s", name, c.state)
+	}
+	c.exitStatus = status
+	c.oomKilled = oomKilled
+	f.setState(c, "dead")
+	return nil
+}
+
+// Write appends to stdout or stderr of a container
+func (f *fakePorto) Write(name, stream, data string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.container(name)
+	if err != nil {
+		return err
+	}
+	c.output[stream].write(data, outputChunkSize)
+	return nil
+}
+
+// State returns the state of a container or an empty string if it does not exist
+func (f *fakePorto) State(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.containers[f.normalize(name)]; ok {
+		return c.state
+	}
+	return ""
+}
+
+// Property returns a property of a container
+func (f *fakePorto) Property(name, property string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.getProperty(name, property)
+}
+
+// Volume returns properties and links of a volume
+func (f *fakePorto) Volume(path string) (map[string]string, []string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.volumes[path]
+	if !ok {
+		return nil, nil, false
+	}
+	return v.properties, append([]string(nil), v.containers...), true
+}
+
+// FailStart makes Start of the container fail with the error
+func (f *fakePorto) FailStart(name string, err error) {
+	f.mu.Lock()
+	f.startErrors[f.normalize(name)] = err
+	f.mu.Unlock()
+}
+
+func (f *fakePorto) Conns() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.conns
+}
+
+func fakeError(errno portorpc.EError, format string, args ...interface{}) error {
+	return &porto.Error{Errno: errno, ErrName: errno.String(), Message: fmt.Sprintf(format, args...)}
+}
+
+// normalize converts absolute names and "self" to names relative to the host
+func (f *fakePorto) normalize(name string) string {
+	switch {
+	case name == "self" || name == "/":
+		return "/"
+	case strings.HasPrefix(name, "/porto/"):
+		return strings.TrimPrefix(name, "/porto/")
+	default:
+		return name
+	}
+}
+
+func (f *fakePorto) container(name string) (*fakeContainer, error) {
+	c, ok := f.containers[f.normalize(name)]
+	if !ok {
+		return nil, fakeError(portorpc.EError_ContainerDoesNotExist, "container %s does not exist", name)
+	}
+	return c, nil
+}
+
+func (f *fakePorto) setState(c *fakeContainer, state string) {
+	c.state = state
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakePorto) create(name string) error {
+	name = f.normalize(name)
+	if name == "/" || name == "" {
+		return fakeError(portorpc.EError_InvalidValue, "invalid name %q", name)
+	}
+	if _, ok := f.containers[name]; ok {
+		return fakeError(portorpc.EError_ContainerAlreadyExists, "container %s already exists", name)
+	}
+	if parent := filepath.Dir(name); parent != "." {
+		if _, ok := f.containers[parent]; !ok {
+			return fakeError(portorpc.EError_ContainerDoesNotExist, "parent %s does not exist", parent)
+		}
+	}
+	f.containers[name] = &fakeContainer{
+		state:      "stopped",
+		properties: make(map[string]string),
+		output: map[string]*fakeOutput{
+			"stdout": new(fakeOutput),
+			"stderr": new(fakeOutput),
+		},
+	}
+	return nil
+}
+
+func (f *fakePorto) destroy(name string) error {
+	name = f.normalize(name)
+	if _, err := f.container(name); err != nil {
+		return err
+	}
+	for child := range f.containers {
+		if child == name || strings.HasPrefix(child, name+"/") {
+			delete(f.containers, child)
+			f.unlinkAll(child)
+		}
+	}
+	close(f.changed)
+	f.changed = make(chan struct{})
+	return nil
+}
+
+// unlinkAll unlinks volumes from the container. Unlinked volumes are destroyed.
+func (f *fakePorto) unlinkAll(name string) {
+	for path, v := range f.volumes {
+		for i, linked := range v.containers {
+			if linked == name {
+				v.containers = append(v.containers[:i], v.containers[i+1:]...)
+				break
+			}
+		}
+		if len(v.containers) == 0 {
+			delete(f.volumes, path)
+		}
+	}
+}
+
+func (f *fakePorto) start(name string) error {
+	c, err := f.container(name)
+	if err != nil {
+		return err
+	}
+	if c.state != "stopped" {
+		return fakeError(portorpc.EError_InvalidState, "container %s is %s", name, c.state)
+	}
+	if err = f.startErrors[f.normalize(name)]; err != nil {
+		return err
+	}
+	if c.properties["command"] == "" {
+		f.setState(c, "meta")
+	} else {
+		f.setState(c, "running")
+	}
+	return nil
+}
+
+func (f *fakePorto) kill(name string, sig syscall.Signal) error {
+	c, err := f.container(name)
+	if err != nil {
+		return err
+	}
+	if c.state != "running" {
+		return fakeError(portorpc.EError_InvalidState, "container %s is %s", name, c.state)
+	}
+	c.exitStatus = int(sig)
+	f.setState(c, "dead")
+	return nil
+}
+
+func (f *fakePorto) getProperty(name, property string) (string, error) {
+	if f.normalize(name) == "/" {
+		if property == "absolute_name" {
+			return "/", nil
+		}
+		return "", fakeError(portorpc.EError_InvalidProperty, "property %s of / is not supported", property)
+	}
+
+	c, err := f.container(name)
+	if err != nil {
+		return "", err
+	}
+
+	switch property {
+	case "state":
+		return c.state, nil
+	case "absolute_name":
+		return "/porto/" + f.normalize(name), nil
+	case "exit_status", "exit_code", "oom_killed":
+		if c.state != "dead" {
+			return "", fakeError(portorpc.EError_InvalidState, "container %s is %s", name, c.state)
+		}
+		switch ws := syscall.WaitStatus(c.exitStatus); {
+		case property == "oom_killed":
+			return strconv.FormatBool(c.oomKilled), nil
+		case property == "exit_status":
+			return strconv.Itoa(c.exitStatus), nil
+		case c.oomKilled:
+			return "-99", nil
+		case ws.Signaled():
+			return strconv.Itoa(-int(ws.Signal())), nil
+		default:
+			return strconv.Itoa(ws.ExitStatus()), nil
+		}
+	case "stdout_offset", "stderr_offset":
+		return strconv.FormatUint(c.output[strings.TrimSuffix(property, "_offset")].start, 10), nil
+	case "stdout", "stderr":
+		return c.output[property].data, nil
+	}
+
+	var stream string
+	var offset, length uint64
+	if n, _ := fmt.Sscanf(property, "stdout[%d:%d]", &offset, &length); n == 2 {
+		stream = "stdout"
+	} else if n, _ := fmt.Sscanf(property, "stderr[%d:%d]", &offset, &length); n == 2 {
+		stream = "stderr"
+	}
+	if stream != "" {
+		return c.output[stream].GetData(name, fmt.Sprintf("stdout[%d:%d]", offset, length))
+	}
+
+	return c.properties[property], nil
+}
+
+func (f *fakePorto) setProperty(name, property, value string) error {
+	c, err := f.container(name)
+	if err != nil {
+		return err
+	}
+	switch property {
+	case "state", "absolute_name", "exit_status", "oom_killed", "stdout", "stderr":
+		return fakeError(portorpc.EError_InvalidValue, "property %s is read-only", property)
+	}
+	if c.state != "stopped" && property == "command" {
+		return fakeError(portorpc.EError_InvalidState, "container %s is %s", name, c.state)
+	}
+	c.properties[property] = value
+	return nil
+}
+
+func (f *fakePorto) linkVolume(path, name string) error {
+	v, ok := f.volumes[path]
+	if !ok {
+		return fakeError(portorpc.EError_VolumeNotFound, "volume %s not found", path)
+	}
+	name = f.normalize(name)
+	if name != "/" {
+		if _, err := f.container(name); err != nil {
+			return err
+		}
+	}
+	for _, linked := range v.containers {
+		if linked == name {
+			return fakeError(portorpc.EError_VolumeAlreadyLinked, "volume %s is already linked to %s", path, name)
+		}
+	}
+	v.containers = append(v.containers, name)
+	return nil
+}
+
+func (f *fakePorto) unlinkVolume(path, name string) error {
+	v, ok := f.volumes[path]
+	if !ok {
+		return fakeError(portorpc.EError_VolumeNotFound, "volume %s not found", path)
+	}
+	if name == "***" {
+		v.containers = nil
+	} else {
+		name = f.normalize(name)
+		found := false
+		for i, linked := range v.containers {
+			if linked == name {
+				v.containers = append(v.containers[:i], v.containers[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fakeError(portorpc.EError_VolumeNotLinked, "volume %s is not linked to %s", path, name)
+		}
+	}
+	if len(v.containers) == 0 {
+		delete(f.volumes, path)
+	}
+	return nil
+}
+
+func (f *fakePorto) createVolume(path string, config map[string]string) (porto.TVolumeDescription, error) {
+	if path == "" {
+		return porto.TVolumeDescription{}, fakeError(portorpc.EError_InvalidValue, "volumes without a path are not supported")
+	}
+	if _, ok := f.volumes[path]; ok {
+		return porto.TVolumeDescription{}, fakeError(portorpc.EError_VolumeAlreadyExists, "volume %s already exists", path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return porto.TVolumeDescription{}, fakeError(portorpc.EError_InvalidValue, "%v", err)
+	}
+	if layers := config["layers"]; layers != "" {
+		for _, layer := range strings.Split(layers, ";") {
+			if !f.layers[layer] {
+				return porto.TVolumeDescription{}, fakeError(portorpc.EError_LayerNotFound, "layer %s not found", layer)
+			}
+		}
+	}
+
+	properties := make(map[string]string, len(config))
+	for k, v := range config {
+		properties[k] = v
+	}
+	f.volumes[path] = &fakeVolume{properties: properties, containers: []string{"/"}}
+	return porto.TVolumeDescription{Path: path, Properties: properties, Containers: []string{"/"}}, nil
+}
+
+func (f *fakePorto) removeLayer(layer string) error {
+	if !f.layers[layer] {
+		return fakeError(portorpc.EError_LayerNotFound, "layer %s not found", layer)
+	}
+	for _, v := range f.volumes {
+		for _, used := range strings.Split(v.properties["layers"], ";") {
+			if used == layer {
+				return fakeError(portorpc.EError_Busy, "layer %s is in use", layer)
+			}
+		}
+	}
+	delete(f.layers, layer)
+	return nil
+}
+
+// fakePortoConn is a connection to fakePorto
+type fakePortoConn struct {
+	porto  *fakePorto
+	closed bool
+	err    portorpc.EError
+	msg    string
+}
+
+var _ porto.API = &fakePortoConn{}
+
+// call runs fn with the state locked and remembers the error as Portod connection does
+func (c *fakePortoConn) call(fn func() error) error {
+	if c.closed {
+		return errFakeConnClosed
+	}
+	c.porto.mu.Lock()
+	err := fn()
+	c.porto.mu.Unlock()
+
+	c.err, c.msg = portorpc.EError_Success, ""
+	if perr, ok := err.(*porto.Error); ok {
+		c.err, c.msg = perr.Errno, perr.Message
+	}
+	return err
+}
+
+func (c *fakePortoConn) GetVersion() (tag string, revision string, err error) {
+	err = c.call(func() error {
+		tag, revision = "fake", "0"
+		return nil
+	})
+	return tag, revision, err
+}
+
+func (c *fakePortoConn) GetLastError() portorpc.EError { return c.err }
+func (c *fakePortoConn) GetLastErrorMessage() string   { return c.msg }
+
+func (c *fakePortoConn) Create(name string) error {
+	return c.call(func() error { return c.porto.create(name) })
+}
+
+func (c *fakePortoConn) CreateWeak(name string) error {
+	return c.Create(name)
+}
+
+func (c *fakePortoConn) Destroy(name string) error {
+	return c.call(func() error { return c.porto.destroy(name) })
+}
+
+func (c *fakePortoConn) Start(name string) error {
+	return c.call(func() error { return c.porto.start(name) })
+}
+
+func (c *fakePortoConn) Stop(name string) error {
+	return c.call(func() error {
+		fc, err := c.porto.container(name)
+		if err != nil {
+			return err
+		}
+		if fc.state == "stopped" {
+			return fakeError(portorpc.EError_InvalidState, "container %s is stopped", name)
+		}
+		c.porto.setState(fc, "stopped")
+		return nil
+	})
+}
+
+func (c *fakePortoConn) Kill(name string, sig syscall.Signal) error {
+	return c.call(func() error { return c.porto.kill(name, sig) })
+}
+
+func (c *fakePortoConn) Pause(name string) error {
+	return c.call(func() error {
+		fc, err := c.porto.container(name)
+		if err != nil {
+			return err
+		}
+		if fc.state != "running" {
+			return fakeError(portorpc.EError_InvalidState, "container %s is %s", name, fc.state)
+		}
+		c.porto.setState(fc, "paused")
+		return nil
+	})
+}
+
+func (c *fakePortoConn) Resume(name string) error {
+	return c.call(func() error {
+		fc, err := c.porto.container(name)
+		if err != nil {
+			return err
+		}
+		if fc.state != "paused" {
+			return fakeError(portorpc.EError_InvalidState, "container %s is %s", name, fc.state)
+		}
+		c.porto.setState(fc, "running")
+		return nil
+	})
+}
+
+// Wait returns the name of the first dead container or an empty string on timeout
+func (c *fakePortoConn) Wait(containers []string, timeout time.Duration) (string, error) {
+	deadline := time.After(timeout)
+	for {
+		var (
+			dead    string
+			changed chan struct{}
+		)
+		err := c.call(func() error {
+			for _, name := range containers {
+				fc, err := c.porto.container(name)
+				if err != nil {
+					return err
+				}
+				if fc.state == "dead" {
+					dead = name
+					return nil
+				}
+			}
+			changed = c.porto.changed
+			return nil
+		})
+		if err != nil || dead != "" {
+			return dead, err
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return "", nil
+		}
+	}
+}
+
+func (c *fakePortoConn) List() (names []string, err error) {
+	err = c.call(func() error {
+		for name := range c.porto.containers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil
+	})
+	return names, err
+}
+
+func (c *fakePortoConn) Plist() ([]porto.TProperty, error) {
+	var list []porto.TProperty
+	for _, name := range []string{"command", "cwd", "env", "bind", "root", "net", "ip", "hostname", "ulimit", "state", "exit_status", "oom_killed"} {
+		list = append(list, porto.TProperty{Name: name})
+	}
+	return list, c.call(func() error { return nil })
+}
+
+func (c *fakePortoConn) Dlist() ([]porto.TData, error) {
+	var list []porto.TData
+	for _, name := range []string{"stdout", "stderr", "stdout_offset", "stderr_offset"} {
+		list = append(list, porto.TData{Name: name})
+	}
+	return list, c.call(func() error { return nil })
+}
+
+func (c *fakePortoConn) Get(containers []string, variables []string) (map[string]map[string]porto.TPortoGetResponse, error) {
+	result := make(map[string]map[string]porto.TPortoGetResponse, len(containers))
+	err := c.call(func() error {
+		for _, name := range containers {
+			values := make(map[string]porto.TPortoGetResponse, len(variables))
+			for _, variable := range variables {
+				value, err := c.porto.getProperty(name, variable)
+				response := porto.TPortoGetResponse{Value: value}
+				if perr, ok := err.(*porto.Error); ok {
+					response.Error, response.ErrorMsg = int(perr.Errno), perr.Message
+				}
+				values[variable] = response
+			}
+			result[name] = values
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (c *fakePortoConn) GetProperty(name string, property string) (value string, err error) {
+	err = c.call(func() error {
+		value, err = c.porto.getProperty(name, property)
+		return err
+	})
+	return value, err
+}
+
+func (c *fakePortoConn) SetProperty(name string, property string, value string) error {
+	return c.call(func() error { return c.porto.setProperty(name, property, value) })
+}
+
+func (c *fakePortoConn) GetData(name string, data string) (string, error) {
+	return c.GetProperty(name, data)
+}
+
+func (c *fakePortoConn) ListVolumeProperties() ([]porto.TProperty, error) {
+	var list []porto.TProperty
+	for _, name := range []string{"backend", "layers", "private", "storage", "space_limit"} {
+		list = append(list, porto.TProperty{Name: name})
+	}
+	return list, c.call(func() error { return nil })
+}
+
+func (c *fakePortoConn) CreateVolume(path string, config map[string]string) (description porto.TVolumeDescription, err error) {
+	err = c.call(func() error {
+		description, err = c.porto.createVolume(path, config)
+		return err
+	})
+	return description, err
+}
+
+func (c *fakePortoConn) TuneVolume(path string, config map[string]string) error {
+	return c.call(func() error {
+		v, ok := c.porto.volumes[path]
+		if !ok {
+			return fakeError(portorpc.EError_VolumeNotFound, "volume %s not found", path)
+		}
+		for k, value := range config {
+			v.properties[k] = value
+		}
+		return nil
+	})
+}
+
+func (c *fakePortoConn) LinkVolume(path string, container string) error {
+	return c.call(func() error { return c.porto.linkVolume(path, container) })
+}
+
+func (c *fakePortoConn) UnlinkVolume(path string, container string) error {
+	return c.call(func() error { return c.porto.unlinkVolume(path, container) })
+}
+
+func (c *fakePortoConn) ListVolumes(path string, container string) (volumes []porto.TVolumeDescription, err error) {
+	err = c.call(func() error {
+		name := c.porto.normalize(container)
+		for volumePath, v := range c.porto.volumes {
+			if path != "" && path != volumePath {
+				continue
+			}
+			linked := container == ""
+			for _, linkedTo := range v.containers {
+				linked = linked || linkedTo == name
+			}
+			if linked {
+				volumes = append(volumes, porto.TVolumeDescription{
+					Path:       volumePath,
+					Properties: v.properties,
+					Containers: append([]string(nil), v.containers...),
+				})
+			}
+		}
+		sort.Sort(volumesByPath(volumes))
+		return nil
+	})
+	return volumes, err
+}
+
+type volumesByPath []porto.TVolumeDescription
+
+func (v volumesByPath) Len() int           { return len(v) }
+func (v volumesByPath) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v volumesByPath) Less(i, j int) bool { return v[i].Path < v[j].Path }
+
+func (c *fakePortoConn) ImportLayer(layer string, tarball string, merge bool) error {
+	return c.call(func() error {
+		if c.porto.layers[layer] && !merge {
+			return fakeError(portorpc.EError_LayerAlreadyExists, "layer %s already exists", layer)
+		}
+		if _, err := os.Stat(tarball); err != nil {
+			return fakeError(portorpc.EError_InvalidValue, "%v", err)
+		}
+		c.porto.layers[layer] = true
+		return nil
+	})
+}
+
+func (c *fakePortoConn) ExportLayer(volume string, tarball string) error {
+	return c.call(func() error {
+		return fakeError(portorpc.EError_NotSupported, "export is not supported")
+	})
+}
+
+func (c *fakePortoConn) RemoveLayer(layer string) error {
+	return c.call(func() error { return c.porto.removeLayer(layer) })
+}
+
+func (c *fakePortoConn) ListLayers() (layers []string, err error) {
+	err = c.call(func() error {
+		for layer := range c.porto.layers {
+			layers = append(layers, layer)
+		}
+		sort.Strings(layers)
+		return nil
+	})
+	return layers, err
+}
+
+func (c *fakePortoConn) ConvertPath(path string, src string, dest string) (string, error) {
+	return path, c.call(func() error { return nil })
+}
+
+func (c *fakePortoConn) Close() error {
+	if c.closed {
+		return errFakeConnClosed
+	}
+	c.closed = true
+	c.porto.mu.Lock()
+	c.porto.conns--
+	c.porto.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,225 @@
+package porto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	apexlog "github.com/apex/log"
+	"github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/pkg/fetcher"
+	"github.com/interiorem/stout/pkg/log"
+	"github.com/interiorem/stout/pkg/semaphore"
+)
+
+const (
+	defaultFetcherTimeoutSec      = 300
+	defaultFetcherTimeoutSecPerGB = 600
+	defaultFetcherConcurrency     = 2
+
+	// how much of stderr of a failed fetcher is reported
+	maxFetcherStderr = 4 << 10
+)
+
+// fetcherConfig describes an external program fetching layers,
+// the protocol is described in pkg/fetcher
+type fetcherConfig struct {
+	Name string   `json:"name"`
+	Cmd  string   `json:"cmd"`
+	Args []string `json:"args"`
+	// The fetcher is killed after timeout_sec plus timeout_sec_per_gb for every GB of the layer
+	TimeoutSec      uint `json:"timeout_sec"`
+	TimeoutSecPerGB uint `json:"timeout_sec_per_gb"`
+	// How many layers the fetcher fetches simultaneously
+	Concurrency uint `json:"concurrency"`
+}
+
+type layerFetcher struct {
+	fetcherConfig
+	sm semaphore.Semaphore
+
+	succeeded metrics.Counter
+	failed    metrics.Counter
+	timer     metrics.Timer
+}
+
+func newLayerFetcher(config fetcherConfig) (*layerFetcher, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("name of the fetcher must be set")
+	}
+	if config.Cmd == "" {
+		return nil, fmt.Errorf("cmd of the fetcher %s must be set", config.Name)
+	}
+	if config.TimeoutSec == 0 {
+		config.TimeoutSec = defaultFetcherTimeoutSec
+	}
+	if config.TimeoutSecPerGB == 0 {
+		config.TimeoutSecPerGB = defaultFetcherTimeoutSecPerGB
+	}
+	if config.Concurrency == 0 {
+		config.Concurrency = defaultFetcherConcurrency
+	}
+	return &layerFetcher{
+		fetcherConfig: config,
+		sm:            semaphore.New(config.Concurrency),
+		succeeded:     metrics.GetOrRegisterCounter(config.Name+".succeeded", fetchersRegistry),
+		failed:        metrics.GetOrRegisterCounter(config.Name+".failed", fetchersRegistry),
+		timer:         metrics.GetOrRegisterTimer(config.Name+".timer", fetchersRegistry),
+	}, nil
+}
+
+func (f *layerFetcher) timeout(size uint64) time.Duration {
+	return time.Duration(f.TimeoutSec)*time.Second + time.Duration(size*uint64(f.TimeoutSecPerGB)>>30)*time.Second
+}
+
+// Fetch runs the fetcher and waits for it to report the result
+func (f *layerFetcher) Fetch(ctx context.Context, req fetcher.Request) (err error) {
+	if err = f.sm.Acquire(ctx); err != nil {
+		return err
+	}
+	defer f.sm.Release()
+
+	start := time.Now()
+	defer func() {
+		if err != nil {
+			f.failed.Inc(1)
+			return
+		}
+		f.succeeded.Inc(1)
+		f.timer.UpdateSince(start)
+	}()
+
+	timeout := f.timeout(req.Size)
+	req.TimeoutSec = uint(timeout / time.Second)
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	fctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(fctx, f.Cmd, f.Args...)
+	cmd.Stdin = bytes.NewReader(body)
+	var stderr limitedBuffer
+	stderr.limit = maxFetcherStderr
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	logger := log.G(ctx).WithFields(apexlog.Fields{"fetcher": f.Name, "digest": req.Digest})
+	var result *fetcher.Event
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		var event fetcher.Event
+		if err = json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			logger.WithError(err).Warnf("invalid event from the fetcher: %q", scanner.Text())
+			continue
+		}
+		switch event.Type {
+		case fetcher.EventProgress:
+			logger.Debugf("fetched %d of %d bytes", event.Bytes, event.Total)
+		case fetcher.EventDone, fetcher.EventError:
+			result = &event
+		}
+	}
+	// the fetcher may be blocked on writing the rest of the output, e.g. after a too long line
+	scanErr := scanner.Err()
+	if scanErr != nil {
+		logger.WithError(scanErr).Warn("unable to read events of the fetcher, kill it")
+		cmd.Process.Kill()
+	}
+	err = cmd.Wait()
+
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case fctx.Err() != nil:
+		return fmt.Errorf("fetcher %s has not fetched %s within %v", f.Name, req.Digest, timeout)
+	case scanErr != nil:
+		return fmt.Errorf("fetcher %s has failed to fetch %s: unable to read events: %v", f.Name, req.Digest, scanErr)
+	case result != nil && result.Type == fetcher.EventError:
+		return fmt.Errorf("fetcher %s has failed to fetch %s: %s", f.Name, req.Digest, result.Message)
+	case err != nil:
+		return fmt.Errorf("fetcher %s has failed to fetch %s: %v %s", f.Name, req.Digest, err, strings.TrimSpace(stderr.String()))
+	case result == nil:
+		return fmt.Errorf("fetcher %s has exited without the result", f.Name)
+	}
+	logger.Info("the layer has been fetched")
+	return nil
+}
+
+// limitedBuffer keeps the beginning of the output
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if rest := b.limit - b.Len(); rest > 0 {
+		if len(p) > rest {
+			b.Buffer.Write(p[:rest])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// layerFetchers selects fetchers of layers by their names
+type layerFetchers struct {
+	byName   map[string]*layerFetcher
+	fallback string
+}
+
+func newLayerFetchers(configs []fetcherConfig, defaultFetcher string) (*layerFetchers, error) {
+	fetchers := &layerFetchers{byName: make(map[string]*layerFetcher), fallback: defaultFetcher}
+	for _, config := range configs {
+		f, err := newLayerFetcher(config)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := fetchers.byName[f.Name]; ok {
+			return nil, fmt.Errorf("fetcher %s is configured twice", f.Name)
+		}
+		fetchers.byName[f.Name] = f
+	}
+	if defaultFetcher == "" && len(configs) == 1 {
+		fetchers.fallback = configs[0].Name
+	}
+	if _, ok := fetchers.byName[fetchers.fallback]; fetchers.fallback != "" && !ok {
+		return nil, fmt.Errorf("default fetcher %s is not configured", defaultFetcher)
+	}
+	return fetchers, nil
+}
+
+func (f *layerFetchers) enabled() bool {
+	return len(f.byName) > 0
+}
+
+// pick returns the fetcher of the layer. Nil is returned for layers
+// without a fetcher if there is no default one.
+func (f *layerFetchers) pick(layer Layer) (*layerFetcher, error) {
+	name := layer.Fetcher
+	if name == "" {
+		name = f.fallback
+	}
+	if name == "" {
+		return nil, nil
+	}
+	lf, ok := f.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("fetcher %s of layer %s is not configured", name, layer.Digest)
+	}
+	return lf, nil
+}
@@ -0,0 +1,160 @@
+package porto
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/isolate"
+	"github.com/interiorem/stout/pkg/fetcher"
+)
+
+// TestFetcherHelperProcess is not a test: it's a fetcher run by tests
+// with arguments `-- fetcher <mode> <dir>`
+func TestFetcherHelperProcess(t *testing.T) {
+	args := flag.Args()
+	if len(args) != 3 || args[0] != "fetcher" {
+		return
+	}
+	switch args[1] {
+	case "local":
+		local := fetcher.Local{Dir: args[2]}
+		if err := local.Serve(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "hang":
+		time.Sleep(time.Minute)
+	case "flood":
+		// a line longer than the scanner accepts, the fetcher is blocked on writing it
+		fmt.Printf(`{"type": "progress", "message": "%s"}`+"\n", strings.Repeat("x", 1<<20))
+		fmt.Println(`{"type": "done"}`)
+	case "silent":
+	}
+	os.Exit(0)
+}
+
+func helperFetcher(name, mode, dir string) fetcherConfig {
+	return fetcherConfig{
+		Name: name,
+		Cmd:  os.Args[0],
+		Args: []string{"-test.run=TestFetcherHelperProcess", "--", "fetcher", mode, dir},
+	}
+}
+
+func TestLayerFetcher(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "fetchers")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "layer"), []byte("layer"), 0644))
+
+	local, err := newLayerFetcher(helperFetcher("test-local", "local", dir))
+	require.NoError(err)
+	succeeded, failed := local.succeeded.Count(), local.failed.Count()
+
+	destination := filepath.Join(dir, "fetched")
+	require.NoError(local.Fetch(ctx, fetcher.Request{Digest: "layer", Destination: destination}))
+	data, err := ioutil.ReadFile(destination)
+	require.NoError(err)
+	require.Equal("layer", string(data))
+
+	err = local.Fetch(ctx, fetcher.Request{Digest: "absent", Destination: destination})
+	require.Error(err)
+	require.Contains(err.Error(), "fetcher test-local has failed to fetch absent")
+	require.Equal(succeeded+1, local.succeeded.Count())
+	require.Equal(failed+1, local.failed.Count())
+
+	silent, err := newLayerFetcher(helperFetcher("test-silent", "silent", dir))
+	require.NoError(err)
+	require.EqualError(silent.Fetch(ctx, fetcher.Request{Digest: "layer"}), "fetcher test-silent has exited without the result")
+
+	flood, err := newLayerFetcher(helperFetcher("test-flood", "flood", dir))
+	require.NoError(err)
+	start := time.Now()
+	err = flood.Fetch(ctx, fetcher.Request{Digest: "layer"})
+	require.Error(err)
+	require.Contains(err.Error(), "fetcher test-flood has failed to fetch layer: unable to read events")
+	require.True(time.Since(start) < 10*time.Second)
+
+	config := helperFetcher("test-hang", "hang", dir)
+	config.TimeoutSec = 1
+	hang, err := newLayerFetcher(config)
+	require.NoError(err)
+	require.Equal(1201*time.Second, hang.timeout(2<<30))
+	err = hang.Fetch(ctx, fetcher.Request{Digest: "layer"})
+	require.EqualError(err, "fetcher test-hang has not fetched layer within 1s")
+
+	cctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	hang.TimeoutSec = 60
+	require.Equal(context.DeadlineExceeded, hang.Fetch(cctx, fetcher.Request{Digest: "layer"}))
+}
+
+func TestLayerFetchers(t *testing.T) {
+	require := require.New(t)
+
+	_, err := newLayerFetchers([]fetcherConfig{{Name: "a", Cmd: "a"}, {Name: "a", Cmd: "b"}}, "")
+	require.Error(err)
+	_, err = newLayerFetchers([]fetcherConfig{{Name: "a"}}, "")
+	require.Error(err)
+	_, err = newLayerFetchers([]fetcherConfig{{Name: "a", Cmd: "a"}}, "b")
+	require.Error(err)
+
+	// the only fetcher is the default one
+	fetchers, err := newLayerFetchers([]fetcherConfig{{Name: "a", Cmd: "a"}}, "")
+	require.NoError(err)
+	lf, err := fetchers.pick(Layer{})
+	require.NoError(err)
+	require.Equal("a", lf.Name)
+	_, err = fetchers.pick(Layer{Fetcher: "b"})
+	require.Error(err)
+
+	fetchers, err = newLayerFetchers([]fetcherConfig{{Name: "a", Cmd: "a"}, {Name: "b", Cmd: "b"}}, "")
+	require.NoError(err)
+	lf, err = fetchers.pick(Layer{})
+	require.NoError(err)
+	require.Nil(lf)
+	lf, err = fetchers.pick(Layer{Fetcher: "b"})
+	require.NoError(err)
+	require.Equal("b", lf.Name)
+}
+
+func TestBoxSpoolViaFetcherWithFakePorto(t *testing.T) {
+	require := require.New(t)
+
+	env := newFakeBoxEnv(t)
+	defer env.Close()
+	src := filepath.Join(env.dir, "src")
+	require.NoError(os.MkdirAll(filepath.Join(src, "app"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(src, "app", "layer.tar"), []byte("layer"), 0644))
+	local := helperFetcher("local", "local", src)
+	env.cfg["fetchers"] = []interface{}{
+		map[string]interface{}{"name": local.Name, "cmd": local.Cmd, "args": local.Args},
+	}
+	box := env.newBox(t)
+	defer box.Close()
+
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte("layer")))
+	opts, err := isolate.NewRawProfile(map[string]interface{}{
+		"extended_info": map[string]interface{}{
+			"layers": []interface{}{
+				map[string]interface{}{"digest": digest, "digest_type": "sha256", "fetcher": "local", "source": "app/layer.tar"},
+			},
+		},
+	})
+	require.NoError(err)
+	require.NoError(box.Spool(context.Background(), "app", opts))
+	require.Equal("sha256_"+digest, box.journal.GetManifestLayers("app"))
+}
@@ -0,0 +1,314 @@
+package porto
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/pkg/log"
+)
+
+const (
+	defaultLayerGCPeriod = 300
+
+	// partial downloads untouched for so long are considered abandoned
+	partialBlobTTL = 24 * time.Hour
+)
+
+type layerGCConfig struct {
+	Enable bool `json:"enable"`
+	// How often the collector runs
+	PeriodSec uint `json:"period_sec"`
+	// Total size of blobs in the Layers directory.
+	// Manifests of least recently used apps are evicted from the journal
+	// to get below the quota. Zero disables the quota.
+	QuotaBytes int64 `json:"quota_bytes"`
+}
+
+// layerStore is a subset of porto.API used by the collector
+type layerStore interface {
+	ListLayers() ([]string, error)
+	RemoveLayer(layer string) error
+	Close() error
+}
+
+// layerGC removes Porto layers and blobs which are referenced neither by
+// manifests in the journal nor by running containers
+type layerGC struct {
+	config  layerGCConfig
+	dir     string
+	journal *journal
+	connect func() (layerStore, error)
+	// running returns names of apps and layers of the tracked containers
+	running func() (apps []string, layers []string)
+
+	// layers of spools and spawns in progress, which are about
+	// to be referenced by the journal or containers
+	refs *layerRefs
+
+	mu       sync.Mutex
+	started  time.Time
+	lastUsed map[string]time.Time
+}
+
+func newLayerGC(config layerGCConfig, dir string, j *journal, refs *layerRefs, connect func() (layerStore, error), running func() ([]string, []string)) *layerGC {
+	if config.PeriodSec == 0 {
+		config.PeriodSec = defaultLayerGCPeriod
+	}
+
+	return &layerGC{
+		config:   config,
+		dir:      dir,
+		journal:  j,
+		refs:     refs,
+		connect:  connect,
+		running:  running,
+		started:  time.Now(),
+		lastUsed: make(map[string]time.Time),
+	}
+}
+
+// Used updates the last usage time of the app
+func (gc *layerGC) Used(app string) {
+	gc.mu.Lock()
+	gc.lastUsed[app] = time.Now()
+	gc.mu.Unlock()
+}
+
+// LastUsed returns the last usage time of the app.
+// Apps which have not been used since the start are considered to be used at the start.
+func (gc *layerGC) LastUsed(app string) time.Time {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if used, ok := gc.lastUsed[app]; ok {
+		return used
+	}
+	return gc.started
+}
+
+func (gc *layerGC) forget(app string) {
+	gc.mu.Lock()
+	delete(gc.lastUsed, app)
+	gc.mu.Unlock()
+}
+
+func (gc *layerGC) run(ctx context.Context) {
+	period := time.Duration(gc.config.PeriodSec) * time.Second
+	log.G(ctx).Infof("start layer gc every %s", period)
+	for {
+		select {
+		case <-time.After(period):
+			if err := gc.collect(ctx); err != nil {
+				layersGCErrorsCounter.Inc(1)
+				log.G(ctx).WithError(err).Error("layer gc failed")
+			}
+		case <-ctx.Done():
+			log.G(ctx).Info("layer gc has been stopped")
+			return
+		}
+	}
+}
+
+// collect removes unreferenced layers and blobs, then evicts manifests
+// of least recently used apps while blobs exceed the quota
+func (gc *layerGC) collect(ctx context.Context) (err error) {
+	defer log.G(ctx).Trace("collect layers").Stop(&err)
+	start := time.Now()
+	defer layersGCTimer.UpdateSince(start)
+
+	conn, err := gc.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	apps, runningLayers := gc.running()
+	if err = gc.sweep(ctx, conn, runningLayers); err != nil {
+		return err
+	}
+
+	usage, err := blobsDiskUsage(gc.dir)
+	if err != nil {
+		return err
+	}
+	blobsDiskUsageGauge.Update(usage)
+
+	if gc.config.QuotaBytes <= 0 || usage <= gc.config.QuotaBytes {
+		return nil
+	}
+
+	log.G(ctx).Warnf("blobs in %s take %d bytes, evict least recently used apps down to %d bytes", gc.dir, usage, gc.config.QuotaBytes)
+	for _, app := range gc.evictionOrder(apps) {
+		if usage <= gc.config.QuotaBytes {
+			break
+		}
+
+		log.G(ctx).WithField("app", app).Infof("evict app manifest unused since %s", gc.LastUsed(app))
+		gc.journal.RemoveManifest(app)
+		gc.forget(app)
+		if err = gc.sweep(ctx, conn, runningLayers); err != nil {
+			return err
+		}
+
+		if usage, err = blobsDiskUsage(gc.dir); err != nil {
+			return err
+		}
+		blobsDiskUsageGauge.Update(usage)
+	}
+
+	if usage > gc.config.QuotaBytes {
+		log.G(ctx).Warnf("blobs in %s still take %d bytes, nothing to evict", gc.dir, usage)
+	}
+	return nil
+}
+
+// evictionOrder returns apps from the journal without running containers
+// sorted from the least recently used one
+func (gc *layerGC) evictionOrder(running []string) []string {
+	isRunning := make(map[string]struct{}, len(running))
+	for _, app := range running {
+		isRunning[app] = struct{}{}
+	}
+
+	var candidates []string
+	for _, app := range gc.journal.ManifestNames() {
+		if _, ok := isRunning[app]; !ok {
+			candidates = append(candidates, app)
+		}
+	}
+
+	sort.Sort(byLastUsed{apps: candidates, gc: gc})
+	return candidates
+}
+
+// byLastUsed sorts apps from the least recently used one
+type byLastUsed struct {
+	apps []string
+	gc   *layerGC
+}
+
+func (b byLastUsed) Len() int      { return len(b.apps) }
+func (b byLastUsed) Swap(i, j int) { b.apps[i], b.apps[j] = b.apps[j], b.apps[i] }
+func (b byLastUsed) Less(i, j int) bool {
+	return b.gc.LastUsed(b.apps[i]).Before(b.gc.LastUsed(b.apps[j]))
+}
+
+// sweep removes Porto layers and blobs which are not referenced.
+// Spools and spawns wait for it to reference a layer, so a layer
+// they rely on is imported again if it has been removed.
+func (gc *layerGC) sweep(ctx context.Context, conn layerStore, runningLayers []string) error {
+	gc.refs.mu.Lock()
+	defer gc.refs.mu.Unlock()
+
+	referenced := gc.journal.ReferencedLayers()
+	for _, layer := range runningLayers {
+		referenced[layer] = struct{}{}
+	}
+	for layer := range gc.refs.refs {
+		referenced[layer] = struct{}{}
+	}
+	// a failed spool is removing these on its own
+	for layer := range gc.refs.removing {
+		referenced[layer] = struct{}{}
+	}
+
+	layers, err := conn.ListLayers()
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		// Porto can have layers imported by someone else
+		if !isDigestLayer(layer) {
+			continue
+		}
+		if _, ok := referenced[layer]; ok {
+			continue
+		}
+
+		if err := conn.RemoveLayer(layer); err != nil {
+			layersGCErrorsCounter.Inc(1)
+			log.G(ctx).WithError(err).WithField("layer", layer).Warn("unable to remove layer")
+			continue
+		}
+		gc.journal.Remove(layer)
+		layersRemovedCounter.Inc(1)
+		log.G(ctx).WithField("layer", layer).Info("layer has been removed")
+	}
+
+	blobs, err := ioutil.ReadDir(gc.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, blob := range blobs {
+		if strings.HasSuffix(blob.Name(), partialBlobSuffix) && time.Since(blob.ModTime()) > partialBlobTTL {
+			log.G(ctx).WithField("blob", blob.Name()).Info("remove abandoned partial download")
+			os.Remove(filepath.Join(gc.dir, blob.Name()))
+			continue
+		}
+
+		layer, ok := blobLayerName(blob.Name())
+		if !ok || blob.IsDir() {
+			continue
+		}
+		if _, ok := referenced[layer]; ok {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(gc.dir, blob.Name())); err != nil {
+			layersGCErrorsCounter.Inc(1)
+			log.G(ctx).WithError(err).WithField("blob", blob.Name()).Warn("unable to remove blob")
+			continue
+		}
+		blobsRemovedCounter.Inc(1)
+		log.G(ctx).WithField("blob", blob.Name()).Info("blob has been removed")
+	}
+
+	return nil
+}
+
+// blobLayerName returns a name of the Porto layer imported from the blob.
+// Blobs from a registry are named after the digest (sha256:hex),
+// the download helper names them after hex only.
+// Other files such as partial downloads are not blobs.
+func blobLayerName(name string) (string, bool) {
+	if dgst, err := digest.ParseDigest(name); err == nil {
+		return strings.Replace(dgst.String(), ":", "_", 1), true
+	}
+
+	if dgst := digest.NewDigestFromHex(string(digest.SHA256), name); dgst.Validate() == nil {
+		return strings.Replace(dgst.String(), ":", "_", 1), true
+	}
+
+	return "", false
+}
+
+// isDigestLayer reports whether the layer has been imported by the Box
+func isDigestLayer(layer string) bool {
+	_, err := digest.ParseDigest(strings.Replace(layer, "_", ":", 1))
+	return err == nil
+}
+
+// blobsDiskUsage returns the total size of blobs in the directory
+func blobsDiskUsage(dir string) (int64, error) {
+	blobs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var usage int64
+	for _, blob := range blobs {
+		if _, ok := blobLayerName(blob.Name()); ok && !blob.IsDir() {
+			usage += blob.Size()
+		}
+	}
+	return usage, nil
+}
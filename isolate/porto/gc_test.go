@@ -0,0 +1,133 @@
+package porto
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type fakeLayerStore struct {
+	layers map[string]bool
+}
+
+func (s *fakeLayerStore) ListLayers() ([]string, error) {
+	var layers []string
+	for layer := range s.layers {
+		layers = append(layers, layer)
+	}
+	sort.Strings(layers)
+	return layers, nil
+}
+
+func (s *fakeLayerStore) RemoveLayer(layer string) error {
+	if !s.layers[layer] {
+		return fmt.Errorf("layer %s does not exist", layer)
+	}
+	delete(s.layers, layer)
+	return nil
+}
+
+func (s *fakeLayerStore) Close() error { return nil }
+
+func fakeLayer(i int) string {
+	return fmt.Sprintf("sha256:%064x", i)
+}
+
+func TestLayerGC(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "layergc")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	store := &fakeLayerStore{layers: map[string]bool{"base": true}}
+	for i := 1; i <= 4; i++ {
+		store.layers[strings.Replace(fakeLayer(i), ":", "_", 1)] = true
+		require.NoError(ioutil.WriteFile(filepath.Join(dir, fakeLayer(i)), make([]byte, 100), 0644))
+	}
+	// a partial download and a blob of the download helper
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, fakeLayer(5)+"-12345"), make([]byte, 100), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%064x", 6)), make([]byte, 100), 0644))
+
+	j := newJournal()
+	j.InsertManifestLayers("app1", "sha256_"+fakeLayer(1)[7:])
+	j.InsertManifestLayers("app2", "sha256_"+fakeLayer(2)[7:])
+
+	var runningApps, runningLayers []string
+	refs := newLayerRefs()
+	gc := newLayerGC(layerGCConfig{}, dir, j, refs, func() (layerStore, error) {
+		return store, nil
+	}, func() ([]string, []string) {
+		return runningApps, runningLayers
+	})
+
+	runningApps = []string{"app3"}
+	runningLayers = []string{"sha256_" + fakeLayer(3)[7:]}
+
+	require.NoError(gc.collect(ctx))
+	layers, _ := store.ListLayers()
+	require.Equal([]string{"base", "sha256_" + fakeLayer(1)[7:], "sha256_" + fakeLayer(2)[7:], "sha256_" + fakeLayer(3)[7:]}, layers)
+
+	usage, err := blobsDiskUsage(dir)
+	require.NoError(err)
+	require.Equal(int64(300), usage)
+	_, err = os.Stat(filepath.Join(dir, fakeLayer(5)+"-12345"))
+	require.NoError(err)
+
+	// app2 is used recently, so app1 is evicted first
+	gc.Used("app1")
+	time.Sleep(time.Millisecond)
+	gc.Used("app2")
+	gc.config.QuotaBytes = 250
+	require.NoError(gc.collect(ctx))
+	require.Equal("", j.GetManifestLayers("app1"))
+	require.NotEqual("", j.GetManifestLayers("app2"))
+	usage, err = blobsDiskUsage(dir)
+	require.NoError(err)
+	require.Equal(int64(200), usage)
+
+	// running apps are never evicted
+	gc.config.QuotaBytes = 1
+	require.NoError(gc.collect(ctx))
+	layers, _ = store.ListLayers()
+	require.Equal([]string{"base", "sha256_" + fakeLayer(3)[7:]}, layers)
+
+	// layers of spools and spawns in progress are kept along with their blobs
+	running := "sha256_" + fakeLayer(3)[7:]
+	refs.ref(running)
+	runningLayers = nil
+	require.NoError(gc.collect(ctx))
+	layers, _ = store.ListLayers()
+	require.Equal([]string{"base", running}, layers)
+	_, err = os.Stat(filepath.Join(dir, fakeLayer(3)))
+	require.NoError(err)
+
+	refs.release([]string{running})
+	require.NoError(gc.collect(ctx))
+	layers, _ = store.ListLayers()
+	require.Equal([]string{"base"}, layers)
+}
+
+func TestBlobLayerName(t *testing.T) {
+	for name, expected := range map[string]string{
+		fakeLayer(1):                        "sha256_" + fakeLayer(1)[7:],
+		fmt.Sprintf("%064x", 1):             "sha256_" + fakeLayer(1)[7:],
+		fakeLayer(1) + "-12345":             "",
+		fakeLayer(1) + ".tar":               "",
+		"portojournalbak123":                "",
+		"sha256:" + strings.Repeat("a", 10): "",
+	} {
+		layer, ok := blobLayerName(name)
+		require.Equal(t, expected != "", ok, name)
+		require.Equal(t, expected, layer, name)
+	}
+}
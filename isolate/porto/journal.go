@@ -2,13 +2,40 @@ package porto
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 
+	"github.com/docker/distribution/digest"
 	"github.com/pborman/uuid"
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/pkg/log"
+)
+
+const (
+	// Version 1 had no envelope, the journal itself was stored
+	journalVersion = 2
+
+	journalBackupSuffix    = ".bak"
+	journalCorruptedSuffix = ".corrupted"
 )
 
+var errJournalChecksum = errors.New("journal checksum mismatch")
+
+// journalFile is an envelope the journal is stored in
+type journalFile struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
 type layersMap map[string]string
 type manifests map[string]string
 
@@ -30,20 +57,151 @@ func newJournal() *journal {
 
 func (j *journal) Dump(w io.Writer) error {
 	j.mu.RLock()
-	defer j.mu.RUnlock()
+	payload, err := json.Marshal(j)
+	j.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
 	enc := json.NewEncoder(w)
-	return enc.Encode(j)
+	return enc.Encode(journalFile{
+		Version:  journalVersion,
+		Checksum: digest.FromBytes(payload).String(),
+		Payload:  payload,
+	})
 }
 
+// Load replaces the content of the journal. The content is left intact on errors
 func (j *journal) Load(r io.Reader) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	payload, err := migrateJournal(body)
+	if err != nil {
+		return err
+	}
+
+	var loaded journal
+	if err = json.Unmarshal(payload, &loaded); err != nil {
+		return err
+	}
+	if loaded.Layers == nil {
+		loaded.Layers = make(layersMap)
+	}
+	if loaded.Manifests == nil {
+		loaded.Manifests = make(manifests)
+	}
+
 	j.mu.Lock()
-	defer j.mu.Unlock()
-	if err := json.NewDecoder(r).Decode(j); err != nil {
+	j.UUID, j.Layers, j.Manifests = loaded.UUID, loaded.Layers, loaded.Manifests
+	j.mu.Unlock()
+	return nil
+}
+
+// migrateJournal verifies the checksum and returns the journal
+// in the format of the current version
+func migrateJournal(body []byte) ([]byte, error) {
+	var file journalFile
+	if err := json.Unmarshal(body, &file); err != nil {
+		return nil, err
+	}
+
+	switch file.Version {
+	case 0:
+		return body, nil
+	case journalVersion:
+		if digest.FromBytes(file.Payload).String() != file.Checksum {
+			return nil, errJournalChecksum
+		}
+		return file.Payload, nil
+	default:
+		return nil, fmt.Errorf("unsupported journal version %d", file.Version)
+	}
+}
+
+// writeJournal replaces the journal file with fsync of the file and its directory.
+// The previous copy is kept as a backup.
+func writeJournal(path string, j *journal) error {
+	dir := filepath.Dir(path)
+	tempfile, err := ioutil.TempFile(dir, "portojournalbak")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempfile.Name())
+	defer tempfile.Close()
+
+	if err = j.Dump(tempfile); err != nil {
+		return err
+	}
+
+	if err = tempfile.Sync(); err != nil {
+		return err
+	}
+
+	if err = tempfile.Close(); err != nil {
 		return err
 	}
+
+	if err = os.Rename(path, path+journalBackupSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err = os.Rename(tempfile.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// readJournal loads the journal from the file or from its backup
+// if the file is missing or corrupted. A corrupted file is moved aside.
+// The journal stays empty if there is no valid copy.
+func readJournal(ctx context.Context, path string, j *journal) error {
+	for _, candidate := range []string{path, path + journalBackupSuffix} {
+		err := loadJournalFile(candidate, j)
+		switch {
+		case err == nil:
+			if candidate != path {
+				log.G(ctx).WithField("path", candidate).Warn("journal has been restored from the backup")
+			}
+			return nil
+		case os.IsNotExist(err):
+			log.G(ctx).Warnf("unable to open Journal file: %v", err)
+		default:
+			log.G(ctx).WithError(err).WithField("path", candidate).Error("unable to load Journal")
+			if candidate == path {
+				if err = os.Rename(path, path+journalCorruptedSuffix); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	log.G(ctx).Warn("there is no valid Journal, start with an empty one")
 	return nil
 }
 
+func loadJournalFile(path string, j *journal) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return j.Load(f)
+}
+
 func (j *journal) InsertManifestLayers(manifest string, layers string) {
 	j.mu.Lock()
 	j.Manifests[manifest] = layers
@@ -60,6 +218,38 @@ func (j *journal) GetManifestLayers(manifests string) string {
 	return layers
 }
 
+func (j *journal) RemoveManifest(manifest string) {
+	j.mu.Lock()
+	delete(j.Manifests, manifest)
+	j.mu.Unlock()
+}
+
+// ManifestNames returns names of all manifests in the journal
+func (j *journal) ManifestNames() []string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	names := make([]string, 0, len(j.Manifests))
+	for name := range j.Manifests {
+		names = append(names, name)
+	}
+	return names
+}
+
+// ReferencedLayers returns a set of layers used by any manifest
+func (j *journal) ReferencedLayers() map[string]struct{} {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	referenced := make(map[string]struct{})
+	for _, layers := range j.Manifests {
+		for _, layer := range strings.Split(layers, ";") {
+			if layer != "" {
+				referenced[layer] = struct{}{}
+			}
+		}
+	}
+	return referenced
+}
+
 func (j *journal) Insert(layer string, digest string) *journal {
 	j.mu.Lock()
 	defer j.mu.Unlock()
@@ -74,14 +264,17 @@ func (j *journal) In(layer string, digest string) bool {
 	return ok && v == digest
 }
 
-func (j *journal) UpdateFromPorto(layers []string) {
+func (j *journal) Remove(layer string) {
 	j.mu.Lock()
-	defer j.mu.Unlock()
+	delete(j.Layers, layer)
+	j.mu.Unlock()
+}
 
-	if len(layers) == 0 {
-		j.Layers = make(layersMap)
-		return
-	}
+// UpdateFromPorto drops layers and manifests referencing layers
+// which are absent in Porto. Names of dropped manifests are returned.
+func (j *journal) UpdateFromPorto(layers []string) []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
 
 	if !sort.StringsAreSorted(layers) {
 		sort.Strings(layers)
@@ -91,6 +284,18 @@ func (j *journal) UpdateFromPorto(layers []string) {
 			delete(j.Layers, k)
 		}
 	}
+
+	var dropped []string
+	for name, manifestLayers := range j.Manifests {
+		for _, layer := range strings.Split(manifestLayers, ";") {
+			if !in(layers, layer) {
+				delete(j.Manifests, name)
+				dropped = append(dropped, name)
+				break
+			}
+		}
+	}
+	return dropped
 }
 
 func (j *journal) String() string {
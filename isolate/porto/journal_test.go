@@ -3,9 +3,13 @@ package porto
 import (
 	"bytes"
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 )
 
 func TestJournalDumpLoad(t *testing.T) {
@@ -64,3 +68,68 @@ func TestJournalInsert(t *testing.T) {
 
 	assertT.EqualValues(map[string]string{"A": "a", "B": "b", "C": "c", "D": "d"}, j.Layers)
 }
+
+func TestJournalChecksum(t *testing.T) {
+	assertT := require.New(t)
+	j := newJournal()
+	j.InsertManifestLayers("app", "A;B")
+
+	var buff = new(bytes.Buffer)
+	assertT.NoError(j.Dump(buff))
+
+	var file journalFile
+	assertT.NoError(json.Unmarshal(buff.Bytes(), &file))
+	assertT.Equal(journalVersion, file.Version)
+
+	corrupted := bytes.Replace(buff.Bytes(), []byte("A;B"), []byte("A;C"), 1)
+	loaded := newJournal()
+	assertT.Equal(errJournalChecksum, loaded.Load(bytes.NewReader(corrupted)))
+	assertT.Empty(loaded.Manifests)
+
+	assertT.Error(loaded.Load(bytes.NewReader([]byte(`{"version": 100}`))))
+	assertT.NoError(loaded.Load(buff))
+	assertT.Equal("A;B", loaded.GetManifestLayers("app"))
+}
+
+func TestJournalFallback(t *testing.T) {
+	assertT := require.New(t)
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "journal")
+	assertT.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "portojournal.jrnl")
+
+	// neither the journal nor its backup exist
+	j := newJournal()
+	assertT.NoError(readJournal(ctx, path, j))
+	assertT.Empty(j.Manifests)
+
+	j.InsertManifestLayers("app", "A")
+	assertT.NoError(writeJournal(path, j))
+	j.InsertManifestLayers("app", "A;B")
+	assertT.NoError(writeJournal(path, j))
+
+	loaded := newJournal()
+	assertT.NoError(readJournal(ctx, path, loaded))
+	assertT.Equal("A;B", loaded.GetManifestLayers("app"))
+
+	// the journal is corrupted, so the previous copy is used
+	assertT.NoError(ioutil.WriteFile(path, []byte(`{"version": 2, "payload": {"uu`), 0644))
+	loaded = newJournal()
+	assertT.NoError(readJournal(ctx, path, loaded))
+	assertT.Equal("A", loaded.GetManifestLayers("app"))
+	_, err = os.Stat(path + journalCorruptedSuffix)
+	assertT.NoError(err)
+}
+
+func TestJournalUpdateFromPortoDropsManifests(t *testing.T) {
+	assertT := require.New(t)
+	j := newJournal()
+	j.InsertManifestLayers("complete", "A;B")
+	j.InsertManifestLayers("broken", "A;C")
+
+	assertT.Equal([]string{"broken"}, j.UpdateFromPorto([]string{"B", "A"}))
+	assertT.Equal("A;B", j.GetManifestLayers("complete"))
+	assertT.Equal("", j.GetManifestLayers("broken"))
+}
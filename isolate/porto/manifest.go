@@ -0,0 +1,201 @@
+package porto
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest"
+	"github.com/docker/distribution/manifest/schema2"
+	"golang.org/x/net/context"
+)
+
+// Media types which are not known to the vendored docker/distribution
+const (
+	mediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+	mediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	mediaTypeOCILayer     = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeOCILayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeOCILayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+	mediaTypeDockerLayer  = "application/vnd.docker.image.rootfs.diff.tar"
+
+	defaultPlatform = "linux/amd64"
+	defaultZstdCmd  = "zstd"
+)
+
+type layerCompression int
+
+const (
+	compressionNone layerCompression = iota
+	compressionGzip
+	compressionZstd
+)
+
+var layerMediaTypes = map[string]layerCompression{
+	// schema1 descriptors have no media type
+	"": compressionGzip,
+
+	schema2.MediaTypeLayer:        compressionGzip,
+	schema2.MediaTypeForeignLayer: compressionGzip,
+	mediaTypeDockerLayer:          compressionNone,
+	mediaTypeOCILayer:             compressionNone,
+	mediaTypeOCILayerGzip:         compressionGzip,
+	mediaTypeOCILayerZstd:         compressionZstd,
+}
+
+func compressionOf(mediaType string) (layerCompression, error) {
+	compression, ok := layerMediaTypes[mediaType]
+	if !ok {
+		return compressionNone, fmt.Errorf("unsupported layer media type %s", mediaType)
+	}
+	return compression, nil
+}
+
+func init() {
+	register := func(mediaType string, unmarshal distribution.UnmarshalFunc) {
+		if err := distribution.RegisterManifestSchema(mediaType, unmarshal); err != nil {
+			panic(fmt.Sprintf("Unable to register manifest: %s", err))
+		}
+	}
+
+	register(mediaTypeOCIManifest, unmarshalOCIManifest)
+	register(mediaTypeOCIIndex, unmarshalManifestList(mediaTypeOCIIndex))
+	register(mediaTypeManifestList, unmarshalManifestList(mediaTypeManifestList))
+}
+
+// ociManifest is an OCI image manifest. Its layout is the same as schema2 has,
+// but layers can be compressed with zstd or not compressed at all.
+type ociManifest struct {
+	manifest.Versioned
+
+	Config distribution.Descriptor   `json:"config"`
+	Layers []distribution.Descriptor `json:"layers"`
+
+	canonical []byte
+}
+
+// References returns layers of the image
+func (m *ociManifest) References() []distribution.Descriptor {
+	return m.Layers
+}
+
+// Payload returns the raw content of the manifest
+func (m *ociManifest) Payload() (string, []byte, error) {
+	return mediaTypeOCIManifest, m.canonical, nil
+}
+
+func unmarshalOCIManifest(b []byte) (distribution.Manifest, distribution.Descriptor, error) {
+	m := &ociManifest{canonical: b}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, distribution.Descriptor{}, err
+	}
+
+	return m, distribution.Descriptor{Digest: digest.FromBytes(b), Size: int64(len(b)), MediaType: mediaTypeOCIManifest}, nil
+}
+
+type platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p platform) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// parsePlatform parses os/arch[/variant]
+func parsePlatform(s string) (platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return platform{}, fmt.Errorf("invalid platform %q: must be os/arch[/variant]", s)
+	}
+
+	p := platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+type manifestListDescriptor struct {
+	distribution.Descriptor
+
+	Platform platform `json:"platform"`
+}
+
+// manifestList is either a Docker manifest list or an OCI image index.
+// Both describe the same image built for several platforms.
+type manifestList struct {
+	manifest.Versioned
+
+	Manifests []manifestListDescriptor `json:"manifests"`
+
+	mediaType string
+	canonical []byte
+}
+
+// References returns manifests for all platforms
+func (m *manifestList) References() []distribution.Descriptor {
+	dependencies := make([]distribution.Descriptor, len(m.Manifests))
+	for i := range m.Manifests {
+		dependencies[i] = m.Manifests[i].Descriptor
+	}
+	return dependencies
+}
+
+// Payload returns the raw content of the manifest list
+func (m *manifestList) Payload() (string, []byte, error) {
+	return m.mediaType, m.canonical, nil
+}
+
+// Select returns a manifest descriptor for the platform.
+// A variant is compared only if it's set in the platform.
+func (m *manifestList) Select(p platform) (distribution.Descriptor, error) {
+	for _, candidate := range m.Manifests {
+		if candidate.Platform.OS != p.OS || candidate.Platform.Architecture != p.Architecture {
+			continue
+		}
+		if p.Variant != "" && candidate.Platform.Variant != p.Variant {
+			continue
+		}
+		return candidate.Descriptor, nil
+	}
+
+	return distribution.Descriptor{}, fmt.Errorf("no manifest for platform %s", p)
+}
+
+func unmarshalManifestList(mediaType string) distribution.UnmarshalFunc {
+	return func(b []byte) (distribution.Manifest, distribution.Descriptor, error) {
+		m := &manifestList{mediaType: mediaType, canonical: b}
+		if err := json.Unmarshal(b, m); err != nil {
+			return nil, distribution.Descriptor{}, err
+		}
+
+		return m, distribution.Descriptor{Digest: digest.FromBytes(b), Size: int64(len(b)), MediaType: mediaType}, nil
+	}
+}
+
+// decompressZstd unpacks a zstd layer next to the blob,
+// as Porto is able to import only tarballs compressed by gzip, bzip2 or xz.
+// The caller is responsible for removing the result.
+func decompressZstd(ctx context.Context, zstdCmd, blobPath string) (string, error) {
+	tarPath := blobPath + ".tar"
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, zstdCmd, "-d", "-q", "-f", "-o", tarPath, blobPath)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(tarPath)
+		return "", fmt.Errorf("unable to decompress zstd layer %s: %v %s", blobPath, err, strings.TrimSpace(stderr.String()))
+	}
+	return tarPath, nil
+}
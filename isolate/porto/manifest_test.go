@@ -0,0 +1,126 @@
+package porto
+
+import (
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/stretchr/testify/require"
+)
+
+const ociIndexFixture = `{
+	"schemaVersion": 2,
+	"mediaType": "application/vnd.oci.image.index.v1+json",
+	"manifests": [
+		{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"size": 7143,
+			"digest": "sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f",
+			"platform": {"architecture": "arm64", "os": "linux", "variant": "v8"}
+		},
+		{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"size": 7682,
+			"digest": "sha256:5b0bcabd1ed22e9fb1310cf6c2dec7cdef19f0ad69efa1f392e94a4333501270",
+			"platform": {"architecture": "amd64", "os": "linux"}
+		}
+	]
+}`
+
+const ociManifestFixture = `{
+	"schemaVersion": 2,
+	"mediaType": "application/vnd.oci.image.manifest.v1+json",
+	"config": {
+		"mediaType": "application/vnd.oci.image.config.v1+json",
+		"size": 7023,
+		"digest": "sha256:b5b2b2c507a0944348e0303114d8d93aaaa081732b86451d9bce1f432a537bc7"
+	},
+	"layers": [
+		{
+			"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip",
+			"size": 32654,
+			"digest": "sha256:9834876dcfb05cb167a5c24953eba58c4ac89b1adf57f28f2f9d09af107ee8f0"
+		},
+		{
+			"mediaType": "application/vnd.oci.image.layer.v1.tar+zstd",
+			"size": 16724,
+			"digest": "sha256:3c3a4604a545cdc127456d94e421cd355bca5b528f4a9c1905b15da2eb4a4c6b"
+		}
+	]
+}`
+
+func TestUnmarshalOCIManifests(t *testing.T) {
+	require := require.New(t)
+
+	m, descriptor, err := distribution.UnmarshalManifest(mediaTypeOCIIndex, []byte(ociIndexFixture))
+	require.NoError(err)
+	require.Equal(mediaTypeOCIIndex, descriptor.MediaType)
+	list, ok := m.(*manifestList)
+	require.True(ok)
+	require.Len(list.References(), 2)
+
+	selected, err := list.Select(platform{OS: "linux", Architecture: "amd64"})
+	require.NoError(err)
+	require.Equal("sha256:5b0bcabd1ed22e9fb1310cf6c2dec7cdef19f0ad69efa1f392e94a4333501270", selected.Digest.String())
+
+	selected, err = list.Select(platform{OS: "linux", Architecture: "arm64", Variant: "v8"})
+	require.NoError(err)
+	require.Equal("sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f", selected.Digest.String())
+
+	_, err = list.Select(platform{OS: "linux", Architecture: "arm64", Variant: "v7"})
+	require.Error(err)
+
+	m, _, err = distribution.UnmarshalManifest(mediaTypeManifestList, []byte(ociIndexFixture))
+	require.NoError(err)
+	mediaType, payload, err := m.Payload()
+	require.NoError(err)
+	require.Equal(mediaTypeManifestList, mediaType)
+	require.Equal(ociIndexFixture, string(payload))
+
+	m, _, err = distribution.UnmarshalManifest(mediaTypeOCIManifest, []byte(ociManifestFixture))
+	require.NoError(err)
+	_, ok = m.(*ociManifest)
+	require.True(ok)
+	layers := m.References()
+	require.Len(layers, 2)
+	require.Equal(mediaTypeOCILayerGzip, layers[0].MediaType)
+}
+
+func TestParsePlatform(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		expected platform
+		fail     bool
+	}{
+		{in: "linux/amd64", expected: platform{OS: "linux", Architecture: "amd64"}},
+		{in: "linux/arm64/v8", expected: platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		{in: "linux", fail: true},
+		{in: "linux/", fail: true},
+		{in: "linux/arm/v7/extra", fail: true},
+	} {
+		p, err := parsePlatform(tc.in)
+		if tc.fail {
+			require.Error(t, err, tc.in)
+			continue
+		}
+		require.NoError(t, err, tc.in)
+		require.Equal(t, tc.expected, p)
+		require.Equal(t, tc.in, p.String())
+	}
+}
+
+func TestCompressionOf(t *testing.T) {
+	for mediaType, expected := range map[string]layerCompression{
+		"": compressionGzip,
+		"application/vnd.docker.image.rootfs.diff.tar.gzip": compressionGzip,
+		"application/vnd.oci.image.layer.v1.tar":            compressionNone,
+		"application/vnd.oci.image.layer.v1.tar+gzip":       compressionGzip,
+		"application/vnd.oci.image.layer.v1.tar+zstd":       compressionZstd,
+	} {
+		compression, err := compressionOf(mediaType)
+		require.NoError(t, err, mediaType)
+		require.Equal(t, expected, compression, mediaType)
+	}
+
+	_, err := compressionOf("application/vnd.oci.image.config.v1+json")
+	require.Error(t, err)
+}
@@ -15,8 +15,60 @@ var (
 	// containers that crashed during spawning
 	containersErroredCounter = metrics.NewCounter()
 	containersKilledCounter  = metrics.NewCounter()
+	// running containers taken over after restart
+	containersAdoptedCounter = metrics.NewCounter()
+	// dead containers by the way they have exited
+	containersOOMKilledCounter     = metrics.NewCounter()
+	containersSignaledCounter      = metrics.NewCounter()
+	containersExitedNonZeroCounter = metrics.NewCounter()
+	// failed containers kept for debugging and purged later
+	containersRetainedCounter = metrics.NewCounter()
+	retainedPurgedCounter     = metrics.NewCounter()
+	// bytes of output rotated by Porto before they have been sent
+	outputLostCounter = metrics.NewCounter()
 
 	totalSpawnTimer = metrics.NewTimer()
+	// how long a spawn waits for the rate limit and the concurrency semaphore
+	spawnQueueTimer = metrics.NewTimer()
+	// how long it takes to clean up a dead container
+	containerCleanupTimer = metrics.NewTimer()
+
+	// apps spooled on spawn and their layers imported again as they were absent in Porto
+	autoSpoolsCounter       = metrics.NewCounter()
+	layersReimportedCounter = metrics.NewCounter()
+
+	// layers removed as the spool importing them has failed
+	layersRolledBackCounter = metrics.NewCounter()
+
+	layersRemovedCounter  = metrics.NewCounter()
+	blobsRemovedCounter   = metrics.NewCounter()
+	layersGCErrorsCounter = metrics.NewCounter()
+	layersGCTimer         = metrics.NewTimer()
+	// total size of blobs in bytes
+	blobsDiskUsageGauge = metrics.NewGauge()
+
+	blobsDownloadedCounter = metrics.NewCounter()
+	blobsResumedCounter    = metrics.NewCounter()
+	// blobs which did not match their digest
+	blobsCorruptedCounter = metrics.NewCounter()
+	// failures of blob sources which lead to a fallback to the next one
+	blobSourceErrorsCounter = metrics.NewCounter()
+
+	// failed attempts to get a connection to Portod including failed health checks
+	portoConnErrorsCounter  = metrics.NewCounter()
+	portoConnsDialedCounter = metrics.NewCounter()
+	// how long it takes to get a connection to Portod
+	portoConnTimer = metrics.NewTimer()
+
+	// named volumes kept on the disk
+	namedVolumesGauge = metrics.NewGauge()
+	// named volumes removed due to retention or via HTTP
+	namedVolumesRemovedCounter = metrics.NewCounter()
+
+	// results of fetchers: <fetcher>.succeeded, <fetcher>.failed and <fetcher>.timer
+	fetchersRegistry = metrics.NewPrefixedChildRegistry(metrics.DefaultRegistry, "porto_fetchers.")
+	// exits of containers per app and kind: <app>.<kind>
+	appExitsRegistry = metrics.NewPrefixedChildRegistry(metrics.DefaultRegistry, "porto_app_exits.")
 
 	portoConfig    = expvar.NewString("porto_config")
 	journalContent = expvar.NewString("porto_journal")
@@ -28,5 +80,31 @@ func init() {
 	registry.Register("containers_created", containersCreatedCounter)
 	registry.Register("containers_errored", containersErroredCounter)
 	registry.Register("containers_killed", containersKilledCounter)
+	registry.Register("containers_adopted", containersAdoptedCounter)
+	registry.Register("containers_oom_killed", containersOOMKilledCounter)
+	registry.Register("containers_signaled", containersSignaledCounter)
+	registry.Register("containers_exited_non_zero", containersExitedNonZeroCounter)
+	registry.Register("containers_retained", containersRetainedCounter)
+	registry.Register("retained_purged", retainedPurgedCounter)
+	registry.Register("output_lost_bytes", outputLostCounter)
 	registry.Register("total_spawn_timer", totalSpawnTimer)
+	registry.Register("spawn_queue_timer", spawnQueueTimer)
+	registry.Register("container_cleanup_timer", containerCleanupTimer)
+	registry.Register("auto_spools", autoSpoolsCounter)
+	registry.Register("layers_reimported", layersReimportedCounter)
+	registry.Register("layers_rolled_back", layersRolledBackCounter)
+	registry.Register("layers_removed", layersRemovedCounter)
+	registry.Register("blobs_removed", blobsRemovedCounter)
+	registry.Register("layers_gc_errors", layersGCErrorsCounter)
+	registry.Register("layers_gc_timer", layersGCTimer)
+	registry.Register("blobs_disk_usage", blobsDiskUsageGauge)
+	registry.Register("blobs_downloaded", blobsDownloadedCounter)
+	registry.Register("blobs_resumed", blobsResumedCounter)
+	registry.Register("blobs_corrupted", blobsCorruptedCounter)
+	registry.Register("blob_source_errors", blobSourceErrorsCounter)
+	registry.Register("conn_errors", portoConnErrorsCounter)
+	registry.Register("conns_dialed", portoConnsDialedCounter)
+	registry.Register("conn_timer", portoConnTimer)
+	registry.Register("named_volumes", namedVolumesGauge)
+	registry.Register("named_volumes_removed", namedVolumesRemovedCounter)
 }
@@ -0,0 +1,200 @@
+package porto
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Network modes of the profile. They are named after Porto ones.
+const (
+	networkNone      = "none"
+	networkInherited = "inherited"
+	networkL3        = "L3"
+	networkMacvlan   = "macvlan"
+	networkIpvlan    = "ipvlan"
+	networkNAT       = "NAT"
+
+	// the name of the network interface inside a container
+	defaultNetworkInterface = "eth0"
+	defaultMacvlanType      = "bridge"
+	defaultIpvlanMode       = "l2"
+)
+
+var (
+	networkModes = []string{networkNone, networkInherited, networkL3, networkMacvlan, networkIpvlan, networkNAT}
+
+	macvlanTypes = map[string]bool{"bridge": true, "private": true, "vepa": true, "passthru": true}
+	ipvlanModes  = map[string]bool{"l2": true, "l3": true}
+)
+
+// networkConfig is a validated network section of a profile.
+// The mode comes from `network_mode`, the rest from `network`.
+type networkConfig struct {
+	Mode string
+	// the mode of the profile if it's not known, e.g. `host` of old profiles.
+	// Such profiles used to get the inherited network and still do.
+	LegacyMode string
+	// `interface`: the name of the interface inside the container
+	Interface string
+	// `master`: the host interface for macvlan and ipvlan
+	Master string
+	// `type`: the type of macvlan or the mode of ipvlan
+	Type string
+	// `mtu`: MTU of macvlan and ipvlan interfaces
+	MTU string
+	// `ip`: addresses separated by ';'
+	Addresses []string
+	// `gateway`: the default gateway for macvlan and ipvlan
+	Gateway string
+}
+
+// parseNetwork validates the network section of a profile.
+// defaultMaster is used for macvlan and ipvlan if the profile does not specify it.
+// Unknown modes fall back to inherited for compatibility with old profiles.
+func parseNetwork(mode string, network map[string]string, defaultMaster string) (*networkConfig, error) {
+	n := &networkConfig{
+		Mode:      networkInherited,
+		Interface: network["interface"],
+		Master:    network["master"],
+		Type:      network["type"],
+		MTU:       network["mtu"],
+		Gateway:   network["gateway"],
+	}
+
+	if mode != "" {
+		n.Mode = ""
+		for _, known := range networkModes {
+			if strings.EqualFold(mode, known) {
+				n.Mode = known
+			}
+		}
+		if n.Mode == "" {
+			n.Mode, n.LegacyMode = networkInherited, mode
+		}
+	}
+
+	if n.Interface == "" {
+		n.Interface = defaultNetworkInterface
+	}
+	if strings.ContainsAny(n.Interface, " ;") {
+		return nil, fmt.Errorf("invalid network interface name %q", n.Interface)
+	}
+
+	for _, address := range strings.Split(network["ip"], ";") {
+		if address = strings.TrimSpace(address); address == "" {
+			continue
+		}
+		if !validAddress(address) {
+			return nil, fmt.Errorf("invalid IP address %q", address)
+		}
+		n.Addresses = append(n.Addresses, address)
+	}
+
+	if n.Gateway != "" && net.ParseIP(n.Gateway) == nil {
+		return nil, fmt.Errorf("invalid gateway %q", n.Gateway)
+	}
+
+	if n.MTU != "" {
+		if mtu, err := strconv.ParseUint(n.MTU, 10, 16); err != nil || mtu == 0 {
+			return nil, fmt.Errorf("invalid MTU %q", n.MTU)
+		}
+	}
+
+	switch n.Mode {
+	case networkNone, networkInherited:
+		if len(n.Addresses) > 0 || n.Gateway != "" {
+			return nil, fmt.Errorf("addresses can not be assigned in %s network mode", n.Mode)
+		}
+	case networkL3:
+		if len(n.Addresses) == 0 {
+			return nil, fmt.Errorf("%s network mode requires addresses", n.Mode)
+		}
+	case networkNAT:
+	case networkMacvlan, networkIpvlan:
+		if n.Master == "" {
+			n.Master = defaultMaster
+		}
+		if n.Master == "" {
+			return nil, fmt.Errorf("%s network mode requires a master interface", n.Mode)
+		}
+		if n.Mode == networkMacvlan {
+			if n.Type == "" {
+				n.Type = defaultMacvlanType
+			}
+			if !macvlanTypes[n.Type] {
+				return nil, fmt.Errorf("invalid macvlan type %q", n.Type)
+			}
+		} else {
+			if n.Type == "" {
+				n.Type = defaultIpvlanMode
+			}
+			if !ipvlanModes[n.Type] {
+				return nil, fmt.Errorf("invalid ipvlan mode %q", n.Type)
+			}
+		}
+	}
+
+	switch n.Mode {
+	case networkMacvlan, networkIpvlan:
+	default:
+		if n.Gateway != "" {
+			return nil, fmt.Errorf("a gateway can not be set in %s network mode", n.Mode)
+		}
+		if n.MTU != "" {
+			return nil, fmt.Errorf("MTU can not be set in %s network mode", n.Mode)
+		}
+	}
+
+	return n, nil
+}
+
+// warning describes the fallback of an unknown mode, it's empty for known ones
+func (n *networkConfig) warning() string {
+	if n.LegacyMode == "" {
+		return ""
+	}
+	return fmt.Sprintf("unknown network mode %q is treated as %s, expected one of %s", n.LegacyMode, networkInherited, strings.Join(networkModes, ", "))
+}
+
+// validAddress accepts an address with or without a prefix length
+func validAddress(address string) bool {
+	if net.ParseIP(address) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(address)
+	return err == nil
+}
+
+// properties returns Porto properties of the container: net, ip and default_gw
+func (n *networkConfig) properties() map[string]string {
+	var netProperty []string
+	switch n.Mode {
+	case networkL3, networkNAT:
+		netProperty = []string{n.Mode, n.Interface}
+	case networkMacvlan, networkIpvlan:
+		netProperty = []string{n.Mode, n.Master, n.Interface, n.Type}
+		if n.MTU != "" {
+			netProperty = append(netProperty, n.MTU)
+		}
+	default:
+		netProperty = []string{n.Mode}
+	}
+
+	properties := map[string]string{"net": strings.Join(netProperty, " ")}
+
+	if len(n.Addresses) > 0 {
+		addresses := make([]string, 0, len(n.Addresses))
+		for _, address := range n.Addresses {
+			addresses = append(addresses, n.Interface+" "+address)
+		}
+		properties["ip"] = strings.Join(addresses, ";")
+	}
+
+	if n.Gateway != "" {
+		properties["default_gw"] = n.Interface + " " + n.Gateway
+	}
+
+	return properties
+}
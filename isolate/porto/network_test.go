@@ -0,0 +1,104 @@
+package porto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNetwork(t *testing.T) {
+	for _, tc := range []struct {
+		mode       string
+		network    map[string]string
+		properties map[string]string
+	}{
+		{
+			mode:       "",
+			properties: map[string]string{"net": "inherited"},
+		},
+		{
+			// MTN options are ignored
+			mode:       "inherited",
+			network:    map[string]string{"mtn": "disable", "netid": "123"},
+			properties: map[string]string{"net": "inherited"},
+		},
+		{
+			mode:       "none",
+			properties: map[string]string{"net": "none"},
+		},
+		{
+			mode:    "l3",
+			network: map[string]string{"ip": "2a02:6b8::1; 10.0.0.1/24"},
+			properties: map[string]string{
+				"net": "L3 eth0",
+				"ip":  "eth0 2a02:6b8::1;eth0 10.0.0.1/24",
+			},
+		},
+		{
+			mode:       "NAT",
+			network:    map[string]string{"interface": "veth"},
+			properties: map[string]string{"net": "NAT veth"},
+		},
+		{
+			mode:    "macvlan",
+			network: map[string]string{"ip": "10.0.0.2", "gateway": "10.0.0.1", "mtu": "1450"},
+			properties: map[string]string{
+				"net":        "macvlan eth1 eth0 bridge 1450",
+				"ip":         "eth0 10.0.0.2",
+				"default_gw": "eth0 10.0.0.1",
+			},
+		},
+		{
+			mode:       "ipvlan",
+			network:    map[string]string{"master": "bond0", "type": "l3"},
+			properties: map[string]string{"net": "ipvlan bond0 eth0 l3"},
+		},
+	} {
+		n, err := parseNetwork(tc.mode, tc.network, "eth1")
+		require.NoError(t, err, tc.mode)
+		assert.Equal(t, tc.properties, n.properties(), tc.mode)
+	}
+}
+
+func TestParseNetworkLegacyModes(t *testing.T) {
+	for _, mode := range []string{"", "host", "somenetwork", "bridge"} {
+		n, err := parseNetwork(mode, nil, "")
+		require.NoError(t, err, mode)
+		assert.Equal(t, map[string]string{"net": "inherited"}, n.properties(), mode)
+		if mode == "" {
+			assert.Empty(t, n.warning())
+		} else {
+			assert.Equal(t, mode, n.LegacyMode)
+			assert.Contains(t, n.warning(), mode)
+		}
+	}
+
+	// the fallback is not a way to set addresses
+	_, err := parseNetwork("host", map[string]string{"ip": "10.0.0.1"}, "")
+	assert.Error(t, err)
+}
+
+func TestParseNetworkErrors(t *testing.T) {
+	for _, tc := range []struct {
+		mode    string
+		network map[string]string
+		master  string
+	}{
+		{mode: "none", network: map[string]string{"ip": "10.0.0.1"}},
+		{mode: "inherited", network: map[string]string{"gateway": "10.0.0.1"}},
+		{mode: "L3"},
+		{mode: "L3", network: map[string]string{"ip": "10.0.0.300"}},
+		{mode: "L3", network: map[string]string{"ip": "10.0.0.1", "gateway": "10.0.0.254"}},
+		{mode: "NAT", network: map[string]string{"mtu": "1500"}},
+		{mode: "macvlan"},
+		{mode: "macvlan", master: "eth1", network: map[string]string{"type": "l2"}},
+		{mode: "macvlan", master: "eth1", network: map[string]string{"mtu": "big"}},
+		{mode: "macvlan", master: "eth1", network: map[string]string{"gateway": "gw"}},
+		{mode: "ipvlan", master: "eth1", network: map[string]string{"type": "bridge"}},
+		{mode: "NAT", network: map[string]string{"interface": "eth0;eth1"}},
+	} {
+		_, err := parseNetwork(tc.mode, tc.network, tc.master)
+		assert.Error(t, err, "%s %v", tc.mode, tc.network)
+	}
+}
@@ -0,0 +1,185 @@
+package porto
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/pkg/log"
+	porto "github.com/yandex/porto/src/api/go"
+	portorpc "github.com/yandex/porto/src/api/go/rpc"
+)
+
+const (
+	defaultOutputPollMs = 1000
+
+	// how many bytes of output are read by a request
+	outputChunkSize = 1 << 20
+)
+
+// dataGetter is a subset of porto.API used to read output
+type dataGetter interface {
+	GetData(name, data string) (string, error)
+}
+
+// outputStream tails stdout or stderr of a container.
+// Porto keeps only the tail of the output, its start is reported by <stream>_offset.
+type outputStream struct {
+	name string
+	// absolute offset of the first byte which has not been sent yet
+	offset uint64
+	// Porto is not able to read a range of the output
+	noRanges bool
+}
+
+// pump sends the output which has appeared since the previous call
+func (s *outputStream) pump(ctx context.Context, portoConn dataGetter, id string, w io.Writer) error {
+	var start uint64
+	var offsetKnown = true
+	if value, err := portoConn.GetData(id, s.name+"_offset"); err == nil {
+		if start, err = strconv.ParseUint(value, 10, 64); err != nil {
+			log.G(ctx).WithError(err).WithField("id", id).Warnf("unable to parse %s_offset %q", s.name, value)
+			start, offsetKnown = s.offset, false
+		}
+	}
+	// the whole output can not be matched with the sent part without the offset
+	pumpAll := func() error {
+		if !offsetKnown {
+			return nil
+		}
+		return s.pumpAll(portoConn, id, start, w)
+	}
+
+	if s.offset < start {
+		log.G(ctx).WithField("id", id).Warnf("%d bytes of %s have been rotated before sending", start-s.offset, s.name)
+		outputLostCounter.Inc(int64(start - s.offset))
+		s.offset = start
+	}
+
+	if s.noRanges {
+		return pumpAll()
+	}
+
+	for {
+		chunk, err := portoConn.GetData(id, fmt.Sprintf("%s[%d:%d]", s.name, s.offset, outputChunkSize))
+		if err != nil {
+			if isEqualPortoError(err, portorpc.EError_InvalidProperty) || isEqualPortoError(err, portorpc.EError_InvalidValue) {
+				log.G(ctx).WithError(err).WithField("id", id).Warnf("unable to read a range of %s, read it entirely", s.name)
+				s.noRanges = true
+				return pumpAll()
+			}
+			return err
+		}
+
+		if len(chunk) == 0 {
+			return nil
+		}
+
+		w.Write([]byte(chunk))
+		s.offset += uint64(len(chunk))
+		if len(chunk) < outputChunkSize {
+			return nil
+		}
+	}
+}
+
+// pumpAll reads the whole output kept by Porto and sends its unsent part
+func (s *outputStream) pumpAll(portoConn dataGetter, id string, start uint64, w io.Writer) error {
+	value, err := portoConn.GetData(id, s.name)
+	if err != nil {
+		return err
+	}
+
+	if end := start + uint64(len(value)); end > s.offset {
+		w.Write([]byte(value[s.offset-start:]))
+		s.offset = end
+	}
+	return nil
+}
+
+// startStreaming enables sending of the output while the container is running.
+// It must be called after the notification about start is sent.
+func (c *container) startStreaming() {
+	c.outputMu.Lock()
+	c.streaming = true
+	c.outputMu.Unlock()
+}
+
+// drainOutput sends the rest of the output and stops streaming
+func (c *container) drainOutput(portoConn dataGetter) {
+	c.outputMu.Lock()
+	defer c.outputMu.Unlock()
+	c.pumpOutputLocked(portoConn)
+	c.streaming = false
+}
+
+// pumpOutputLocked must be called with outputMu held.
+// Errors other than Porto ones are returned as they mean a broken connection.
+func (c *container) pumpOutputLocked(portoConn dataGetter) (err error) {
+	for _, stream := range []*outputStream{&c.stdout, &c.stderr} {
+		before := stream.offset
+		if perr := stream.pump(c.ctx, portoConn, c.containerID, c.output); perr != nil {
+			log.G(c.ctx).WithField("id", c.containerID).WithError(perr).Warnf("unable to get %s", stream.name)
+			if _, ok := perr.(*porto.Error); !ok {
+				err = perr
+			}
+		}
+		if sent := stream.offset - before; sent > 0 {
+			log.G(c.ctx).WithField("id", c.containerID).Infof("%d bytes of %s have been sent", sent, stream.name)
+		}
+	}
+	return err
+}
+
+// outputLoop streams the output of the running containers
+func (b *Box) outputLoop(ctx context.Context) {
+	period := time.Duration(b.config.OutputPollMs) * time.Millisecond
+	log.G(ctx).Infof("stream output of containers every %s", period)
+
+	var portoConn porto.API
+	defer func() {
+		if portoConn != nil {
+			portoConn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-time.After(period):
+		case <-ctx.Done():
+			return
+		}
+
+		if portoConn == nil {
+			var err error
+			if portoConn, err = b.conns.Get(ctx); err != nil {
+				log.G(ctx).WithError(err).Warn("unable to connect to Portod to stream output")
+				continue
+			}
+		}
+
+		b.muContainers.Lock()
+		containers := make([]*container, 0, len(b.containers))
+		for _, container := range b.containers {
+			containers = append(containers, container)
+		}
+		b.muContainers.Unlock()
+
+		var err error
+		for _, container := range containers {
+			container.outputMu.Lock()
+			if container.streaming && err == nil {
+				err = container.pumpOutputLocked(portoConn)
+			}
+			container.outputMu.Unlock()
+		}
+
+		if err != nil {
+			discardConn(portoConn)
+			portoConn = nil
+		}
+	}
+}
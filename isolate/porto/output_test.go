@@ -0,0 +1,120 @@
+package porto
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	porto "github.com/yandex/porto/src/api/go"
+	portorpc "github.com/yandex/porto/src/api/go/rpc"
+)
+
+// fakeOutput keeps the tail of the output as Porto does
+type fakeOutput struct {
+	start    uint64
+	data     string
+	noRanges bool
+	// stdout_offset is not a number
+	badOffset bool
+}
+
+func (o *fakeOutput) write(s string, limit int) {
+	o.data += s
+	if len(o.data) > limit {
+		o.start += uint64(len(o.data) - limit)
+		o.data = o.data[len(o.data)-limit:]
+	}
+}
+
+func (o *fakeOutput) GetData(name, data string) (string, error) {
+	var offset, length uint64
+	switch {
+	case data == "stdout_offset" && o.badOffset:
+		return "garbage", nil
+	case data == "stdout_offset":
+		return strconv.FormatUint(o.start, 10), nil
+	case data == "stdout":
+		return o.data, nil
+	case o.noRanges:
+		return "", &porto.Error{Errno: portorpc.EError_InvalidProperty, ErrName: "InvalidProperty"}
+	}
+
+	if _, err := fmt.Sscanf(data, "stdout[%d:%d]", &offset, &length); err != nil {
+		return "", err
+	}
+	if offset < o.start {
+		offset = o.start
+	}
+	from := offset - o.start
+	if from > uint64(len(o.data)) {
+		return "", nil
+	}
+	to := from + length
+	if to > uint64(len(o.data)) {
+		to = uint64(len(o.data))
+	}
+	return o.data[from:to], nil
+}
+
+func TestOutputStream(t *testing.T) {
+	for _, noRanges := range []bool{false, true} {
+		require := require.New(t)
+		ctx := context.Background()
+
+		var sent bytes.Buffer
+		output := &fakeOutput{noRanges: noRanges}
+		stream := &outputStream{name: "stdout"}
+
+		require.NoError(stream.pump(ctx, output, "id", &sent))
+		require.Empty(sent.String())
+
+		output.write("hello ", 10)
+		require.NoError(stream.pump(ctx, output, "id", &sent))
+		require.NoError(stream.pump(ctx, output, "id", &sent))
+		require.Equal("hello ", sent.String())
+
+		output.write("world", 10)
+		require.NoError(stream.pump(ctx, output, "id", &sent))
+		require.Equal("hello world", sent.String())
+
+		// Porto has rotated a part of the output before it has been sent
+		output.write("0123456789abc", 10)
+		require.NoError(stream.pump(ctx, output, "id", &sent))
+		require.Equal("hello world3456789abc", sent.String())
+		require.Equal(uint64(24), stream.offset)
+		require.Equal(noRanges, stream.noRanges)
+	}
+}
+
+func TestOutputStreamBadOffset(t *testing.T) {
+	for _, noRanges := range []bool{false, true} {
+		require := require.New(t)
+		ctx := context.Background()
+
+		var sent bytes.Buffer
+		output := &fakeOutput{noRanges: noRanges}
+		stream := &outputStream{name: "stdout"}
+		output.write("hello ", 10)
+		require.NoError(stream.pump(ctx, output, "id", &sent))
+
+		// the whole output is not sent again if its start is unknown
+		output.badOffset = true
+		output.write("0123456789", 10)
+		require.NoError(stream.pump(ctx, output, "id", &sent))
+		if noRanges {
+			require.Equal("hello ", sent.String())
+			require.Equal(uint64(6), stream.offset)
+		} else {
+			require.Equal("hello 0123456789", sent.String())
+		}
+
+		output.badOffset = false
+		require.NoError(stream.pump(ctx, output, "id", &sent))
+		require.Equal("hello 0123456789", sent.String())
+		require.Equal(uint64(16), stream.offset)
+	}
+}
@@ -0,0 +1,182 @@
+package porto
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/pkg/semaphore"
+	porto "github.com/yandex/porto/src/api/go"
+)
+
+const (
+	defaultPortoPoolSize = 16
+	// waitLoop and outputLoop keep their connections,
+	// Kill may need one more
+	minPortoPoolSize = 4
+
+	defaultPortoConnectTimeoutSec = 30
+
+	// connections which have been idle for longer are checked before use
+	portoHealthCheckIdle = 5 * time.Second
+	portoDialRetryDelay  = 100 * time.Millisecond
+)
+
+// portoDial connects to Portod. Tests replace it with a fake.
+var portoDial = porto.Connect
+
+type idleConn struct {
+	conn  porto.API
+	since time.Time
+}
+
+// connPool bounds the number of connections to Portod and reuses them.
+// A connection is returned to the pool by Close.
+type connPool struct {
+	dial    func() (porto.API, error)
+	timeout time.Duration
+
+	slots semaphore.Semaphore
+
+	mu   sync.Mutex
+	idle []idleConn
+}
+
+func newConnPool(dial func() (porto.API, error), size uint, timeout time.Duration) *connPool {
+	if size < minPortoPoolSize {
+		size = minPortoPoolSize
+	}
+	return &connPool{
+		dial:    dial,
+		timeout: timeout,
+		slots:   semaphore.New(size),
+	}
+}
+
+// Get returns a healthy connection. It waits for a free slot and dials Portod
+// until the context is done. The default timeout is applied if the context has no deadline.
+func (p *connPool) Get(ctx context.Context) (conn porto.API, err error) {
+	start := time.Now()
+	defer func() {
+		portoConnTimer.UpdateSince(start)
+		if err != nil {
+			portoConnErrorsCounter.Inc(1)
+		}
+	}()
+
+	if _, ok := ctx.Deadline(); !ok && p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	if err = p.slots.Acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	for {
+		idle, ok := p.popIdle()
+		if !ok {
+			break
+		}
+		if time.Since(idle.since) < portoHealthCheckIdle || healthy(idle.conn) {
+			return &pooledConn{API: idle.conn, pool: p}, nil
+		}
+		portoConnErrorsCounter.Inc(1)
+		idle.conn.Close()
+	}
+
+	if conn, err = p.connect(ctx); err != nil {
+		p.slots.Release()
+		return nil, err
+	}
+	return &pooledConn{API: conn, pool: p}, nil
+}
+
+func (p *connPool) popIdle() (idleConn, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) == 0 {
+		return idleConn{}, false
+	}
+	// the most recently used connection is the most likely to be alive
+	idle := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	return idle, true
+}
+
+// connect dials Portod retrying on temporary errors
+func (p *connPool) connect(ctx context.Context) (porto.API, error) {
+	for {
+		conn, err := p.dial()
+		if err == nil {
+			portoConnsDialedCounter.Inc(1)
+			return conn, nil
+		}
+
+		if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+			return nil, err
+		}
+
+		portoConnErrorsCounter.Inc(1)
+		select {
+		case <-time.After(portoDialRetryDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (p *connPool) put(conn porto.API, broken bool) {
+	if broken {
+		conn.Close()
+	} else {
+		p.mu.Lock()
+		p.idle = append(p.idle, idleConn{conn: conn, since: time.Now()})
+		p.mu.Unlock()
+	}
+	p.slots.Release()
+}
+
+// Close closes idle connections
+func (p *connPool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+	for _, i := range idle {
+		i.conn.Close()
+	}
+}
+
+func healthy(conn porto.API) bool {
+	_, _, err := conn.GetVersion()
+	return err == nil
+}
+
+// pooledConn returns the connection to the pool on Close
+type pooledConn struct {
+	porto.API
+
+	pool   *connPool
+	once   sync.Once
+	broken bool
+}
+
+func (c *pooledConn) Close() error {
+	c.once.Do(func() {
+		c.pool.put(c.API, c.broken)
+	})
+	return nil
+}
+
+// discardConn closes the connection instead of returning it to the pool.
+// It must be used when the connection is known to be broken.
+func discardConn(conn porto.API) {
+	if pc, ok := conn.(*pooledConn); ok {
+		pc.broken = true
+	}
+	conn.Close()
+}
@@ -0,0 +1,108 @@
+package porto
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	porto "github.com/yandex/porto/src/api/go"
+)
+
+// versionConn implements only the calls used by the pool
+type versionConn struct {
+	porto.API
+
+	alive  bool
+	closed bool
+}
+
+func (c *versionConn) GetVersion() (string, string, error) {
+	if !c.alive {
+		return "", "", errors.New("broken pipe")
+	}
+	return "4.0", "", nil
+}
+
+func (c *versionConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "resource temporarily unavailable" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+var _ net.Error = temporaryError{}
+
+func TestConnPool(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	var dialed []*versionConn
+	pool := newConnPool(func() (porto.API, error) {
+		conn := &versionConn{alive: true}
+		dialed = append(dialed, conn)
+		return conn, nil
+	}, 1, time.Second)
+
+	conns := make([]porto.API, 0, minPortoPoolSize)
+	for i := 0; i < minPortoPoolSize; i++ {
+		conn, err := pool.Get(ctx)
+		require.NoError(err)
+		conns = append(conns, conn)
+	}
+	require.Len(dialed, minPortoPoolSize)
+
+	// the pool is exhausted
+	wctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	_, err := pool.Get(wctx)
+	cancel()
+	require.Equal(context.DeadlineExceeded, err)
+
+	// a returned connection is reused, a broken one is closed
+	conns[0].Close()
+	conns[0].Close()
+	discardConn(conns[1])
+	require.True(dialed[1].closed)
+	require.False(dialed[0].closed)
+
+	conn, err := pool.Get(ctx)
+	require.NoError(err)
+	require.Equal(dialed[0], conn.(*pooledConn).API)
+	conn.Close()
+
+	// an idle connection is checked before use
+	pool.idle[0].since = time.Now().Add(-portoHealthCheckIdle)
+	dialed[0].alive = false
+	conn, err = pool.Get(ctx)
+	require.NoError(err)
+	require.True(dialed[0].closed)
+	require.Equal(dialed[len(dialed)-1], conn.(*pooledConn).API)
+}
+
+func TestConnPoolDialRetries(t *testing.T) {
+	require := require.New(t)
+
+	attempts := 0
+	pool := newConnPool(func() (porto.API, error) {
+		attempts++
+		return nil, temporaryError{}
+	}, 1, 250*time.Millisecond)
+
+	_, err := pool.Get(context.Background())
+	require.Equal(context.DeadlineExceeded, err)
+	require.True(attempts > 1)
+
+	// the slot has been released
+	pool.dial = func() (porto.API, error) { return nil, errors.New("no such file or directory") }
+	for i := 0; i <= minPortoPoolSize; i++ {
+		_, err = pool.Get(context.Background())
+		require.EqualError(err, "no such file or directory")
+	}
+}
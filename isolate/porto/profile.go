@@ -8,6 +8,12 @@ const (
 
 type VolumeProfile struct {
 	Target     string            `msg:"target"`
+	// Named volumes keep their data between workers of the app
+	Name       string            `msg:"name"`
+	// exclusive or shared
+	Access     string            `msg:"access"`
+	// How long an unused named volume is kept: forever or a duration
+	Retention  string            `msg:"retention"`
 	Properties map[string]string `msg:"properties"`
 }
 
@@ -20,6 +26,10 @@ type Layer struct {
 	DigestType string `msg:"digest_type"`
 	Size        uint `msg:"size"`
 	TorrentId  string `msg:"torrent_id"`
+	// Name of the fetcher of the layer, the default one is used if empty
+	Fetcher string `msg:"fetcher"`
+	// Location of the layer passed to the fetcher as is
+	Source string `msg:"source"`
 }
 
 type Profile struct {
@@ -37,5 +47,7 @@ type Profile struct {
 
 	Container    map[string]string `msg:"container"`
 	Volume       map[string]string `msg:"volume"`
+	// Limits of the meta container shared by all workers of the app
+	AppLimits    map[string]string `msg:"app_limits"`
 	ExtraVolumes []VolumeProfile   `msg:"extravolumes"`
 }
@@ -194,6 +194,18 @@ func (z *Layer) DecodeMsg(dc *msgp.Reader) (err error) {
 				err = msgp.WrapError(err, "TorrentId")
 				return
 			}
+		case "fetcher":
+			z.Fetcher, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "Fetcher")
+				return
+			}
+		case "source":
+			z.Source, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "Source")
+				return
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -207,9 +219,9 @@ func (z *Layer) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z *Layer) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 4
+	// map header, size 6
 	// write "digest"
-	err = en.Append(0x84, 0xa6, 0x64, 0x69, 0x67, 0x65, 0x73, 0x74)
+	err = en.Append(0x86, 0xa6, 0x64, 0x69, 0x67, 0x65, 0x73, 0x74)
 	if err != nil {
 		return
 	}
@@ -248,15 +260,35 @@ func (z *Layer) EncodeMsg(en *msgp.Writer) (err error) {
 		err = msgp.WrapError(err, "TorrentId")
 		return
 	}
+	// write "fetcher"
+	err = en.Append(0xa7, 0x66, 0x65, 0x74, 0x63, 0x68, 0x65, 0x72)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Fetcher)
+	if err != nil {
+		err = msgp.WrapError(err, "Fetcher")
+		return
+	}
+	// write "source"
+	err = en.Append(0xa6, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Source)
+	if err != nil {
+		err = msgp.WrapError(err, "Source")
+		return
+	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
 func (z *Layer) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 4
+	// map header, size 6
 	// string "digest"
-	o = append(o, 0x84, 0xa6, 0x64, 0x69, 0x67, 0x65, 0x73, 0x74)
+	o = append(o, 0x86, 0xa6, 0x64, 0x69, 0x67, 0x65, 0x73, 0x74)
 	o = msgp.AppendString(o, z.Digest)
 	// string "digest_type"
 	o = append(o, 0xab, 0x64, 0x69, 0x67, 0x65, 0x73, 0x74, 0x5f, 0x74, 0x79, 0x70, 0x65)
@@ -267,6 +299,12 @@ func (z *Layer) MarshalMsg(b []byte) (o []byte, err error) {
 	// string "torrent_id"
 	o = append(o, 0xaa, 0x74, 0x6f, 0x72, 0x72, 0x65, 0x6e, 0x74, 0x5f, 0x69, 0x64)
 	o = msgp.AppendString(o, z.TorrentId)
+	// string "fetcher"
+	o = append(o, 0xa7, 0x66, 0x65, 0x74, 0x63, 0x68, 0x65, 0x72)
+	o = msgp.AppendString(o, z.Fetcher)
+	// string "source"
+	o = append(o, 0xa6, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65)
+	o = msgp.AppendString(o, z.Source)
 	return
 }
 
@@ -312,6 +350,18 @@ func (z *Layer) UnmarshalMsg(bts []byte) (o []byte, err error) {
 				err = msgp.WrapError(err, "TorrentId")
 				return
 			}
+		case "fetcher":
+			z.Fetcher, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Fetcher")
+				return
+			}
+		case "source":
+			z.Source, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Source")
+				return
+			}
 		default:
 			bts, err = msgp.Skip(bts)
 			if err != nil {
@@ -326,7 +376,7 @@ func (z *Layer) UnmarshalMsg(bts []byte) (o []byte, err error) {
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
 func (z *Layer) Msgsize() (s int) {
-	s = 1 + 7 + msgp.StringPrefixSize + len(z.Digest) + 12 + msgp.StringPrefixSize + len(z.DigestType) + 5 + msgp.UintSize + 11 + msgp.StringPrefixSize + len(z.TorrentId)
+	s = 1 + 7 + msgp.StringPrefixSize + len(z.Digest) + 12 + msgp.StringPrefixSize + len(z.DigestType) + 5 + msgp.UintSize + 11 + msgp.StringPrefixSize + len(z.TorrentId) + 8 + msgp.StringPrefixSize + len(z.Fetcher) + 7 + msgp.StringPrefixSize + len(z.Source)
 	return
 }
 
@@ -523,6 +573,36 @@ func (z *Profile) DecodeMsg(dc *msgp.Reader) (err error) {
 				}
 				z.Volume[za0007] = za0008
 			}
+		case "app_limits":
+			var zb0009 uint32
+			zb0009, err = dc.ReadMapHeader()
+			if err != nil {
+				err = msgp.WrapError(err, "AppLimits")
+				return
+			}
+			if z.AppLimits == nil {
+				z.AppLimits = make(map[string]string, zb0009)
+			} else if len(z.AppLimits) > 0 {
+				for key := range z.AppLimits {
+					delete(z.AppLimits, key)
+				}
+			}
+			for zb0009 > 0 {
+				zb0009--
+				var za0010 string
+				var za0011 string
+				za0010, err = dc.ReadString()
+				if err != nil {
+					err = msgp.WrapError(err, "AppLimits")
+					return
+				}
+				za0011, err = dc.ReadString()
+				if err != nil {
+					err = msgp.WrapError(err, "AppLimits", za0010)
+					return
+				}
+				z.AppLimits[za0010] = za0011
+			}
 		case "extravolumes":
 			var zb0008 uint32
 			zb0008, err = dc.ReadArrayHeader()
@@ -555,9 +635,9 @@ func (z *Profile) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z *Profile) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 10
+	// map header, size 11
 	// write "registry"
-	err = en.Append(0x8a, 0xa8, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x72, 0x79)
+	err = en.Append(0x8b, 0xa8, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x72, 0x79)
 	if err != nil {
 		return
 	}
@@ -698,6 +778,28 @@ func (z *Profile) EncodeMsg(en *msgp.Writer) (err error) {
 			return
 		}
 	}
+	// write "app_limits"
+	err = en.Append(0xaa, 0x61, 0x70, 0x70, 0x5f, 0x6c, 0x69, 0x6d, 0x69, 0x74, 0x73)
+	if err != nil {
+		return
+	}
+	err = en.WriteMapHeader(uint32(len(z.AppLimits)))
+	if err != nil {
+		err = msgp.WrapError(err, "AppLimits")
+		return
+	}
+	for za0010, za0011 := range z.AppLimits {
+		err = en.WriteString(za0010)
+		if err != nil {
+			err = msgp.WrapError(err, "AppLimits")
+			return
+		}
+		err = en.WriteString(za0011)
+		if err != nil {
+			err = msgp.WrapError(err, "AppLimits", za0010)
+			return
+		}
+	}
 	// write "extravolumes"
 	err = en.Append(0xac, 0x65, 0x78, 0x74, 0x72, 0x61, 0x76, 0x6f, 0x6c, 0x75, 0x6d, 0x65, 0x73)
 	if err != nil {
@@ -721,9 +823,9 @@ func (z *Profile) EncodeMsg(en *msgp.Writer) (err error) {
 // MarshalMsg implements msgp.Marshaler
 func (z *Profile) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 10
+	// map header, size 11
 	// string "registry"
-	o = append(o, 0x8a, 0xa8, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x72, 0x79)
+	o = append(o, 0x8b, 0xa8, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x72, 0x79)
 	o = msgp.AppendString(o, z.Registry)
 	// string "repository"
 	o = append(o, 0xaa, 0x72, 0x65, 0x70, 0x6f, 0x73, 0x69, 0x74, 0x6f, 0x72, 0x79)
@@ -773,6 +875,13 @@ func (z *Profile) MarshalMsg(b []byte) (o []byte, err error) {
 		o = msgp.AppendString(o, za0007)
 		o = msgp.AppendString(o, za0008)
 	}
+	// string "app_limits"
+	o = append(o, 0xaa, 0x61, 0x70, 0x70, 0x5f, 0x6c, 0x69, 0x6d, 0x69, 0x74, 0x73)
+	o = msgp.AppendMapHeader(o, uint32(len(z.AppLimits)))
+	for za0010, za0011 := range z.AppLimits {
+		o = msgp.AppendString(o, za0010)
+		o = msgp.AppendString(o, za0011)
+	}
 	// string "extravolumes"
 	o = append(o, 0xac, 0x65, 0x78, 0x74, 0x72, 0x61, 0x76, 0x6f, 0x6c, 0x75, 0x6d, 0x65, 0x73)
 	o = msgp.AppendArrayHeader(o, uint32(len(z.ExtraVolumes)))
@@ -979,6 +1088,36 @@ func (z *Profile) UnmarshalMsg(bts []byte) (o []byte, err error) {
 				}
 				z.Volume[za0007] = za0008
 			}
+		case "app_limits":
+			var zb0009 uint32
+			zb0009, bts, err = msgp.ReadMapHeaderBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "AppLimits")
+				return
+			}
+			if z.AppLimits == nil {
+				z.AppLimits = make(map[string]string, zb0009)
+			} else if len(z.AppLimits) > 0 {
+				for key := range z.AppLimits {
+					delete(z.AppLimits, key)
+				}
+			}
+			for zb0009 > 0 {
+				var za0010 string
+				var za0011 string
+				zb0009--
+				za0010, bts, err = msgp.ReadStringBytes(bts)
+				if err != nil {
+					err = msgp.WrapError(err, "AppLimits")
+					return
+				}
+				za0011, bts, err = msgp.ReadStringBytes(bts)
+				if err != nil {
+					err = msgp.WrapError(err, "AppLimits", za0010)
+					return
+				}
+				z.AppLimits[za0010] = za0011
+			}
 		case "extravolumes":
 			var zb0008 uint32
 			zb0008, bts, err = msgp.ReadArrayHeaderBytes(bts)
@@ -1041,6 +1180,13 @@ func (z *Profile) Msgsize() (s int) {
 			s += msgp.StringPrefixSize + len(za0007) + msgp.StringPrefixSize + len(za0008)
 		}
 	}
+	s += 11 + msgp.MapHeaderSize
+	if z.AppLimits != nil {
+		for za0010, za0011 := range z.AppLimits {
+			_ = za0011
+			s += msgp.StringPrefixSize + len(za0010) + msgp.StringPrefixSize + len(za0011)
+		}
+	}
 	s += 13 + msgp.ArrayHeaderSize
 	for za0009 := range z.ExtraVolumes {
 		s += z.ExtraVolumes[za0009].Msgsize()
@@ -1072,6 +1218,24 @@ func (z *VolumeProfile) DecodeMsg(dc *msgp.Reader) (err error) {
 				err = msgp.WrapError(err, "Target")
 				return
 			}
+		case "name":
+			z.Name, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "Name")
+				return
+			}
+		case "access":
+			z.Access, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "Access")
+				return
+			}
+		case "retention":
+			z.Retention, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "Retention")
+				return
+			}
 		case "properties":
 			var zb0002 uint32
 			zb0002, err = dc.ReadMapHeader()
@@ -1115,9 +1279,9 @@ func (z *VolumeProfile) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z *VolumeProfile) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 2
+	// map header, size 5
 	// write "target"
-	err = en.Append(0x82, 0xa6, 0x74, 0x61, 0x72, 0x67, 0x65, 0x74)
+	err = en.Append(0x85, 0xa6, 0x74, 0x61, 0x72, 0x67, 0x65, 0x74)
 	if err != nil {
 		return
 	}
@@ -1126,6 +1290,36 @@ func (z *VolumeProfile) EncodeMsg(en *msgp.Writer) (err error) {
 		err = msgp.WrapError(err, "Target")
 		return
 	}
+	// write "name"
+	err = en.Append(0xa4, 0x6e, 0x61, 0x6d, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Name)
+	if err != nil {
+		err = msgp.WrapError(err, "Name")
+		return
+	}
+	// write "access"
+	err = en.Append(0xa6, 0x61, 0x63, 0x63, 0x65, 0x73, 0x73)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Access)
+	if err != nil {
+		err = msgp.WrapError(err, "Access")
+		return
+	}
+	// write "retention"
+	err = en.Append(0xa9, 0x72, 0x65, 0x74, 0x65, 0x6e, 0x74, 0x69, 0x6f, 0x6e)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Retention)
+	if err != nil {
+		err = msgp.WrapError(err, "Retention")
+		return
+	}
 	// write "properties"
 	err = en.Append(0xaa, 0x70, 0x72, 0x6f, 0x70, 0x65, 0x72, 0x74, 0x69, 0x65, 0x73)
 	if err != nil {
@@ -1154,10 +1348,19 @@ func (z *VolumeProfile) EncodeMsg(en *msgp.Writer) (err error) {
 // MarshalMsg implements msgp.Marshaler
 func (z *VolumeProfile) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 2
+	// map header, size 5
 	// string "target"
-	o = append(o, 0x82, 0xa6, 0x74, 0x61, 0x72, 0x67, 0x65, 0x74)
+	o = append(o, 0x85, 0xa6, 0x74, 0x61, 0x72, 0x67, 0x65, 0x74)
 	o = msgp.AppendString(o, z.Target)
+	// string "name"
+	o = append(o, 0xa4, 0x6e, 0x61, 0x6d, 0x65)
+	o = msgp.AppendString(o, z.Name)
+	// string "access"
+	o = append(o, 0xa6, 0x61, 0x63, 0x63, 0x65, 0x73, 0x73)
+	o = msgp.AppendString(o, z.Access)
+	// string "retention"
+	o = append(o, 0xa9, 0x72, 0x65, 0x74, 0x65, 0x6e, 0x74, 0x69, 0x6f, 0x6e)
+	o = msgp.AppendString(o, z.Retention)
 	// string "properties"
 	o = append(o, 0xaa, 0x70, 0x72, 0x6f, 0x70, 0x65, 0x72, 0x74, 0x69, 0x65, 0x73)
 	o = msgp.AppendMapHeader(o, uint32(len(z.Properties)))
@@ -1192,6 +1395,24 @@ func (z *VolumeProfile) UnmarshalMsg(bts []byte) (o []byte, err error) {
 				err = msgp.WrapError(err, "Target")
 				return
 			}
+		case "name":
+			z.Name, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Name")
+				return
+			}
+		case "access":
+			z.Access, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Access")
+				return
+			}
+		case "retention":
+			z.Retention, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Retention")
+				return
+			}
 		case "properties":
 			var zb0002 uint32
 			zb0002, bts, err = msgp.ReadMapHeaderBytes(bts)
@@ -1236,7 +1457,7 @@ func (z *VolumeProfile) UnmarshalMsg(bts []byte) (o []byte, err error) {
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
 func (z *VolumeProfile) Msgsize() (s int) {
-	s = 1 + 7 + msgp.StringPrefixSize + len(z.Target) + 11 + msgp.MapHeaderSize
+	s = 1 + 7 + msgp.StringPrefixSize + len(z.Target) + 5 + msgp.StringPrefixSize + len(z.Name) + 7 + msgp.StringPrefixSize + len(z.Access) + 10 + msgp.StringPrefixSize + len(z.Retention) + 11 + msgp.MapHeaderSize
 	if z.Properties != nil {
 		for za0001, za0002 := range z.Properties {
 			_ = za0002
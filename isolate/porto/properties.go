@@ -0,0 +1,142 @@
+package porto
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Policies to combine a property of an app with the default one
+const (
+	// the value of the app replaces the default one
+	mergeReplace = "replace"
+	// the value of the app is appended to the default one with ';'
+	mergeAppend = "append"
+)
+
+// protectedProperties are always set by the box
+var protectedProperties = map[string]bool{
+	"command":      true,
+	"root":         true,
+	"enable_porto": true,
+	"net":          true,
+	"ip":           true,
+	"default_gw":   true,
+}
+
+// defaultMergePolicies are used unless the config overrides them
+var defaultMergePolicies = map[string]string{
+	"env":  mergeAppend,
+	"bind": mergeAppend,
+}
+
+// containerPropertiesConfig controls which properties of containers
+// can be set by the `container` section of an app profile
+type containerPropertiesConfig struct {
+	// Properties an app may set. All of them are allowed if empty
+	Allow []string `json:"allow"`
+	// Properties an app must not set
+	Deny []string `json:"deny"`
+	// Policies of combining values of an app with defaults: replace or append
+	Merge map[string]string `json:"merge"`
+	// Properties set for all containers
+	Defaults map[string]string `json:"defaults"`
+}
+
+// propertyName strips an index, so `ulimit[nofile]` is matched by `ulimit`
+func propertyName(property string) string {
+	if i := strings.IndexByte(property, '['); i >= 0 {
+		return property[:i]
+	}
+	return property
+}
+
+func (c *containerPropertiesConfig) validate() error {
+	for property, policy := range c.Merge {
+		if policy != mergeReplace && policy != mergeAppend {
+			return fmt.Errorf("unknown merge policy %q of property %q, expected %s or %s", policy, property, mergeReplace, mergeAppend)
+		}
+	}
+	for property := range c.Defaults {
+		if protectedProperties[propertyName(property)] {
+			return fmt.Errorf("property %q is set by the box and can not have a default value", property)
+		}
+	}
+	return nil
+}
+
+// check returns an error if the app is not allowed to set any of the properties
+func (c *containerPropertiesConfig) check(properties map[string]string) error {
+	for property := range properties {
+		name := propertyName(property)
+		if protectedProperties[name] {
+			return fmt.Errorf("property %q is set by the box and can not be overridden by the profile", property)
+		}
+		if c == nil {
+			continue
+		}
+		if contains(c.Deny, name) || contains(c.Deny, property) {
+			return fmt.Errorf("property %q is denied by the box", property)
+		}
+		if len(c.Allow) > 0 && !contains(c.Allow, name) && !contains(c.Allow, property) {
+			return fmt.Errorf("property %q is not in the list of properties allowed by the box", property)
+		}
+	}
+	return nil
+}
+
+func (c *containerPropertiesConfig) mergePolicy(property string) string {
+	if c != nil {
+		if policy, ok := c.Merge[property]; ok {
+			return policy
+		}
+	}
+	if policy, ok := defaultMergePolicies[property]; ok {
+		return policy
+	}
+	return mergeReplace
+}
+
+// apply merges properties of the app over the defaults
+func (c *containerPropertiesConfig) apply(properties map[string]string) map[string]string {
+	var merged = make(map[string]string, len(properties))
+	if c != nil {
+		for property, value := range c.Defaults {
+			merged[property] = value
+		}
+	}
+
+	for property, value := range properties {
+		if base, ok := merged[property]; ok && base != "" && value != "" && c.mergePolicy(property) == mergeAppend {
+			value = base + ";" + value
+		}
+		merged[property] = value
+	}
+	return merged
+}
+
+// withDefault returns the config with one more default property. It is used
+// for the box-wide `defaultulimits`, so a profile's ulimit is merged with it
+// by the merge policy of `ulimit` just like with any other default.
+func (c *containerPropertiesConfig) withDefault(property, value string) *containerPropertiesConfig {
+	var config containerPropertiesConfig
+	if c != nil {
+		config = *c
+	}
+	config.Defaults = make(map[string]string, len(config.Defaults)+1)
+	if c != nil {
+		for name, base := range c.Defaults {
+			config.Defaults[name] = base
+		}
+	}
+	config.Defaults[property] = value
+	return &config
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
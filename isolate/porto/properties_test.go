@@ -0,0 +1,82 @@
+package porto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerPropertiesCheck(t *testing.T) {
+	var unrestricted *containerPropertiesConfig
+	assert.NoError(t, unrestricted.check(map[string]string{"isolate": "true", "memory_limit": "1G"}))
+	assert.EqualError(t, unrestricted.check(map[string]string{"command": "sh"}),
+		`property "command" is set by the box and can not be overridden by the profile`)
+
+	config := &containerPropertiesConfig{
+		Allow: []string{"memory_limit", "ulimit", "capabilities[NET_BIND_SERVICE]", "env"},
+		Deny:  []string{"ulimit[core]"},
+	}
+	for _, ok := range []map[string]string{
+		nil,
+		{"memory_limit": "1G", "env": "A=B"},
+		{"ulimit[nofile]": "1024 1024"},
+		{"capabilities[NET_BIND_SERVICE]": "true"},
+	} {
+		assert.NoError(t, config.check(ok), "%v", ok)
+	}
+
+	for _, violation := range []map[string]string{
+		{"ulimit[core]": "unlimited"},
+		{"capabilities[SYS_ADMIN]": "true"},
+		{"devices": "/dev/kvm rw"},
+		{"enable_porto": "true"},
+		{"net": "host"},
+	} {
+		assert.Error(t, config.check(violation), "%v", violation)
+	}
+
+	config = &containerPropertiesConfig{Deny: []string{"isolate"}}
+	assert.NoError(t, config.check(map[string]string{"memory_limit": "1G"}))
+	assert.EqualError(t, config.check(map[string]string{"isolate": "false"}), `property "isolate" is denied by the box`)
+}
+
+func TestContainerPropertiesApply(t *testing.T) {
+	require := require.New(t)
+
+	var unrestricted *containerPropertiesConfig
+	require.Equal(map[string]string{"cpu_limit": "1c"}, unrestricted.apply(map[string]string{"cpu_limit": "1c"}))
+
+	config := &containerPropertiesConfig{
+		Merge: map[string]string{"bind": mergeReplace, "ulimit": mergeAppend},
+		Defaults: map[string]string{
+			"env":          "LANG=C",
+			"bind":         "/etc/hosts /etc/hosts ro",
+			"ulimit":       "nofile: 1024 1024",
+			"memory_limit": "1G",
+			"isolate":      "true",
+		},
+	}
+	require.NoError(config.validate())
+	require.Equal(map[string]string{
+		"env":          "LANG=C;A=B",
+		"bind":         "/data /data",
+		"ulimit":       "nofile: 1024 1024;core: 0 0",
+		"memory_limit": "2G",
+		"isolate":      "true",
+	}, config.apply(map[string]string{
+		"env":          "A=B",
+		"bind":         "/data /data",
+		"ulimit":       "core: 0 0",
+		"memory_limit": "2G",
+	}))
+
+	// the box-wide default does not change the config itself
+	require.Equal(map[string]string{"ulimit": "core: 0 0"},
+		unrestricted.withDefault("ulimit", "nofile: 1 1").apply(map[string]string{"ulimit": "core: 0 0"}))
+	require.Equal("core: 0 0", config.withDefault("ulimit", "core: 0 0").apply(nil)["ulimit"])
+	require.Equal("nofile: 1024 1024", config.Defaults["ulimit"])
+
+	require.Error((&containerPropertiesConfig{Merge: map[string]string{"env": "prepend"}}).validate())
+	require.Error((&containerPropertiesConfig{Defaults: map[string]string{"root": "/"}}).validate())
+}
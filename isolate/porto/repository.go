@@ -3,18 +3,27 @@ package porto
 import (
 	"fmt"
 	"io"
-	"math/rand"
+	"net/http"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
+	apexlog "github.com/apex/log"
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/digest"
 
 	"github.com/interiorem/stout/pkg/log"
+	"github.com/interiorem/stout/pkg/semaphore"
 	"golang.org/x/net/context"
 )
 
+const (
+	defaultMaxDownloads = 4
+
+	partialBlobSuffix = ".partial"
+)
+
 type asyncSpoolResult struct {
 	path string
 	err  error
@@ -26,12 +35,30 @@ type BlobRepository interface {
 
 type BlobRepositoryConfig struct {
 	SpoolPath string `json:"spool"`
+	// How many blobs can be downloaded simultaneously
+	MaxDownloads uint `json:"max_downloads"`
+	// Sources are tried in order. The origin registry is used if empty
+	Sources []BlobSourceConfig `json:"sources"`
+	// Transport for mirrors
+	Transport http.RoundTripper `json:"-"`
+}
+
+// blobDownload is shared by all callers waiting for the same blob.
+// It's cancelled as soon as the last of them has gone.
+type blobDownload struct {
+	waiters   int
+	cancelled bool
+	cancel    context.CancelFunc
+	done      chan struct{}
+	res       asyncSpoolResult
 }
 
 type blobRepo struct {
 	mu sync.Mutex
 	BlobRepositoryConfig
-	inProgress map[digest.Digest][]chan asyncSpoolResult
+	inProgress map[digest.Digest]*blobDownload
+	downloads  semaphore.Semaphore
+	sources    []*trackedSource
 }
 
 func NewBlobRepository(ctx context.Context, cfg BlobRepositoryConfig) (BlobRepository, error) {
@@ -39,13 +66,36 @@ func NewBlobRepository(ctx context.Context, cfg BlobRepositoryConfig) (BlobRepos
 		return nil, fmt.Errorf("spool is not configuried")
 	}
 
+	if cfg.MaxDownloads == 0 {
+		cfg.MaxDownloads = defaultMaxDownloads
+	}
+
+	if len(cfg.Sources) == 0 {
+		cfg.Sources = []BlobSourceConfig{{Type: blobSourceRegistry}}
+	}
+
+	if cfg.Transport == nil {
+		cfg.Transport = http.DefaultTransport
+	}
+
+	var sources = make([]*trackedSource, 0, len(cfg.Sources))
+	for _, sourceCfg := range cfg.Sources {
+		source, err := newBlobSource(sourceCfg, cfg.Transport)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, &trackedSource{blobSource: source})
+	}
+
 	if err := os.MkdirAll(cfg.SpoolPath, 0777); err != nil {
 		return nil, err
 	}
 
 	s := &blobRepo{
 		BlobRepositoryConfig: cfg,
-		inProgress:           make(map[digest.Digest][]chan asyncSpoolResult),
+		inProgress:           make(map[digest.Digest]*blobDownload),
+		downloads:            semaphore.New(cfg.MaxDownloads),
+		sources:              sources,
 	}
 
 	return s, nil
@@ -67,63 +117,217 @@ func (r *blobRepo) Get(ctx context.Context, repository distribution.Repository,
 }
 
 func (r *blobRepo) download(ctx context.Context, repository distribution.Repository, dgst digest.Digest) (string, error) {
-	ch := make(chan asyncSpoolResult, 1)
 	r.mu.Lock()
-	downloading, ok := r.inProgress[dgst]
-	r.inProgress[dgst] = append(downloading, ch)
-	r.mu.Unlock()
-	if !ok {
-		go func() {
-			log.G(ctx).WithField("digest", dgst).Info("fetching blob")
-			path, err := r.fetch(ctx, repository, dgst)
-			res := asyncSpoolResult{path: path, err: err}
-			r.mu.Lock()
-			log.G(ctx).WithField("digest", dgst).Debug("push notifications")
-			for _, ch := range r.inProgress[dgst] {
-				ch <- res
-			}
-			log.G(ctx).WithField("digest", dgst).Debug("clean notifications store")
-			delete(r.inProgress, dgst)
-			r.mu.Unlock()
-		}()
+	d, ok := r.inProgress[dgst]
+	if !ok || d.cancelled {
+		// A cancelled download may still be writing the partial file,
+		// so the new one starts after it.
+		var after chan struct{}
+		if ok {
+			after = d.done
+		}
+		// The download must outlive the context of the caller, who started it
+		dctx, cancel := context.WithCancel(log.WithLogger(context.Background(), log.G(ctx)))
+		d = &blobDownload{
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		r.inProgress[dgst] = d
+		go r.run(dctx, d, after, repository, dgst)
 	}
+	d.waiters++
+	r.mu.Unlock()
 
 	log.G(ctx).WithField("digest", dgst).Info("the blob downloading is in progress. Waiting")
 	select {
 	case <-ctx.Done():
+		r.mu.Lock()
+		d.waiters--
+		if d.waiters == 0 && !d.cancelled {
+			log.G(ctx).WithField("digest", dgst).Info("nobody waits for the blob anymore, cancel downloading")
+			d.cancelled = true
+			d.cancel()
+		}
+		r.mu.Unlock()
 		return "", ctx.Err()
-	case res := <-ch:
-		return res.path, res.err
+	case <-d.done:
+		return d.res.path, d.res.err
 	}
 }
 
-// fetch downloads the blob to a tempfile, renames it to the expected name
+func (r *blobRepo) run(ctx context.Context, d *blobDownload, after chan struct{}, repository distribution.Repository, dgst digest.Digest) {
+	defer d.cancel()
+	if after != nil {
+		<-after
+	}
+
+	var res asyncSpoolResult
+	if res.err = r.downloads.Acquire(ctx); res.err == nil {
+		log.G(ctx).WithField("digest", dgst).Info("fetching blob")
+		res.path, res.err = r.fetch(ctx, repository, dgst)
+		r.downloads.Release()
+	}
+
+	r.mu.Lock()
+	d.res = res
+	cancelled := d.cancelled
+	if r.inProgress[dgst] == d {
+		delete(r.inProgress, dgst)
+	}
+	r.mu.Unlock()
+	// Nobody waits for the blob, so the partial file is not left behind.
+	// The next download waits for this one, so it's safe to remove the file.
+	if cancelled && res.err != nil {
+		os.Remove(filepath.Join(r.SpoolPath, dgst.String()+partialBlobSuffix))
+	}
+	log.G(ctx).WithField("digest", dgst).Debug("push notifications")
+	close(d.done)
+}
+
+// fetch downloads the blob to a partial file, verifies its digest and
+// renames it to the expected name. Sources are tried one by one:
+// the next source resumes from the end of the partial file
+// left by the failed one, as the content is addressed by the digest.
+// The partial file is kept on failures other than a digest mismatch
+// and cancellation, so the next attempt resumes from its end too.
 func (r *blobRepo) fetch(ctx context.Context, repository distribution.Repository, dgst digest.Digest) (path string, err error) {
 	defer log.G(ctx).WithField("digest", dgst).Trace("fetch the blob").Stop(&err)
-	tempFilePath := filepath.Join(r.SpoolPath, fmt.Sprintf("%s-%d", dgst.String(), rand.Int63()))
-	f, err := os.Create(tempFilePath)
+	verifier, err := digest.NewDigestVerifier(dgst)
+	if err != nil {
+		return "", err
+	}
+
+	partialFilePath := filepath.Join(r.SpoolPath, dgst.String()+partialBlobSuffix)
+	f, err := os.OpenFile(partialFilePath, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
-	defer os.Remove(tempFilePath)
 
-	blob, err := repository.Blobs(ctx).Open(ctx, dgst)
+	// Hash the content downloaded by previous attempts
+	offset, err := io.Copy(verifier, f)
 	if err != nil {
 		return "", err
 	}
-	defer blob.Close()
 
-	if _, err = io.Copy(f, blob); err != nil {
+	verified := offset > 0 && verifier.Verified()
+	for _, source := range orderSources(r.sources, time.Now()) {
+		if verified {
+			break
+		}
+
+		logger := log.G(ctx).WithFields(apexlog.Fields{"digest": dgst, "source": source})
+		offset, verifier, err = r.resume(ctx, source, repository, dgst, f, offset, verifier)
+		switch {
+		case ctx.Err() != nil:
+			return "", ctx.Err()
+		case err == distribution.ErrBlobUnknown:
+			logger.Info("the blob is not found in the source")
+			continue
+		case err != nil:
+			logger.WithError(err).Warn("unable to fetch the blob from the source")
+		case verifier.Verified():
+			source.Succeeded()
+			verified = true
+			continue
+		default:
+			blobsCorruptedCounter.Inc(1)
+			corrupted := distribution.ErrBlobInvalidDigest{Digest: dgst, Reason: fmt.Errorf("content of %d bytes does not match the digest", offset)}
+			logger.WithError(corrupted).Warn("the source has served a corrupted blob")
+			if offset, verifier, err = restart(f, dgst); err != nil {
+				return "", err
+			}
+			err = corrupted
+		}
+
+		blobSourceErrorsCounter.Inc(1)
+		if source.Failed(time.Now()) {
+			logger.Warn("the source is considered unhealthy")
+		}
+	}
+
+	if !verified {
+		if _, isInvalid := err.(distribution.ErrBlobInvalidDigest); isInvalid {
+			os.Remove(partialFilePath)
+		}
+		if err == nil {
+			err = distribution.ErrBlobUnknown
+		}
+		return "", err
+	}
+
+	if err = f.Sync(); err != nil {
 		return "", err
 	}
 	f.Close()
-	blob.Close()
 
 	resultFilePath := filepath.Join(r.SpoolPath, dgst.String())
-	if err = os.Rename(tempFilePath, resultFilePath); err != nil {
+	if err = os.Rename(partialFilePath, resultFilePath); err != nil {
 		return "", err
 	}
+	blobsDownloadedCounter.Inc(1)
 
 	return resultFilePath, nil
 }
+
+// resume appends the rest of the blob from the source to f starting from offset.
+// The download starts over if the source does not support ranges.
+// It returns the size of the file and the verifier fed with its content.
+func (r *blobRepo) resume(ctx context.Context, source blobSource, repository distribution.Repository, dgst digest.Digest, f *os.File, offset int64, verifier digest.Verifier) (int64, digest.Verifier, error) {
+	blob, err := source.Open(ctx, repository, dgst)
+	if err != nil {
+		return offset, verifier, err
+	}
+	defer func() { blob.Close() }()
+
+	if offset > 0 {
+		if _, err = blob.Seek(offset, os.SEEK_SET); err == nil {
+			blobsResumedCounter.Inc(1)
+			log.G(ctx).WithField("digest", dgst).Infof("resume downloading from %d bytes", offset)
+		} else {
+			if err == distribution.ErrBlobUnknown {
+				return offset, verifier, err
+			}
+			log.G(ctx).WithError(err).WithField("digest", dgst).Warn("unable to resume downloading, start over")
+			blob.Close()
+			if blob, err = source.Open(ctx, repository, dgst); err != nil {
+				return offset, verifier, err
+			}
+			if offset, verifier, err = restart(f, dgst); err != nil {
+				return offset, verifier, err
+			}
+		}
+	}
+
+	n, err := io.Copy(io.MultiWriter(f, verifier), &ctxReader{ctx: ctx, r: blob})
+	return offset + n, verifier, err
+}
+
+// restart truncates the partial file
+func restart(f *os.File, dgst digest.Digest) (int64, digest.Verifier, error) {
+	verifier, err := digest.NewDigestVerifier(dgst)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err = f.Truncate(0); err != nil {
+		return 0, nil, err
+	}
+	if _, err = f.Seek(0, os.SEEK_SET); err != nil {
+		return 0, nil, err
+	}
+	return 0, verifier, nil
+}
+
+// ctxReader stops reading as soon as the context is done,
+// as the registry client does not support contexts
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,270 @@
+package porto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/client"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// blobServer serves a single blob with Range support
+type blobServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	content []byte
+	ranges  []string
+	block   chan struct{}
+}
+
+func newBlobServer(content []byte) *blobServer {
+	s := &blobServer{content: content}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.Contains(req.URL.Path, "/blobs/") {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		s.mu.Lock()
+		s.ranges = append(s.ranges, req.Header.Get("Range"))
+		block, content := s.block, s.content
+		s.mu.Unlock()
+		if block != nil {
+			<-block
+		}
+		http.ServeContent(w, req, "blob", time.Time{}, bytes.NewReader(content))
+	}))
+	return s
+}
+
+func (s *blobServer) repository(t *testing.T) distribution.Repository {
+	named, err := reference.ParseNamed("test/blob")
+	require.NoError(t, err)
+	repo, err := client.NewRepository(context.Background(), named, s.URL, http.DefaultTransport)
+	require.NoError(t, err)
+	return repo
+}
+
+func newTestBlobRepo(t *testing.T) (*blobRepo, string) {
+	dir, err := ioutil.TempDir("", "blobrepo")
+	require.NoError(t, err)
+	repo, err := NewBlobRepository(context.Background(), BlobRepositoryConfig{SpoolPath: dir, MaxDownloads: 1})
+	require.NoError(t, err)
+	return repo.(*blobRepo), dir
+}
+
+func TestBlobRepositoryVerifiesAndResumes(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	content := bytes.Repeat([]byte("layer"), 1000)
+	dgst := digest.FromBytes(content)
+	server := newBlobServer(content)
+	defer server.Close()
+
+	repo, dir := newTestBlobRepo(t)
+	defer os.RemoveAll(dir)
+
+	// a previous attempt has been interrupted in the middle
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, dgst.String()+partialBlobSuffix), content[:1234], 0644))
+
+	path, err := repo.Get(ctx, server.repository(t), dgst)
+	require.NoError(err)
+	require.Equal(filepath.Join(dir, dgst.String()), path)
+	body, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Equal(content, body)
+	require.Equal([]string{"bytes=1234-"}, server.ranges)
+	_, err = os.Stat(path + partialBlobSuffix)
+	require.True(os.IsNotExist(err))
+
+	// the content does not match the digest
+	server.content = []byte("corrupted")
+	dgst = digest.FromBytes([]byte("expected"))
+	_, err = repo.Get(ctx, server.repository(t), dgst)
+	require.IsType(distribution.ErrBlobInvalidDigest{}, err)
+	_, err = os.Stat(filepath.Join(dir, dgst.String()+partialBlobSuffix))
+	require.True(os.IsNotExist(err))
+}
+
+func TestBlobRepositoryRefcountedCancellation(t *testing.T) {
+	require := require.New(t)
+
+	content := []byte("some layer content")
+	dgst := digest.FromBytes(content)
+	server := newBlobServer(content)
+	defer server.Close()
+	block := make(chan struct{})
+	server.block = block
+
+	repo, dir := newTestBlobRepo(t)
+	defer os.RemoveAll(dir)
+	registry := server.repository(t)
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := repo.Get(first, registry, dgst)
+		firstErr <- err
+	}()
+
+	secondRes := make(chan asyncSpoolResult, 1)
+	go func() {
+		path, err := repo.Get(context.Background(), registry, dgst)
+		secondRes <- asyncSpoolResult{path: path, err: err}
+	}()
+
+	require.NoError(waitFor(func() bool {
+		repo.mu.Lock()
+		defer repo.mu.Unlock()
+		d, ok := repo.inProgress[dgst]
+		return ok && d.waiters == 2
+	}))
+
+	// the download goes on for the second caller
+	cancelFirst()
+	require.Equal(context.Canceled, <-firstErr)
+	close(block)
+
+	res := <-secondRes
+	require.NoError(res.err)
+	require.Equal(filepath.Join(dir, dgst.String()), res.path)
+}
+
+func waitFor(cond func() bool) error {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return context.DeadlineExceeded
+}
+
+func TestBlobRepositorySources(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	content := []byte("layer from the origin")
+	dgst := digest.FromBytes(content)
+	origin := newBlobServer(content)
+	defer origin.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	seeded, err := ioutil.TempDir("", "seeded")
+	require.NoError(err)
+	defer os.RemoveAll(seeded)
+	seededContent := []byte("pre-seeded layer")
+	seededDigest := digest.FromBytes(seededContent)
+	require.NoError(os.MkdirAll(filepath.Join(seeded, "sha256"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(seeded, "sha256", seededDigest.Hex()), seededContent, 0644))
+
+	dir, err := ioutil.TempDir("", "blobrepo")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	repo, err := NewBlobRepository(ctx, BlobRepositoryConfig{
+		SpoolPath: dir,
+		Sources: []BlobSourceConfig{
+			{Type: blobSourceDir, Path: seeded},
+			{Type: blobSourceMirror, URL: broken.URL},
+			{Type: blobSourceRegistry},
+		},
+	})
+	require.NoError(err)
+	sources := repo.(*blobRepo).sources
+
+	path, err := repo.Get(ctx, origin.repository(t), seededDigest)
+	require.NoError(err)
+	body, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Equal(seededContent, body)
+	require.Empty(origin.ranges)
+
+	// the blob is absent in the directory and the mirror is broken
+	path, err = repo.Get(ctx, origin.repository(t), dgst)
+	require.NoError(err)
+	body, err = ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Equal(content, body)
+	require.Equal(1, sources[1].failures)
+	require.Equal(0, sources[0].failures)
+
+	_, err = NewBlobRepository(ctx, BlobRepositoryConfig{
+		SpoolPath: dir,
+		Sources:   []BlobSourceConfig{{Type: "torrent"}},
+	})
+	require.Error(err)
+}
+
+func TestOrderSources(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	a := &trackedSource{blobSource: registrySource{}}
+	b := &trackedSource{blobSource: registrySource{}}
+	sources := []*trackedSource{a, b}
+
+	for i := 1; i < blobSourceMaxFailures; i++ {
+		require.False(a.Failed(now))
+	}
+	require.Equal([]*trackedSource{a, b}, orderSources(sources, now))
+
+	require.True(a.Failed(now))
+	require.Equal([]*trackedSource{b, a}, orderSources(sources, now))
+	require.Equal([]*trackedSource{a, b}, orderSources(sources, now.Add(blobSourceMinBackoff)))
+
+	a.Succeeded()
+	require.Equal([]*trackedSource{a, b}, orderSources(sources, now))
+}
+
+func TestBlobRepositoryCancellationRemovesPartialBlob(t *testing.T) {
+	require := require.New(t)
+
+	content := []byte("some layer content")
+	dgst := digest.FromBytes(content)
+	server := newBlobServer(content)
+	defer server.Close()
+	block := make(chan struct{})
+	server.block = block
+
+	repo, dir := newTestBlobRepo(t)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := repo.Get(ctx, server.repository(t), dgst)
+		errs <- err
+	}()
+	require.NoError(waitFor(func() bool {
+		_, err := os.Stat(filepath.Join(dir, dgst.String()+partialBlobSuffix))
+		return err == nil
+	}))
+
+	cancel()
+	require.Equal(context.Canceled, <-errs)
+	close(block)
+	require.NoError(waitFor(func() bool {
+		_, err := os.Stat(filepath.Join(dir, dgst.String()+partialBlobSuffix))
+		return os.IsNotExist(err)
+	}))
+	_, err := os.Stat(filepath.Join(dir, dgst.String()))
+	require.True(os.IsNotExist(err))
+}
@@ -0,0 +1,334 @@
+package porto
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	porto "github.com/yandex/porto/src/api/go"
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/pkg/log"
+)
+
+const (
+	// files placed into the root directory of a retained container
+	retainedInfoFile       = "postmortem.json"
+	retainedPropertiesFile = "properties.json"
+	retainedStdoutFile     = "stdout.log"
+	retainedStderrFile     = "stderr.log"
+
+	defaultRetainTTLSec    = 3600
+	defaultRetainMaxPerApp = 3
+
+	retainedSweepPeriod = time.Minute
+)
+
+// retainConfig controls retention of failed containers for post-mortem debugging.
+// Requires cleanupenabled as otherwise all containers are left.
+type retainConfig struct {
+	Enable bool `json:"enable"`
+	// How long a failed container is kept
+	TTLSec uint `json:"ttl_sec"`
+	// How many failed containers of an app are kept. The oldest ones are purged first
+	MaxPerApp uint `json:"max_per_app"`
+}
+
+// retainedContainer is a dead container left for debugging
+type retainedContainer struct {
+	ID        string `json:"id"`
+	Container string `json:"container"`
+	App       string `json:"app"`
+	UUID      string `json:"uuid"`
+	// why the container has been retained
+	Reason     string    `json:"reason"`
+	ExitStatus int       `json:"exit_status"`
+	OOMKilled  bool      `json:"oom_killed"`
+	Failed     time.Time `json:"failed"`
+	// directory with captured output and properties
+	Dir string `json:"dir"`
+
+	cnt *container
+}
+
+type retainedContainers struct {
+	config retainConfig
+
+	mu    sync.Mutex
+	items []*retainedContainer
+}
+
+type byFailed []*retainedContainer
+
+func (b byFailed) Len() int           { return len(b) }
+func (b byFailed) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byFailed) Less(i, j int) bool { return b[i].Failed.Before(b[j].Failed) }
+
+func newRetainedContainers(config retainConfig) *retainedContainers {
+	if config.TTLSec == 0 {
+		config.TTLSec = defaultRetainTTLSec
+	}
+	if config.MaxPerApp == 0 {
+		config.MaxPerApp = defaultRetainMaxPerApp
+	}
+	return &retainedContainers{config: config}
+}
+
+// add returns the containers of the same app evicted to keep the limit
+func (r *retainedContainers) add(rc *retainedContainer) (evicted []*retainedContainer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.items = append(r.items, rc)
+	sort.Stable(byFailed(r.items))
+
+	var count uint
+	for _, item := range r.items {
+		if item.App == rc.App {
+			count++
+		}
+	}
+	return r.removeLocked(func(item *retainedContainer) bool {
+		if item.App == rc.App && count > r.config.MaxPerApp {
+			count--
+			return true
+		}
+		return false
+	})
+}
+
+// removeLocked removes the items matching the predicate in order of failure
+func (r *retainedContainers) removeLocked(match func(*retainedContainer) bool) (removed []*retainedContainer) {
+	kept := r.items[:0]
+	for _, item := range r.items {
+		if match(item) {
+			removed = append(removed, item)
+		} else {
+			kept = append(kept, item)
+		}
+	}
+	r.items = kept
+	return removed
+}
+
+func (r *retainedContainers) remove(match func(*retainedContainer) bool) []*retainedContainer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.removeLocked(match)
+}
+
+func (r *retainedContainers) expired(now time.Time) []*retainedContainer {
+	ttl := time.Duration(r.config.TTLSec) * time.Second
+	return r.remove(func(item *retainedContainer) bool { return now.Sub(item.Failed) >= ttl })
+}
+
+// list returns retained containers of the app or all of them if app is empty
+func (r *retainedContainers) list(app string) []retainedContainer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	items := make([]retainedContainer, 0, len(r.items))
+	for _, item := range r.items {
+		if app == "" || item.App == app {
+			items = append(items, *item)
+		}
+	}
+	return items
+}
+
+func (r *retainedContainers) has(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, item := range r.items {
+		if item.Container == name {
+			return true
+		}
+	}
+	return false
+}
+
+// retainIfFailed keeps the dead container if it has exited abnormally.
+// It returns false if the container must be cleaned up as usual.
+func (b *Box) retainIfFailed(ctx context.Context, portoConn porto.API, c *container, exit exitInfo) bool {
+	if b.retained == nil || !c.cleanupEnabled || !exit.failed() {
+		return false
+	}
+
+	b.retain(ctx, portoConn, c, exit.reason(), exit)
+	return true
+}
+
+// retain captures the output and properties of the failed container to disk
+// and keeps it until it's purged
+func (b *Box) retain(ctx context.Context, portoConn porto.API, c *container, reason string, exit exitInfo) {
+	logger := log.G(ctx).WithField("id", c.containerID)
+	// the rest of the output is sent as usual
+	c.drainOutput(portoConn)
+	c.release()
+
+	rc := &retainedContainer{
+		ID:         filepath.Base(c.rootDir),
+		Container:  c.containerID,
+		App:        c.appName,
+		UUID:       c.uuid,
+		Reason:     reason,
+		ExitStatus: exit.Status,
+		OOMKilled:  exit.OOMKilled,
+		Failed:     time.Now(),
+		Dir:        c.rootDir,
+		cnt:        c,
+	}
+	if err := rc.capture(portoConn); err != nil {
+		logger.WithError(err).Warn("unable to capture the state of the failed container")
+	}
+
+	containersRetainedCounter.Inc(1)
+	logger.WithField("reason", reason).Info("the failed container is retained for debugging")
+	b.purgeRetainedWith(ctx, portoConn, b.retained.add(rc))
+}
+
+func (rc *retainedContainer) capture(portoConn porto.API) error {
+	// the info is written first, so the container can be purged after restart anyway
+	info, err := json.Marshal(rc)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(rc.Dir, retainedInfoFile), info, 0644); err != nil {
+		return err
+	}
+
+	for file, stream := range map[string]string{retainedStdoutFile: "stdout", retainedStderrFile: "stderr"} {
+		data, err := portoConn.GetProperty(rc.Container, stream)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(filepath.Join(rc.Dir, file), []byte(data), 0644); err != nil {
+			return err
+		}
+	}
+
+	result, err := portoConn.Get([]string{rc.Container}, getPListAndDlist(portoConn))
+	if err != nil {
+		return err
+	}
+	properties, err := json.Marshal(portoData(result[rc.Container]))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(rc.Dir, retainedPropertiesFile), properties, 0644)
+}
+
+// purgeRetained cleans up the containers as if they had not been retained
+func (b *Box) purgeRetained(ctx context.Context, items []*retainedContainer) {
+	if len(items) == 0 {
+		return
+	}
+	portoConn, err := b.conns.Get(ctx)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("unable to purge %d retained containers", len(items))
+		b.retained.mu.Lock()
+		b.retained.items = append(b.retained.items, items...)
+		b.retained.mu.Unlock()
+		return
+	}
+	defer portoConn.Close()
+	b.purgeRetainedWith(ctx, portoConn, items)
+}
+
+// purgeRetainedWith purges the containers using the connection of the caller
+func (b *Box) purgeRetainedWith(ctx context.Context, portoConn porto.API, items []*retainedContainer) {
+	for _, rc := range items {
+		rc.cnt.Cleanup(portoConn)
+		b.releaseAppMeta(ctx, portoConn, rc.cnt)
+		retainedPurgedCounter.Inc(1)
+		log.G(ctx).WithField("id", rc.Container).Info("the retained container has been purged")
+	}
+}
+
+// loadRetained restores containers retained by the previous instance of the daemon
+func (b *Box) loadRetained(ctx context.Context) error {
+	infos, err := filepath.Glob(filepath.Join(b.config.Containers, "*", retainedInfoFile))
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		rootDir := filepath.Dir(info)
+		logger := log.G(ctx).WithField("dir", rootDir)
+		body, err := ioutil.ReadFile(info)
+		if err != nil {
+			logger.WithError(err).Warn("unable to read the retained container")
+			continue
+		}
+		rc := new(retainedContainer)
+		if err = json.Unmarshal(body, rc); err != nil {
+			logger.WithError(err).Warn("unable to decode the retained container")
+			continue
+		}
+		state, err := loadContainerState(rootDir)
+		if err != nil {
+			logger.WithError(err).Warn("unable to load the state of the retained container")
+			continue
+		}
+
+		// shared resources have been released when the container was retained
+		rc.cnt = restoreContainer(ctx, b.GlobalState, b.conns, nil, rc.Container, rootDir, state, true)
+		rc.cnt.mtnAllocCleaned = true
+		if rc.cnt.meta != "" {
+			b.appMetas.adopt(rc.cnt.meta)
+		}
+		b.purgeRetained(ctx, b.retained.add(rc))
+	}
+	return nil
+}
+
+func (b *Box) runRetention(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(retainedSweepPeriod):
+			b.purgeRetained(ctx, b.retained.expired(time.Now()))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// retainedHandler lists retained containers on GET and purges them on DELETE.
+// Both accept the `app` query argument, DELETE accepts `id` as well.
+func (b *Box) retainedHandler(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		app, id := r.URL.Query().Get("app"), r.URL.Query().Get("id")
+		switch r.Method {
+		case "GET", "HEAD":
+			body, err := json.Marshal(b.retained.list(app))
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintln(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(body)
+		case "DELETE":
+			if app == "" && id == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, "query arg app or id must be set")
+				return
+			}
+			purged := b.retained.remove(func(item *retainedContainer) bool {
+				return (app == "" || item.App == app) && (id == "" || item.ID == id)
+			})
+			if len(purged) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			b.purgeRetained(ctx, purged)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
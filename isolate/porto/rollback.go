@@ -0,0 +1,167 @@
+package porto
+
+import (
+	"sync"
+
+	apexlog "github.com/apex/log"
+	portorpc "github.com/yandex/porto/src/api/go/rpc"
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/pkg/log"
+)
+
+// layerRefs counts spools and spawns in progress relying on layers,
+// so neither a rollback nor the collector removes a layer which is
+// about to be referenced by the journal or a container
+type layerRefs struct {
+	mu   sync.Mutex
+	refs map[string]int
+	// layers being removed by a rollback can not be referenced
+	// until the removal is over, removed is broadcast then
+	removing map[string]bool
+	removed  *sync.Cond
+}
+
+func newLayerRefs() *layerRefs {
+	r := &layerRefs{
+		refs:     make(map[string]int),
+		removing: make(map[string]bool),
+	}
+	r.removed = sync.NewCond(&r.mu)
+	return r
+}
+
+func (r *layerRefs) ref(layers ...string) {
+	r.mu.Lock()
+	for _, layer := range layers {
+		for r.removing[layer] {
+			r.removed.Wait()
+		}
+		r.refs[layer]++
+	}
+	r.mu.Unlock()
+}
+
+func (r *layerRefs) release(layers []string) {
+	r.mu.Lock()
+	r.unref(layers)
+	r.mu.Unlock()
+}
+
+// has must be called with r.mu held
+func (r *layerRefs) has(layer string) bool {
+	return r.refs[layer] > 0
+}
+
+// markRemoving marks unreferenced layers as being removed and returns them.
+// It must be called with r.mu held.
+func (r *layerRefs) markRemoving(layers []string) []string {
+	var marked []string
+	for _, layer := range layers {
+		if !r.has(layer) && !r.removing[layer] {
+			r.removing[layer] = true
+			marked = append(marked, layer)
+		}
+	}
+	return marked
+}
+
+func (r *layerRefs) unmarkRemoving(layers []string) {
+	r.mu.Lock()
+	for _, layer := range layers {
+		delete(r.removing, layer)
+	}
+	r.mu.Unlock()
+	r.removed.Broadcast()
+}
+
+// unref must be called with r.mu held
+func (r *layerRefs) unref(layers []string) {
+	for _, layer := range layers {
+		if r.refs[layer]--; r.refs[layer] <= 0 {
+			delete(r.refs, layer)
+		}
+	}
+}
+
+// layerTx collects layers imported by a spool to remove them if it fails
+type layerTx struct {
+	b *Box
+	// all layers the spool relies on
+	used []string
+	// layers created by the spool
+	imported []string
+}
+
+func (b *Box) newLayerTx() *layerTx {
+	return &layerTx{b: b}
+}
+
+// use protects the layer from removal until the spool is finished.
+// It's called before the blob is fetched, as the collector removes blobs too.
+func (tx *layerTx) use(layer string) {
+	if contains(tx.used, layer) {
+		return
+	}
+	tx.b.layerRefs.ref(layer)
+	tx.used = append(tx.used, layer)
+}
+
+func (tx *layerTx) importLayer(ctx context.Context, layer, blobPath string) error {
+	tx.use(layer)
+	created, err := tx.b.importLayer(ctx, layer, blobPath)
+	if created {
+		tx.imported = append(tx.imported, layer)
+	}
+	return err
+}
+
+// finish removes the imported layers if the spool has failed. Layers referenced
+// by the journal, tracked containers or other spools in progress are kept.
+// Porto is called without the lock of refs: the layers are marked as being
+// removed instead, so nobody can start to rely on them meanwhile.
+func (tx *layerTx) finish(ctx context.Context, spoolErr error) {
+	refs := tx.b.layerRefs
+	refs.mu.Lock()
+	refs.unref(tx.used)
+	var removing []string
+	if spoolErr != nil {
+		removing = refs.markRemoving(tx.imported)
+	}
+	refs.mu.Unlock()
+	if len(removing) == 0 {
+		return
+	}
+	defer refs.unmarkRemoving(removing)
+
+	// Whoever has referenced a layer before it was marked has put it
+	// into the journal or a tracked container by now
+	referenced := tx.b.journal.ReferencedLayers()
+	_, running := tx.b.runningLayers()
+	for _, layer := range running {
+		referenced[layer] = struct{}{}
+	}
+
+	// the context of the spool is likely to be cancelled
+	ctx = log.WithLogger(context.Background(), log.G(ctx))
+	portoConn, err := tx.b.conns.Get(ctx)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("unable to roll back layers %v imported by the failed spool", removing)
+		return
+	}
+	defer portoConn.Close()
+
+	for _, layer := range removing {
+		logger := log.G(ctx).WithFields(apexlog.Fields{"layer": layer, "reason": spoolErr})
+		if _, ok := referenced[layer]; ok {
+			logger.Debug("the layer imported by the failed spool is in use")
+			continue
+		}
+		if err = portoConn.RemoveLayer(layer); err != nil && !isEqualPortoError(err, portorpc.EError_LayerNotFound) {
+			logger.WithError(err).Warn("unable to remove the layer imported by the failed spool")
+			continue
+		}
+		layersRolledBackCounter.Inc(1)
+		logger.Info("the layer imported by the failed spool has been removed")
+	}
+}
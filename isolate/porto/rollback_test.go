@@ -0,0 +1,38 @@
+package porto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayerRefsWaitForRemoval(t *testing.T) {
+	require := require.New(t)
+	refs := newLayerRefs()
+
+	refs.ref("used")
+	refs.mu.Lock()
+	removing := refs.markRemoving([]string{"used", "unused"})
+	refs.mu.Unlock()
+	require.Equal([]string{"unused"}, removing)
+
+	// a layer being removed can not be referenced until the removal is over
+	referenced := make(chan struct{})
+	go func() {
+		refs.ref("unused")
+		close(referenced)
+	}()
+	select {
+	case <-referenced:
+		t.Fatal("the layer has been referenced while it is being removed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	refs.unmarkRemoving(removing)
+	<-referenced
+	refs.mu.Lock()
+	defer refs.mu.Unlock()
+	require.True(refs.has("unused"))
+	require.Empty(refs.markRemoving([]string{"used", "unused"}))
+}
@@ -0,0 +1,99 @@
+package porto
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/pkg/ratelimit"
+)
+
+// spawnRateConfig limits how often containers are started.
+// It's independent of the concurrency of spawns.
+type spawnRateConfig struct {
+	// Containers started per second, zero disables the limit
+	Rate float64 `json:"rate"`
+	// How many containers can be started at once after idle time
+	Burst uint `json:"burst"`
+	// The same limits applied to every app separately
+	PerAppRate  float64 `json:"per_app_rate"`
+	PerAppBurst uint    `json:"per_app_burst"`
+}
+
+func (c *spawnRateConfig) validate() error {
+	if c.Rate < 0 {
+		return fmt.Errorf("spawn rate must not be negative: %v", c.Rate)
+	}
+	if c.PerAppRate < 0 {
+		return fmt.Errorf("per app spawn rate must not be negative: %v", c.PerAppRate)
+	}
+	return nil
+}
+
+// spawnLimiter throttles starts of containers globally and per app
+type spawnLimiter struct {
+	config spawnRateConfig
+	global *ratelimit.Limiter
+
+	mu   sync.Mutex
+	apps map[string]*ratelimit.Limiter
+}
+
+func newSpawnLimiter(config spawnRateConfig) *spawnLimiter {
+	l := &spawnLimiter{
+		config: config,
+		apps:   make(map[string]*ratelimit.Limiter),
+	}
+	if config.Rate > 0 {
+		l.global = ratelimit.New(config.Rate, config.Burst)
+	}
+	return l
+}
+
+func (l *spawnLimiter) app(name string) *ratelimit.Limiter {
+	if l.config.PerAppRate <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limiter, ok := l.apps[name]
+	if !ok {
+		l.prune()
+		limiter = ratelimit.New(l.config.PerAppRate, l.config.PerAppBurst)
+		l.apps[name] = limiter
+	}
+	return limiter
+}
+
+// prune forgets limits of idle apps, their buckets are full
+// as if they were new. It must be called with l.mu held.
+func (l *spawnLimiter) prune() {
+	for name, limiter := range l.apps {
+		if limiter.Full() {
+			delete(l.apps, name)
+		}
+	}
+}
+
+// Wait blocks until a container of the app is allowed to start.
+// The limit of the app is waited for first, so a single app
+// can not drain tokens of the global limit. The token of the app
+// is returned if the global limit is not passed.
+func (l *spawnLimiter) Wait(ctx context.Context, app string) error {
+	limiter := l.app(app)
+	if limiter != nil {
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if l.global != nil {
+		if err := l.global.Wait(ctx); err != nil {
+			if limiter != nil {
+				limiter.Return()
+			}
+			return err
+		}
+	}
+	return nil
+}
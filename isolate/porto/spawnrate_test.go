@@ -0,0 +1,48 @@
+package porto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestSpawnLimiter(t *testing.T) {
+	require := require.New(t)
+
+	// no limits by default
+	limiter := newSpawnLimiter(spawnRateConfig{})
+	for i := 0; i < 100; i++ {
+		require.NoError(limiter.Wait(context.Background(), "app"))
+	}
+
+	limiter = newSpawnLimiter(spawnRateConfig{Rate: 100, Burst: 10, PerAppRate: 1, PerAppBurst: 1})
+	require.NoError(limiter.Wait(context.Background(), "app"))
+	// other apps are not throttled by the limit of the app
+	require.NoError(limiter.Wait(context.Background(), "other"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.Equal(context.DeadlineExceeded, limiter.Wait(ctx, "app"))
+
+	// the token of the app is returned if the global limit is not passed
+	limiter = newSpawnLimiter(spawnRateConfig{Rate: 1, Burst: 1, PerAppRate: 0.001, PerAppBurst: 1})
+	require.NoError(limiter.Wait(context.Background(), "other"))
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.Equal(context.DeadlineExceeded, limiter.Wait(ctx, "app"))
+	require.True(limiter.app("app").Full())
+
+	// limits of idle apps are forgotten once another app comes
+	limiter = newSpawnLimiter(spawnRateConfig{PerAppRate: 1000, PerAppBurst: 1})
+	require.NoError(limiter.Wait(context.Background(), "app"))
+	require.True(eventually(func() bool { return limiter.app("app").Full() }))
+	require.NoError(limiter.Wait(context.Background(), "other"))
+	limiter.mu.Lock()
+	require.Len(limiter.apps, 1)
+	limiter.mu.Unlock()
+
+	require.Error((&spawnRateConfig{Rate: -1}).validate())
+	require.Error((&spawnRateConfig{PerAppRate: -1}).validate())
+}
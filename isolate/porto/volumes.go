@@ -0,0 +1,505 @@
+package porto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	porto "github.com/yandex/porto/src/api/go"
+	"golang.org/x/net/context"
+
+	"github.com/interiorem/stout/pkg/log"
+)
+
+// Access modes of named volumes
+const (
+	// only one container of the app uses the volume at once
+	volumeExclusive = "exclusive"
+	// containers of the app using the volume in shared mode run simultaneously
+	volumeShared = "shared"
+
+	// an unused volume is kept until it's deleted via HTTP
+	retentionForever = "forever"
+
+	namedVolumeMetaFile = "volume.json"
+	namedVolumeDataDir  = "data"
+
+	defaultNamedVolumesSweepPeriod = 600
+)
+
+var (
+	errNamedVolumeNotFound = errors.New("named volume does not exist")
+	errNamedVolumeInUse    = errors.New("named volume is in use")
+
+	namedVolumeNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+type namedVolumesConfig struct {
+	// Directory for data of named volumes. They are disabled if it's empty
+	Dir string `json:"dir"`
+	// space_limit of a volume unless the profile sets it
+	DefaultSpaceLimit string `json:"default_space_limit"`
+	// The largest space_limit a profile may set. Empty means no limit
+	MaxSpaceLimit string `json:"max_space_limit"`
+	// Retention of a volume unless the profile sets it: forever or a duration
+	DefaultRetention string `json:"default_retention"`
+	// How often unused volumes are checked for expiration
+	SweepPeriodSec uint `json:"sweep_period_sec"`
+}
+
+// namedVolumeInfo is stored next to the data of a volume
+type namedVolumeInfo struct {
+	App        string    `json:"app"`
+	Name       string    `json:"name"`
+	Access     string    `json:"access"`
+	Retention  string    `json:"retention"`
+	SpaceLimit string    `json:"space_limit,omitempty"`
+	Created    time.Time `json:"created"`
+	LastUsed   time.Time `json:"last_used"`
+}
+
+// namedVolumeStatus is reported by the HTTP endpoint
+type namedVolumeStatus struct {
+	namedVolumeInfo
+	// containers which use the volume now
+	Users []string `json:"users"`
+}
+
+type namedVolumeKey struct {
+	app, name string
+}
+
+type namedVolumeEntry struct {
+	info  namedVolumeInfo
+	dir   string
+	users map[string]bool
+}
+
+// namedVolumes keeps data of named extra volumes of apps between workers
+// and restarts of the daemon. Data of a volume is placed into <dir>/<app>/<name>/data.
+type namedVolumes struct {
+	config namedVolumesConfig
+
+	maxSpaceLimit uint64
+
+	mu      sync.Mutex
+	volumes map[namedVolumeKey]*namedVolumeEntry
+}
+
+func newNamedVolumes(ctx context.Context, config namedVolumesConfig) (*namedVolumes, error) {
+	if config.SweepPeriodSec == 0 {
+		config.SweepPeriodSec = defaultNamedVolumesSweepPeriod
+	}
+	if config.DefaultRetention == "" {
+		config.DefaultRetention = retentionForever
+	}
+	if _, err := parseRetention(config.DefaultRetention); err != nil {
+		return nil, err
+	}
+
+	v := &namedVolumes{
+		config:  config,
+		volumes: make(map[namedVolumeKey]*namedVolumeEntry),
+	}
+
+	if config.MaxSpaceLimit != "" {
+		limit, err := parseSpaceLimit(config.MaxSpaceLimit)
+		if err != nil {
+			return nil, err
+		}
+		v.maxSpaceLimit = limit
+	}
+	if config.DefaultSpaceLimit != "" {
+		if err := v.checkSpaceLimit(config.DefaultSpaceLimit); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := v.load(ctx); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// load reads metadata of the volumes created before restart
+func (v *namedVolumes) load(ctx context.Context) error {
+	metas, err := filepath.Glob(filepath.Join(v.config.Dir, "*", "*", namedVolumeMetaFile))
+	if err != nil {
+		return err
+	}
+
+	for _, meta := range metas {
+		body, err := ioutil.ReadFile(meta)
+		if err != nil {
+			return err
+		}
+		var info namedVolumeInfo
+		if err = json.Unmarshal(body, &info); err != nil {
+			log.G(ctx).WithError(err).WithField("volume", meta).Warn("skip the volume with broken metadata")
+			continue
+		}
+		v.volumes[namedVolumeKey{info.App, info.Name}] = &namedVolumeEntry{
+			info:  info,
+			dir:   filepath.Dir(meta),
+			users: make(map[string]bool),
+		}
+	}
+	namedVolumesGauge.Update(int64(len(v.volumes)))
+	return nil
+}
+
+func parseRetention(retention string) (time.Duration, error) {
+	if retention == retentionForever {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(retention)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid retention %q, expected %s or a positive duration", retention, retentionForever)
+	}
+	return ttl, nil
+}
+
+// parseSpaceLimit parses sizes in Porto format: bytes with an optional K, M, G, T suffix
+func parseSpaceLimit(limit string) (uint64, error) {
+	value := strings.TrimSpace(limit)
+	var shift uint
+	if n := len(value); n > 0 {
+		switch value[n-1] {
+		case 'k', 'K':
+			shift = 10
+		case 'm', 'M':
+			shift = 20
+		case 'g', 'G':
+			shift = 30
+		case 't', 'T':
+			shift = 40
+		}
+		if shift > 0 {
+			value = strings.TrimSpace(value[:n-1])
+		}
+	}
+	size, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || size > (^uint64(0))>>shift {
+		return 0, fmt.Errorf("invalid space limit %q", limit)
+	}
+	return size << shift, nil
+}
+
+func (v *namedVolumes) checkSpaceLimit(limit string) error {
+	size, err := parseSpaceLimit(limit)
+	if err != nil {
+		return err
+	}
+	if v.maxSpaceLimit > 0 && (size == 0 || size > v.maxSpaceLimit) {
+		return fmt.Errorf("space limit %s exceeds the maximum %s", limit, v.config.MaxSpaceLimit)
+	}
+	return nil
+}
+
+// validate checks the options of a named volume of a profile
+func (v *namedVolumes) validate(profile VolumeProfile) error {
+	if !namedVolumeNameRe.MatchString(profile.Name) {
+		return fmt.Errorf("invalid volume name %q", profile.Name)
+	}
+	switch profile.Access {
+	case "", volumeExclusive, volumeShared:
+	default:
+		return fmt.Errorf("unknown access mode %q of volume %s, expected %s or %s", profile.Access, profile.Name, volumeExclusive, volumeShared)
+	}
+	if profile.Retention != "" {
+		if _, err := parseRetention(profile.Retention); err != nil {
+			return err
+		}
+	}
+	if limit := profile.Properties["space_limit"]; limit != "" {
+		return v.checkSpaceLimit(limit)
+	}
+	return nil
+}
+
+// options returns the effective access, retention and space limit of the volume
+func (v *namedVolumes) options(profile VolumeProfile) (access, retention, spaceLimit string) {
+	access, retention, spaceLimit = profile.Access, profile.Retention, profile.Properties["space_limit"]
+	if access == "" {
+		access = volumeExclusive
+	}
+	if retention == "" {
+		retention = v.config.DefaultRetention
+	}
+	if spaceLimit == "" {
+		spaceLimit = v.config.DefaultSpaceLimit
+	}
+	return access, retention, spaceLimit
+}
+
+func (v *namedVolumes) volumeDir(app, name string) string {
+	return filepath.Join(v.config.Dir, escapeVolumeApp(app), name)
+}
+
+// escapeVolumeApp turns an app name into a single path element:
+// separators and other unsafe bytes are %-escaped the way url.PathEscape
+// escapes a path segment, and "." or ".." can not point outside of the dir.
+func escapeVolumeApp(app string) string {
+	const hex = "0123456789ABCDEF"
+	escaped := make([]byte, 0, len(app))
+	for i := 0; i < len(app); i++ {
+		c := app[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			strings.IndexByte("-_.~$&+,:;=@", c) >= 0 {
+			escaped = append(escaped, c)
+			continue
+		}
+		escaped = append(escaped, '%', hex[c>>4], hex[c&15])
+	}
+	if app == "." || app == ".." {
+		return strings.Replace(app, ".", "%2E", -1)
+	}
+	return string(escaped)
+}
+
+func (e *namedVolumeEntry) save() error {
+	body, err := json.Marshal(e.info)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(e.dir, namedVolumeMetaFile), body, 0644)
+}
+
+func (e *namedVolumeEntry) status() namedVolumeStatus {
+	status := namedVolumeStatus{namedVolumeInfo: e.info, Users: make([]string, 0, len(e.users))}
+	for user := range e.users {
+		status.Users = append(status.Users, user)
+	}
+	sort.Strings(status.Users)
+	return status
+}
+
+// Acquire creates the volume if needed and registers the container as its user.
+// It returns the storage directory and the space limit of the volume.
+func (v *namedVolumes) Acquire(app string, profile VolumeProfile, containerID string) (storage, spaceLimit string, err error) {
+	if err = v.validate(profile); err != nil {
+		return "", "", err
+	}
+	access, retention, spaceLimit := v.options(profile)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key := namedVolumeKey{app, profile.Name}
+	entry, ok := v.volumes[key]
+	if !ok {
+		entry = &namedVolumeEntry{
+			info: namedVolumeInfo{
+				App:     app,
+				Name:    profile.Name,
+				Created: time.Now(),
+			},
+			dir:   v.volumeDir(app, profile.Name),
+			users: make(map[string]bool),
+		}
+		if err = os.MkdirAll(filepath.Join(entry.dir, namedVolumeDataDir), 0755); err != nil {
+			return "", "", err
+		}
+	}
+
+	if len(entry.users) > 0 && (access == volumeExclusive || entry.info.Access == volumeExclusive) {
+		return "", "", fmt.Errorf("volume %s of %s is used by %d containers: %v", profile.Name, app, len(entry.users), errNamedVolumeInUse)
+	}
+
+	entry.info.Access = access
+	entry.info.Retention = retention
+	entry.info.SpaceLimit = spaceLimit
+	entry.info.LastUsed = time.Now()
+	if err = entry.save(); err != nil {
+		return "", "", err
+	}
+
+	entry.users[containerID] = true
+	if !ok {
+		v.volumes[key] = entry
+		namedVolumesGauge.Update(int64(len(v.volumes)))
+	}
+	return filepath.Join(entry.dir, namedVolumeDataDir), spaceLimit, nil
+}
+
+// adopt registers a running container as a user of the volume after restart
+func (v *namedVolumes) adopt(app, name, containerID string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if entry, ok := v.volumes[namedVolumeKey{app, name}]; ok {
+		entry.users[containerID] = true
+	}
+}
+
+// Release unregisters the container. The data is kept according to the retention.
+func (v *namedVolumes) Release(ctx context.Context, app, name, containerID string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	entry, ok := v.volumes[namedVolumeKey{app, name}]
+	if !ok || !entry.users[containerID] {
+		return
+	}
+	delete(entry.users, containerID)
+	entry.info.LastUsed = time.Now()
+	if err := entry.save(); err != nil {
+		log.G(ctx).WithError(err).WithField("volume", entry.dir).Warn("unable to save the last usage time of the volume")
+	}
+}
+
+// List returns volumes of the app or all of them if app is empty
+func (v *namedVolumes) List(app string) []namedVolumeStatus {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	volumes := make([]namedVolumeStatus, 0, len(v.volumes))
+	for key, entry := range v.volumes {
+		if app == "" || key.app == app {
+			volumes = append(volumes, entry.status())
+		}
+	}
+	sort.Sort(byAppAndName(volumes))
+	return volumes
+}
+
+type byAppAndName []namedVolumeStatus
+
+func (b byAppAndName) Len() int      { return len(b) }
+func (b byAppAndName) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byAppAndName) Less(i, j int) bool {
+	if b[i].App != b[j].App {
+		return b[i].App < b[j].App
+	}
+	return b[i].Name < b[j].Name
+}
+
+// Delete removes the data of an unused volume
+func (v *namedVolumes) Delete(app, name string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.remove(namedVolumeKey{app, name})
+}
+
+func (v *namedVolumes) remove(key namedVolumeKey) error {
+	entry, ok := v.volumes[key]
+	if !ok {
+		return errNamedVolumeNotFound
+	}
+	if len(entry.users) > 0 {
+		return errNamedVolumeInUse
+	}
+	if err := os.RemoveAll(entry.dir); err != nil {
+		return err
+	}
+	delete(v.volumes, key)
+	namedVolumesGauge.Update(int64(len(v.volumes)))
+	namedVolumesRemovedCounter.Inc(1)
+	return nil
+}
+
+// sweep removes unused volumes whose retention has expired
+func (v *namedVolumes) sweep(ctx context.Context, now time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for key, entry := range v.volumes {
+		ttl, err := parseRetention(entry.info.Retention)
+		if err != nil || ttl == 0 || len(entry.users) > 0 || now.Sub(entry.info.LastUsed) < ttl {
+			continue
+		}
+		logger := log.G(ctx).WithField("volume", entry.dir)
+		if err = v.remove(key); err != nil {
+			logger.WithError(err).Error("unable to remove the expired volume")
+			continue
+		}
+		logger.Infof("the volume has been unused for %s and removed", now.Sub(entry.info.LastUsed))
+	}
+}
+
+func (v *namedVolumes) run(ctx context.Context) {
+	period := time.Duration(v.config.SweepPeriodSec) * time.Second
+	log.G(ctx).Infof("remove expired named volumes every %s", period)
+	for {
+		select {
+		case <-time.After(period):
+			v.sweep(ctx, time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ServeHTTP lists volumes on GET and deletes an unused volume on DELETE.
+// Both accept the `app` query argument, DELETE requires `name` as well.
+func (v *namedVolumes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	app, name := r.URL.Query().Get("app"), r.URL.Query().Get("name")
+	switch r.Method {
+	case "GET", "HEAD":
+		body, err := json.Marshal(v.List(app))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	case "DELETE":
+		if app == "" || name == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "query args app and name must be set")
+			return
+		}
+		switch err := v.Delete(app, name); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errNamedVolumeNotFound:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, err)
+		case errNamedVolumeInUse:
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintln(w, err)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, err)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// namedVolume is an extra volume whose storage outlives the container
+type namedVolume struct {
+	portoVolume
+
+	volumes *namedVolumes
+	app     string
+	name    string
+}
+
+// Destroy unlinks the volume and keeps its data
+func (v *namedVolume) Destroy(ctx context.Context, portoConn porto.API) error {
+	v.portoVolume.unlink(ctx, portoConn)
+	v.release(ctx)
+	// the mount point is empty unless the volume is still mounted
+	if err := os.Remove(v.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (v *namedVolume) release(ctx context.Context) {
+	if v.volumes != nil {
+		v.volumes.Release(ctx, v.app, v.name, v.cID)
+	}
+}
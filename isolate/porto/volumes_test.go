@@ -0,0 +1,184 @@
+package porto
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestParseSpaceLimit(t *testing.T) {
+	for limit, size := range map[string]uint64{
+		"0":      0,
+		"1024":   1024,
+		"10K":    10 << 10,
+		"512M":   512 << 20,
+		"2 G":    2 << 30,
+		"1t":     1 << 40,
+		" 100 ":  100,
+		"16384G": 16384 << 30,
+	} {
+		parsed, err := parseSpaceLimit(limit)
+		require.NoError(t, err, limit)
+		assert.Equal(t, size, parsed, limit)
+	}
+
+	for _, limit := range []string{"", "G", "1.5G", "-1", "10P", "99999999999999999999T"} {
+		_, err := parseSpaceLimit(limit)
+		assert.Error(t, err, limit)
+	}
+}
+
+func TestNamedVolumes(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "namedvolumes")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := namedVolumesConfig{Dir: dir, DefaultSpaceLimit: "1G", MaxSpaceLimit: "10G"}
+	volumes, err := newNamedVolumes(ctx, config)
+	require.NoError(err)
+
+	for _, invalid := range []VolumeProfile{
+		{Name: "../cache"},
+		{Name: "cache", Access: "readonly"},
+		{Name: "cache", Retention: "week"},
+		{Name: "cache", Properties: map[string]string{"space_limit": "20G"}},
+	} {
+		require.Error(volumes.validate(invalid), "%v", invalid)
+	}
+
+	exclusive := VolumeProfile{Target: "/cache", Name: "cache"}
+	storage, spaceLimit, err := volumes.Acquire("app:1", exclusive, "c1")
+	require.NoError(err)
+	require.Equal(filepath.Join(dir, "app:1", "cache", "data"), storage)
+	require.Equal("1G", spaceLimit)
+	require.NoError(ioutil.WriteFile(filepath.Join(storage, "state"), []byte("data"), 0644))
+
+	// an exclusive volume is used by one container at once
+	_, _, err = volumes.Acquire("app:1", exclusive, "c2")
+	require.Error(err)
+	_, _, err = volumes.Acquire("app:1", VolumeProfile{Name: "cache", Access: volumeShared}, "c2")
+	require.Error(err)
+	require.Equal(errNamedVolumeInUse, volumes.Delete("app:1", "cache"))
+
+	volumes.Release(ctx, "app:1", "cache", "c1")
+	storage, _, err = volumes.Acquire("app:1", exclusive, "c2")
+	require.NoError(err)
+	volumes.Release(ctx, "app:1", "cache", "c2")
+
+	shared := VolumeProfile{Name: "shared", Access: volumeShared, Retention: "1h", Properties: map[string]string{"space_limit": "2G"}}
+	_, spaceLimit, err = volumes.Acquire("app:1", shared, "c1")
+	require.NoError(err)
+	require.Equal("2G", spaceLimit)
+	_, _, err = volumes.Acquire("app:1", shared, "c2")
+	require.NoError(err)
+
+	list := volumes.List("")
+	require.Len(list, 2)
+	require.Equal("cache", list[0].Name)
+	require.Equal(volumeExclusive, list[0].Access)
+	require.Equal(retentionForever, list[0].Retention)
+	require.Empty(list[0].Users)
+	require.Equal("shared", list[1].Name)
+	require.Equal([]string{"c1", "c2"}, list[1].Users)
+	require.Empty(volumes.List("other"))
+
+	// volumes and their data survive restart
+	restarted, err := newNamedVolumes(ctx, config)
+	require.NoError(err)
+	require.Len(restarted.List("app:1"), 2)
+	restarted.adopt("app:1", "shared", "c1")
+	data, err := ioutil.ReadFile(filepath.Join(storage, "state"))
+	require.NoError(err)
+	require.Equal("data", string(data))
+
+	// only unused volumes expire
+	restarted.sweep(ctx, time.Now().Add(2*time.Hour))
+	require.Len(restarted.List(""), 2)
+	restarted.Release(ctx, "app:1", "shared", "c1")
+	restarted.sweep(ctx, time.Now().Add(30*time.Minute))
+	require.Len(restarted.List(""), 2)
+	restarted.sweep(ctx, time.Now().Add(2*time.Hour))
+	require.Len(restarted.List(""), 1)
+	_, err = os.Stat(filepath.Join(dir, "app:1", "shared"))
+	require.True(os.IsNotExist(err))
+
+	require.NoError(restarted.Delete("app:1", "cache"))
+	require.Equal(errNamedVolumeNotFound, restarted.Delete("app:1", "cache"))
+	_, err = os.Stat(storage)
+	require.True(os.IsNotExist(err))
+}
+
+func TestNamedVolumesEscapeAppNames(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "namedvolumes")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	volumes, err := newNamedVolumes(ctx, namedVolumesConfig{Dir: dir})
+	require.NoError(err)
+
+	for app, escaped := range map[string]string{
+		"app:1":       "app:1",
+		"../../etc":   "..%2F..%2Fetc",
+		"..":          "%2E%2E",
+		".":           "%2E",
+		"a/b":         "a%2Fb",
+		"a b%":        "a%20b%25",
+		"..hidden/..": "..hidden%2F..",
+	} {
+		require.Equal(escaped, escapeVolumeApp(app), app)
+		storage, _, err := volumes.Acquire(app, VolumeProfile{Name: "cache"}, "c1")
+		require.NoError(err)
+		require.Equal(filepath.Join(dir, escaped, "cache", "data"), storage)
+		require.Equal(dir, filepath.Dir(filepath.Dir(filepath.Dir(storage))), app)
+	}
+	require.Len(volumes.List(""), 7)
+}
+
+func TestNamedVolumesHTTP(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "namedvolumes")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	volumes, err := newNamedVolumes(ctx, namedVolumesConfig{Dir: dir})
+	require.NoError(err)
+	_, _, err = volumes.Acquire("app", VolumeProfile{Name: "cache"}, "c1")
+	require.NoError(err)
+
+	serve := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		volumes.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		return w
+	}
+
+	w := serve("GET", "/volumes/porto?app=app")
+	require.Equal(http.StatusOK, w.Code)
+	var list []namedVolumeStatus
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(list, 1)
+	require.Equal([]string{"c1"}, list[0].Users)
+
+	require.Equal(http.StatusBadRequest, serve("DELETE", "/volumes/porto?app=app").Code)
+	require.Equal(http.StatusConflict, serve("DELETE", "/volumes/porto?app=app&name=cache").Code)
+	volumes.Release(ctx, "app", "cache", "c1")
+	require.Equal(http.StatusNoContent, serve("DELETE", "/volumes/porto?app=app&name=cache").Code)
+	require.Equal(http.StatusNotFound, serve("DELETE", "/volumes/porto?app=app&name=cache").Code)
+	require.Equal(http.StatusMethodNotAllowed, serve("POST", "/volumes/porto").Code)
+}
@@ -0,0 +1,85 @@
+// Package fetcher defines the protocol of external layer fetchers.
+//
+// A fetcher is an executable started once per layer. It reads a Request
+// encoded as JSON from stdin, saves the layer to Request.Destination and
+// reports to stdout with Events, one JSON object per line: any number of
+// progress events followed by a single done or error event. A line must not
+// exceed 64 KiB, otherwise the fetcher is killed. The layer is
+// fetched only if the fetcher has reported done and exited with zero status.
+// Stderr of the fetcher is logged on failures.
+//
+// The fetcher is killed if it has not finished within Request.TimeoutSec
+// or the fetch is cancelled. The digest of the layer is verified by the
+// caller, so the fetcher is not required to do it.
+package fetcher
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Types of events
+const (
+	EventProgress = "progress"
+	EventDone     = "done"
+	EventError    = "error"
+)
+
+// Request describes the layer to fetch
+type Request struct {
+	// Hex encoded digest of the layer and its algorithm, like sha256
+	Digest     string `json:"digest"`
+	DigestType string `json:"digest_type"`
+	// Size in bytes, zero if unknown
+	Size uint64 `json:"size"`
+	// Location of the layer from its metadata in the profile
+	Source    string `json:"source,omitempty"`
+	TorrentID string `json:"torrent_id,omitempty"`
+	// Path to save the layer to
+	Destination string `json:"destination"`
+	TimeoutSec  uint   `json:"timeout_sec"`
+}
+
+// Event is reported by the fetcher
+type Event struct {
+	Type string `json:"type"`
+	// Bytes fetched so far and the total size if it's known
+	Bytes uint64 `json:"bytes,omitempty"`
+	Total uint64 `json:"total,omitempty"`
+	// Description of the failure
+	Message string `json:"message,omitempty"`
+}
+
+// ReadRequest decodes the request from stdin of the fetcher
+func ReadRequest(r io.Reader) (*Request, error) {
+	req := new(Request)
+	if err := json.NewDecoder(r).Decode(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// Reporter writes events to stdout of the fetcher
+type Reporter struct {
+	enc *json.Encoder
+}
+
+// NewReporter returns a Reporter writing to w
+func NewReporter(w io.Writer) *Reporter {
+	return &Reporter{enc: json.NewEncoder(w)}
+}
+
+// Progress reports how many bytes have been fetched
+func (r *Reporter) Progress(bytes, total uint64) error {
+	return r.enc.Encode(Event{Type: EventProgress, Bytes: bytes, Total: total})
+}
+
+// Done reports the layer has been fetched
+func (r *Reporter) Done() error {
+	return r.enc.Encode(Event{Type: EventDone})
+}
+
+// Error reports the failure
+func (r *Reporter) Error(err error) error {
+	return r.enc.Encode(Event{Type: EventError, Message: err.Error()})
+}
@@ -0,0 +1,82 @@
+package fetcher
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// progressStep is how often the local fetcher reports its progress
+const progressStep = 4 << 20
+
+// Local fetches layers from a directory. The layer is looked up by its
+// source relative to the directory or by its digest if the source is empty.
+// It's used for tests and hosts with pre-seeded layers.
+type Local struct {
+	Dir string
+}
+
+// Serve handles a single request according to the protocol
+func (l *Local) Serve(stdin io.Reader, stdout io.Writer) error {
+	reporter := NewReporter(stdout)
+	req, err := ReadRequest(stdin)
+	if err == nil {
+		err = l.fetch(req, reporter)
+	}
+	if err != nil {
+		reporter.Error(err)
+		return err
+	}
+	return reporter.Done()
+}
+
+func (l *Local) path(req *Request) (string, error) {
+	name := req.Source
+	if name == "" {
+		name = req.Digest
+	}
+	path := filepath.Join(l.Dir, filepath.Clean("/"+name))
+	if name == "" || !strings.HasPrefix(path, filepath.Clean(l.Dir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid source %q", name)
+	}
+	return path, nil
+}
+
+func (l *Local) fetch(req *Request, reporter *Reporter) error {
+	path, err := l.path(req)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(req.Destination)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	var copied uint64
+	for {
+		n, err := io.CopyN(dst, src, progressStep)
+		copied += uint64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err = reporter.Progress(copied, req.Size); err != nil {
+			return err
+		}
+	}
+	if err = reporter.Progress(copied, req.Size); err != nil {
+		return err
+	}
+	return dst.Sync()
+}
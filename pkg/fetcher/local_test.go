@@ -0,0 +1,69 @@
+package fetcher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func serve(t *testing.T, l *Local, req Request) ([]Event, error) {
+	body, err := json.Marshal(req)
+	require.NoError(t, err)
+	var stdout bytes.Buffer
+	serveErr := l.Serve(bytes.NewReader(body), &stdout)
+
+	var events []Event
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		var event Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	return events, serveErr
+}
+
+func TestLocal(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "fetcher")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	content := []byte(strings.Repeat("layer", 1<<20))
+	require.NoError(os.MkdirAll(filepath.Join(dir, "src", "app"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "src", "0123"), content, 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "src", "app", "layer.tar"), content, 0644))
+	local := &Local{Dir: filepath.Join(dir, "src")}
+
+	// by digest
+	destination := filepath.Join(dir, "fetched")
+	events, err := serve(t, local, Request{Digest: "0123", Size: uint64(len(content)), Destination: destination})
+	require.NoError(err)
+	require.Equal(EventProgress, events[0].Type)
+	require.Equal(Event{Type: EventProgress, Bytes: uint64(len(content)), Total: uint64(len(content))}, events[len(events)-2])
+	require.Equal(Event{Type: EventDone}, events[len(events)-1])
+	fetched, err := ioutil.ReadFile(destination)
+	require.NoError(err)
+	require.Equal(content, fetched)
+
+	// by source
+	_, err = serve(t, local, Request{Digest: "4567", Source: "app/layer.tar", Destination: destination})
+	require.NoError(err)
+
+	for _, req := range []Request{
+		{Digest: "4567", Destination: destination},
+		{Source: "../fetched", Destination: destination},
+		{Digest: "0123", Destination: filepath.Join(dir, "absent", "fetched")},
+	} {
+		events, err = serve(t, local, req)
+		require.Error(err, "%v", req)
+		require.Equal(EventError, events[len(events)-1].Type)
+		require.Equal(err.Error(), events[len(events)-1].Message)
+	}
+}
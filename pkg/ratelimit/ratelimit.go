@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Limiter is a token bucket: it's refilled with rate tokens per second
+// up to burst tokens, and every Wait takes one token
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// New returns a full bucket. rate must be positive, burst is at least 1
+func New(rate float64, burst uint) *Limiter {
+	if rate <= 0 {
+		panic("ratelimit: rate must be positive")
+	}
+	if burst == 0 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// refill adds tokens for the time passed, it must be called with l.mu held
+func (l *Limiter) refill() {
+	now := l.now()
+	if now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+	}
+}
+
+// reserve takes a token and returns how long to wait until it's available.
+// The number of tokens becomes negative if waiters are queued.
+func (l *Limiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Return gives back a token which has not been used,
+// e.g. when the action of the caller of Wait has been cancelled
+func (l *Limiter) Return() {
+	l.mu.Lock()
+	l.tokens++
+	l.mu.Unlock()
+}
+
+// Full reports whether the bucket has been refilled up to the burst,
+// i.e. the limiter is as good as a new one
+func (l *Limiter) Full() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	return l.tokens >= l.burst
+}
+
+// Wait blocks until a token is available or the context is done
+func (l *Limiter) Wait(ctx context.Context) error {
+	delay := l.reserve()
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.Return()
+		return ctx.Err()
+	}
+}
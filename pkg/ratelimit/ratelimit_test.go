@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestLimiter(t *testing.T) {
+	l := New(10, 2)
+	now := l.last
+	l.now = func() time.Time { return now }
+
+	if !l.Full() {
+		t.Fatal("a new bucket must be full")
+	}
+	// the burst is available at once
+	for _, expected := range []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		if delay := l.reserve(); delay != expected {
+			t.Fatalf("expected delay %v, got %v", expected, delay)
+		}
+	}
+
+	// the bucket is refilled, but never above the burst
+	now = now.Add(time.Hour)
+	if !l.Full() {
+		t.Fatal("the bucket must be full after idle time")
+	}
+	for _, expected := range []time.Duration{0, 0, 100 * time.Millisecond} {
+		if delay := l.reserve(); delay != expected {
+			t.Fatalf("expected delay %v after idle time, got %v", expected, delay)
+		}
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	l := New(5, 1)
+	ctx := context.Background()
+	if err := l.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := l.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("Wait must be throttled, it has taken %v", d)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err must be %v, not %v", context.DeadlineExceeded, err)
+	}
+	// the token of the cancelled waiter is returned
+	if delay := l.reserve(); delay > 200*time.Millisecond {
+		t.Fatalf("the cancelled token has not been returned: delay %v", delay)
+	}
+}
+
+func TestLimiterReturn(t *testing.T) {
+	l := New(1, 1)
+	now := l.last
+	l.now = func() time.Time { return now }
+
+	l.reserve()
+	if l.Full() {
+		t.Fatal("the bucket must not be full after a token has been taken")
+	}
+	l.Return()
+	if !l.Full() {
+		t.Fatal("the bucket must be full after the token has been returned")
+	}
+}